@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"io"
+	"os"
+	"os/signal"
+
+	"github.com/threecorp/peerdrive/pkg/bus"
+	"github.com/threecorp/peerdrive/pkg/client"
+	"github.com/threecorp/peerdrive/pkg/ctrl"
+)
+
+// printEvents writes the events of b to w as JSON lines until ctx is done.
+func printEvents(ctx context.Context, b *bus.Bus, w io.Writer) {
+	events, cancel := b.Subscribe(0)
+	defer cancel()
+
+	enc := json.NewEncoder(w)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case ev := <-events:
+			if err := enc.Encode(ev); err != nil {
+				log.Errorw("events", "error", err)
+				return
+			}
+		}
+	}
+}
+
+// runEvents prints the events of the daemon as JSON lines until interrupted.
+func runEvents(argv []string) error {
+	fs := flag.NewFlagSet("events", flag.ExitOnError)
+	addr := fs.String("ctrl", ctrl.DefaultAddr, "Control interface address")
+	if err := fs.Parse(argv); err != nil {
+		return err
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	enc := json.NewEncoder(os.Stdout)
+	return client.New(client.Options{Addr: *addr}).Watch(ctx, func(ev *bus.Event) error {
+		return enc.Encode(ev)
+	})
+}
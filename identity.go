@@ -0,0 +1,196 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"golang.org/x/xerrors"
+
+	"github.com/threecorp/peerdrive/pkg/config"
+	"github.com/threecorp/peerdrive/pkg/identity"
+)
+
+// loadIdentity reads or creates the key file, with the rotations the node
+// keeps announcing.
+func loadIdentity(opts identity.Options) (crypto.PrivKey, identity.Chain, error) {
+	key, err := identity.Load(opts)
+	if err != nil {
+		return nil, nil, err
+	}
+	name, err := opts.File()
+	if err != nil {
+		return nil, nil, err
+	}
+	chain, err := identity.ReadRotations(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	return key, chain, nil
+}
+
+// runIdentity shows, exports, imports or rotates the key of the node. The
+// daemon picks a new key up once restarted.
+func runIdentity(argv []string) error {
+	usage := xerrors.New("want show, export [-o file], import [-force] <file> or rotate [-type t]")
+	if len(argv) == 0 {
+		return usage
+	}
+	cmd := argv[0]
+
+	fs := flag.NewFlagSet("identity "+cmd, flag.ExitOnError)
+	cfgFile := fs.String("config", os.Getenv(envName("config")), "YAML config file")
+	keyFile := fs.String("identity", os.Getenv(envName("identity")), "Key file, empty is in the user config dir")
+	out := fs.String("o", "", "export: file to write, empty is stdout")
+	force := fs.Bool("force", false, "import: replace the current key")
+	keyType := fs.String("type", "", "rotate: key type, ed25519, ecdsa or rsa")
+	if err := fs.Parse(argv[1:]); err != nil {
+		return err
+	}
+
+	cfg := config.Default()
+	if *cfgFile != "" {
+		var err error
+		if cfg, err = config.Load(*cfgFile); err != nil {
+			return err
+		}
+	}
+	if *keyFile != "" {
+		cfg.Identity.Path = *keyFile
+	}
+	opts := cfg.IdentityOptions()
+	name, err := opts.File()
+	if err != nil {
+		return err
+	}
+
+	switch cmd {
+	case "show":
+		key, err := identity.Load(opts)
+		if err != nil {
+			return err
+		}
+		return showIdentity(name, key)
+	case "export":
+		if _, err := identity.Load(opts); err != nil {
+			return err
+		}
+		data, err := os.ReadFile(name)
+		if err != nil {
+			return err
+		}
+		if *out == "" {
+			_, err = os.Stdout.Write(data)
+			return err
+		}
+		return os.WriteFile(*out, data, 0600)
+	case "import":
+		if fs.NArg() != 1 {
+			return usage
+		}
+		return importIdentity(name, fs.Arg(0), opts.Passphrase, *force)
+	case "rotate":
+		if *keyType != "" {
+			if opts.Type, err = identity.ParseType(*keyType); err != nil {
+				return err
+			}
+		}
+		return rotateIdentity(name, opts)
+	default:
+		return usage
+	}
+}
+
+func showIdentity(name string, key crypto.PrivKey) error {
+	id, err := peer.IDFromPrivateKey(key)
+	if err != nil {
+		return err
+	}
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return err
+	}
+	chain, err := identity.ReadRotations(name)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Peer: %s\n", id)
+	fmt.Printf("Type: %s\n", identity.TypeOf(key.GetPublic()))
+	if identity.Encrypted(data) {
+		fmt.Printf("File: %s (encrypted)\n", name)
+	} else {
+		fmt.Printf("File: %s\n", name)
+	}
+	for _, r := range chain {
+		if old, err := r.Verify(); err == nil {
+			fmt.Printf("Formerly: %s (rotated %s)\n", old, r.Time.Format("2006-01-02 15:04"))
+		}
+	}
+	return nil
+}
+
+// importIdentity replaces the key with the one in file, stored with the
+// current passphrase. Rotations of the replaced key don't apply anymore.
+func importIdentity(name, file, passphrase string, force bool) error {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	key, err := identity.Decode(data, passphrase)
+	if err != nil {
+		return xerrors.Errorf("%s: %w", file, err)
+	}
+	id, err := peer.IDFromPrivateKey(key)
+	if err != nil {
+		return err
+	}
+
+	if cur, err := identity.Read(name, passphrase); err == nil {
+		curID, _ := peer.IDFromPrivateKey(cur)
+		if curID != id && !force {
+			return xerrors.Errorf("%s holds %s, -force replaces it", name, curID)
+		}
+		if curID != id {
+			os.Remove(identity.RotationsPath(name))
+		}
+	} else if !os.IsNotExist(err) && !force {
+		return xerrors.Errorf("%w, -force replaces it", err)
+	}
+
+	if err := identity.Write(name, key, passphrase); err != nil {
+		return err
+	}
+	fmt.Printf("Peer: %s\n", id)
+	return nil
+}
+
+// rotateIdentity replaces the key with a new one. The old key signs the
+// rotation, and the daemon announces it so peers rename the device.
+func rotateIdentity(name string, opts identity.Options) error {
+	old, err := identity.Read(name, opts.Passphrase)
+	if err != nil {
+		return err
+	}
+	next, err := identity.Generate(opts.Type)
+	if err != nil {
+		return err
+	}
+	r, err := identity.NewRotation(old, next)
+	if err != nil {
+		return err
+	}
+	if err := identity.AddRotation(name, r); err != nil {
+		return err
+	}
+	if err := identity.Write(name, next, opts.Passphrase); err != nil {
+		return err
+	}
+
+	oldID, _ := peer.IDFromPrivateKey(old)
+	fmt.Printf("Peer: %s\nFormerly: %s\n", r.New, oldID)
+	fmt.Printf("Restart the daemon to announce the new peer ID\n")
+	return nil
+}
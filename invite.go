@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"path/filepath"
+	"time"
+
+	"golang.org/x/xerrors"
+
+	"github.com/threecorp/peerdrive/pkg/client"
+	"github.com/threecorp/peerdrive/pkg/config"
+	"github.com/threecorp/peerdrive/pkg/ctrl"
+	"github.com/threecorp/peerdrive/pkg/invite"
+	"github.com/threecorp/peerdrive/pkg/p2p"
+	"github.com/threecorp/peerdrive/pkg/snap"
+)
+
+func inviteFunc(srv *invite.Server, folders []*snap.Folder, cfgs []config.Folder) func(ctx context.Context, folder string, ttl time.Duration) (string, error) {
+	return func(ctx context.Context, folder string, ttl time.Duration) (string, error) {
+		for i, f := range folders {
+			if f.Dir != folder {
+				continue
+			}
+			cf := cfgs[i]
+			offer := invite.Offer{Rendezvous: cf.Rendezvous, Ignore: cf.Ignore, Password: cf.Password}
+			t, err := srv.Invite(f.Group, offer, ttl)
+			if err != nil {
+				return "", err
+			}
+			return t.String(), nil
+		}
+		return "", xerrors.Errorf("no folder %s", folder)
+	}
+}
+
+func joinFunc(node *p2p.Node) func(ctx context.Context, token string) (*ctrl.Join, error) {
+	return func(ctx context.Context, token string) (*ctrl.Join, error) {
+		t, err := invite.Parse(token)
+		if err != nil {
+			return nil, err
+		}
+		offer, err := invite.Join(ctx, node.Host, t)
+		if err != nil {
+			return nil, err
+		}
+		if err := node.SaveTrust(ctx, t.Group, offer.Trust); err != nil {
+			return nil, xerrors.Errorf("save trust: %w", err)
+		}
+
+		j := &ctrl.Join{Token: token, Rendezvous: offer.Rendezvous, Ignore: offer.Ignore, Password: offer.Password}
+		for _, e := range offer.Trust {
+			j.Trusted = append(j.Trusted, e.Peer.String())
+		}
+		return j, nil
+	}
+}
+
+// runInvite prints a single-use token that lets another device join folder.
+func runInvite(argv []string) error {
+	fs := flag.NewFlagSet("invite", flag.ExitOnError)
+	addr := fs.String("ctrl", ctrl.DefaultAddr, "Control interface address")
+	ttl := fs.Duration("ttl", invite.DefaultTTL, "How long the token stays valid")
+	if err := fs.Parse(argv); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return xerrors.New("usage: peerdrive invite [-ctrl addr] [-ttl d] <folder>")
+	}
+	folder, err := filepath.Abs(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	token, err := client.New(client.Options{Addr: *addr}).Invite(ctx, folder, *ttl)
+	if err != nil {
+		return err
+	}
+	fmt.Println(token)
+	return nil
+}
+
+// runJoin redeems a token with the running daemon, and adds the folder to
+// the config file, or prints it when there is none.
+func runJoin(argv []string) error {
+	fs := flag.NewFlagSet("join", flag.ExitOnError)
+	addr := fs.String("ctrl", ctrl.DefaultAddr, "Control interface address")
+	cfgFile := fs.String("config", "", "YAML config file to add the folder to")
+	dir := fs.String("sdir", "./", "Directory to sync the folder into")
+	mode := fs.String("mode", "", "Folder mode, send-receive by default")
+	if err := fs.Parse(argv); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return xerrors.New("usage: peerdrive join [-ctrl addr] [-config file] [-sdir dir] [-mode m] <token>")
+	}
+	var err error
+	var m snap.Mode // left out of the config file unless given
+	if *mode != "" {
+		if m, err = snap.ParseMode(*mode); err != nil {
+			return err
+		}
+	}
+	path, err := filepath.Abs(*dir)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	j, err := client.New(client.Options{Addr: *addr}).Join(ctx, fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	f := config.Folder{Path: path, Rendezvous: j.Rendezvous, Mode: m, Ignore: j.Ignore, Password: j.Password}
+	fmt.Printf("Joined, trusting %d peers\n", len(j.Trusted))
+
+	if *cfgFile == "" {
+		fmt.Printf("Add the folder to the config file, or run with -rv:\n")
+		fmt.Printf("  - path: %s\n    rendezvous: %q\n", f.Path, f.Rendezvous)
+		if len(f.Ignore) > 0 {
+			fmt.Printf("    ignore: %q\n", []string(f.Ignore))
+		}
+		if f.Password != "" {
+			fmt.Printf("    password: %q\n", f.Password)
+		}
+		return nil
+	}
+	if err := config.AddFolder(*cfgFile, f); err != nil {
+		return err
+	}
+	fmt.Printf("Added %s to %s, restart the daemon to sync it\n", f.Path, *cfgFile)
+	return nil
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"os"
+	"time"
+
+	"github.com/threecorp/peerdrive/pkg/bandwidth"
+	"github.com/threecorp/peerdrive/pkg/client"
+	"github.com/threecorp/peerdrive/pkg/ctrl"
+)
+
+func readJSON(name string, v any) error {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// runLimits shows the bandwidth limits of the running daemon, or replaces
+// them with -f and adjusts the global ones with -up and -down.
+func runLimits(argv []string) error {
+	fs := flag.NewFlagSet("limits", flag.ExitOnError)
+	addr := fs.String("ctrl", ctrl.DefaultAddr, "Control interface address")
+	file := fs.String("f", "", "Bandwidth limits and schedule JSON file to apply")
+	up := fs.Int64("up", -1, "Global upload limit in bytes/s, 0 is unlimited")
+	down := fs.Int64("down", -1, "Global download limit in bytes/s, 0 is unlimited")
+	if err := fs.Parse(argv); err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	c := client.New(client.Options{Addr: *addr})
+	cfg, err := c.Limits(ctx)
+	if err != nil {
+		return err
+	}
+	if *file != "" || *up >= 0 || *down >= 0 {
+		if *file != "" {
+			cfg = &bandwidth.Config{}
+			if err := readJSON(*file, cfg); err != nil {
+				return err
+			}
+		}
+		if *up >= 0 {
+			cfg.Global.Up = *up
+		}
+		if *down >= 0 {
+			cfg.Global.Down = *down
+		}
+		if err := c.SetLimits(ctx, cfg); err != nil {
+			return err
+		}
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(cfg)
+}
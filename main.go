@@ -3,68 +3,357 @@ package main
 import (
 	"context"
 	"flag"
-	"log"
+	"io"
+	"os"
+	"os/signal"
 	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
 
 	"golang.org/x/xerrors"
 
-	"github.com/threecorp/peerdrive/pkg/p2p"
-	"github.com/threecorp/peerdrive/pkg/snap"
+	"github.com/threecorp/peerdrive/pkg/bandwidth"
+	"github.com/threecorp/peerdrive/pkg/bus"
+	"github.com/threecorp/peerdrive/pkg/config"
+	"github.com/threecorp/peerdrive/pkg/ctrl"
+	"github.com/threecorp/peerdrive/pkg/engine"
+	"github.com/threecorp/peerdrive/pkg/event"
+	"github.com/threecorp/peerdrive/pkg/invite"
+	"github.com/threecorp/peerdrive/pkg/logging"
+	"github.com/threecorp/peerdrive/pkg/metrics"
 )
 
+var log = logging.Logger("peerdrive")
+
 type args struct {
+	*config.Config
+	ConfigFile string
+	LimitsFile string
 	Rendezvous string
-	Port       int
 	SyncDir    string
+	Events     string
 }
 
-func parseArgs() (*args, error) {
-	a := &args{}
+// drainTimeout bounds how long shutdown waits for running transfers.
+const drainTimeout = 30 * time.Second
+
+// envPrefix names the environment variables that stand in for flags, like
+// PEERDRIVE_PEER_WORKERS for -peer-workers.
+const envPrefix = "PEERDRIVE_"
 
-	flag.StringVar(&a.Rendezvous, "rv", "", "Rendezvous string like the only master key")
-	flag.IntVar(&a.Port, "port", 6868, "vpn-mesh port")
-	flag.StringVar(&a.SyncDir, "sdir", "./", "Synchornize directory")
+func envName(flagName string) string {
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(flagName, "-", "_"))
+}
 
-	flag.Parse()
+func newFlagSet(a *args) *flag.FlagSet {
+	fs := flag.NewFlagSet("peerdrive", flag.ContinueOnError)
 
-	seen := make(map[string]bool)
-	flag.Visit(func(f *flag.Flag) { seen[f.Name] = true })
-	for _, r := range []string{"rv"} {
-		if !seen[r] {
-			return nil, xerrors.Errorf("missing required -%s argument/flag", r)
+	fs.StringVar(&a.ConfigFile, "config", a.ConfigFile, "YAML config file, reloaded on SIGHUP")
+	fs.StringVar(&a.Identity.Path, "identity", a.Identity.Path, "Key file, empty is in the user config dir")
+	fs.StringVar(&a.Rendezvous, "rv", "", "Rendezvous string like the only master key")
+	fs.StringVar(&a.Name, "name", a.Name, "Device name told to peers, empty is the hostname")
+	fs.IntVar(&a.Port, "port", a.Port, "vpn-mesh port")
+	fs.StringVar(&a.SyncDir, "sdir", "./", "Synchornize directory")
+	fs.StringVar((*string)(&a.Watcher), "watcher", string(a.Watcher), "File watcher: auto, notify or poll")
+	fs.DurationVar(&a.Poll, "poll", a.Poll, "Polling watcher interval")
+	fs.IntVar(&a.Workers, "workers", a.Workers, "Concurrent transfers")
+	fs.IntVar(&a.PeerWorkers, "peer-workers", a.PeerWorkers, "Concurrent transfers per peer")
+	fs.StringVar(&a.Ctrl, "ctrl", a.Ctrl, "Control interface address, empty to disable")
+	fs.StringVar(&a.Metrics, "metrics", a.Metrics, "Prometheus metrics address, empty to disable")
+	fs.Int64Var(&a.Limits.Global.Up, "up", a.Limits.Global.Up, "Upload limit in bytes/s, 0 is unlimited")
+	fs.Int64Var(&a.Limits.Global.Down, "down", a.Limits.Global.Down, "Download limit in bytes/s, 0 is unlimited")
+	fs.DurationVar(&a.PartialAge, "partial-age", a.PartialAge, "Remove partial downloads untouched for longer")
+	fs.StringVar(&a.LimitsFile, "limits", "", "Bandwidth limits and schedule JSON file, reloaded on SIGHUP")
+	fs.StringVar(&a.Log.Level, "log-level", a.Log.Level, "Log level: debug, info, warn or error")
+	fs.StringVar((*string)(&a.Log.Format), "log-format", string(a.Log.Format), "Log format: text or json")
+	fs.StringVar(&a.Events, "events", "", "Sync events on stdout: json for JSON lines, empty for arrows")
+
+	return fs
+}
+
+// parseArgs layers the settings: flags win over PEERDRIVE_* environment
+// variables, which win over the config file, which wins over the defaults.
+// -rv and -sdir make up the folder when the config file has none, or
+// replace the settings of its only one.
+func parseArgs(argv []string) (*args, error) {
+	// The first pass only finds the config file
+	a := &args{Config: config.Default()}
+	if err := newFlagSet(a).Parse(argv); err != nil {
+		return nil, err
+	}
+	if a.ConfigFile == "" {
+		a.ConfigFile = os.Getenv(envName("config"))
+	}
+	cfg := config.Default()
+	if a.ConfigFile != "" {
+		var err error
+		if cfg, err = config.Load(a.ConfigFile); err != nil {
+			return nil, xerrors.Errorf("-config argument/flag: %w", err)
 		}
 	}
-	syncDir, err := filepath.Abs(a.SyncDir)
+
+	a = &args{Config: cfg, ConfigFile: a.ConfigFile}
+	fs := newFlagSet(a)
+	fs.SetOutput(io.Discard)
+	if err := fs.Parse(argv); err != nil {
+		return nil, err
+	}
+	seen := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { seen[f.Name] = true })
+
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		v, ok := os.LookupEnv(envName(f.Name))
+		if seen[f.Name] || !ok || err != nil {
+			return
+		}
+		if err = fs.Set(f.Name, v); err != nil {
+			err = xerrors.Errorf("%s: %w", envName(f.Name), err)
+		}
+		seen[f.Name] = true
+	})
 	if err != nil {
-		return nil, xerrors.Errorf("required -sdir argument/flag: %w", err)
+		return nil, err
+	}
+
+	if seen["rv"] || seen["sdir"] {
+		syncDir, err := filepath.Abs(a.SyncDir)
+		if err != nil {
+			return nil, xerrors.Errorf("-sdir argument/flag: %w", err)
+		}
+		switch len(a.Folders) {
+		case 0:
+			if !seen["rv"] {
+				return nil, xerrors.New("missing required -rv argument/flag")
+			}
+			a.Folders = append(a.Folders, config.Folder{Path: syncDir, Rendezvous: a.Rendezvous})
+		case 1:
+			if seen["rv"] {
+				a.Folders[0].Rendezvous = a.Rendezvous
+			}
+			if seen["sdir"] {
+				a.Folders[0].Path = syncDir
+			}
+		default:
+			return nil, xerrors.New("-rv and -sdir are ambiguous with several folders in the config file")
+		}
 	}
-	a.SyncDir = syncDir
 
+	if a.LimitsFile != "" {
+		lf := bandwidth.Config{}
+		if err := readJSON(a.LimitsFile, &lf); err != nil {
+			return nil, xerrors.Errorf("-limits argument/flag: %w", err)
+		}
+		if seen["up"] {
+			lf.Global.Up = a.Limits.Global.Up
+		}
+		if seen["down"] {
+			lf.Global.Down = a.Limits.Global.Down
+		}
+		a.Limits = lf
+	}
+
+	if a.Events != "" && a.Events != "json" {
+		return nil, xerrors.Errorf("-events argument/flag: %q, want json or empty", a.Events)
+	}
+	if err := a.Validate(); err != nil {
+		return nil, xerrors.Errorf("config: %w", err)
+	}
 	return a, nil
 }
 
 func main() {
+	logging.Setup(logging.DefaultOptions())
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "status":
+			if err := runStatus(os.Args[2:]); err != nil {
+				log.Fatalw("status", "error", err)
+			}
+			return
+		case "limits":
+			if err := runLimits(os.Args[2:]); err != nil {
+				log.Fatalw("limits", "error", err)
+			}
+			return
+		case "revert":
+			if err := runRevert(os.Args[2:]); err != nil {
+				log.Fatalw("revert", "error", err)
+			}
+			return
+		case "pause", "resume":
+			if err := runPause(os.Args[1], os.Args[2:]); err != nil {
+				log.Fatalw(os.Args[1], "error", err)
+			}
+			return
+		case "rescan":
+			if err := runRescan(os.Args[2:]); err != nil {
+				log.Fatalw("rescan", "error", err)
+			}
+			return
+		case "invite":
+			if err := runInvite(os.Args[2:]); err != nil {
+				log.Fatalw("invite", "error", err)
+			}
+			return
+		case "join":
+			if err := runJoin(os.Args[2:]); err != nil {
+				log.Fatalw("join", "error", err)
+			}
+			return
+		case "events":
+			if err := runEvents(os.Args[2:]); err != nil {
+				log.Fatalw("events", "error", err)
+			}
+			return
+		case "identity":
+			if err := runIdentity(os.Args[2:]); err != nil {
+				log.Fatalw("identity", "error", err)
+			}
+			return
+		}
+	}
+
 	// Arguments
-	args, err := parseArgs()
+	args, err := parseArgs(os.Args[1:])
+	if xerrors.Is(err, flag.ErrHelp) {
+		return
+	}
 	if err != nil {
-		log.Fatalf("parseArgs: %+v\n", err)
+		log.Fatalw("parse args", "error", err)
+	}
+	if err := setupLogging(args); err != nil {
+		log.Fatalw("logging", "error", err)
+	}
+	if err := run(args); err != nil {
+		log.Fatalw("run", "error", err)
+	}
+}
+
+// setupLogging applies the log settings of args, the sync activity joins
+// the logs when they are JSON or stdout is taken by JSON events.
+func setupLogging(args *args) error {
+	if err := logging.Setup(args.Log); err != nil {
+		return err
+	}
+	if args.Log.Format == logging.JSON || args.Events == "json" {
+		event.SetSinks(event.LogSink{})
+	} else {
+		event.SetSinks(event.NewPrettySink(os.Stdout))
+	}
+	return nil
+}
+
+// run serves until SIGINT or SIGTERM, then drains running transfers and
+// closes the node, badger last. SIGHUP reloads the limits and rescans,
+// other changes to the config need a restart.
+func run(args *args) error {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// Events
+	events := bus.New()
+	if args.Events == "json" {
+		go printEvents(ctx, events, os.Stdout)
 	}
-	ctx := context.Background()
 
 	// P2P Host
-	node, err := p2p.NewNode(ctx, args.Port, args.Rendezvous)
+	eopts := engine.DefaultOptions()
+	eopts.Node = args.NodeOptions()
+	eopts.Limits = args.Limits
+	eopts.Events = events
+	eopts.Drain = drainTimeout
+	var err error
+	if eopts.Node.Key, eopts.Node.Rotations, err = loadIdentity(args.IdentityOptions()); err != nil {
+		return xerrors.Errorf("identity: %w", err)
+	}
+	eng, err := engine.New(ctx, eopts)
 	if err != nil {
-		log.Fatalf("newNode: %+v\n", err)
+		return xerrors.Errorf("engine: %w", err)
+	}
+	defer func() {
+		log.Infow("draining transfers")
+		if err := eng.Close(); err != nil {
+			log.Errorw("close", "error", err)
+		}
+	}()
+	node, lim := eng.Node, eng.Limiter
+	log.Infow("started", "peer", node.Host.ID())
+
+	// Folders
+	for _, cf := range args.Folders {
+		if _, err := eng.Open(ctx, cf.Path, cf.Rendezvous, args.FolderOptions(&cf)); err != nil {
+			return xerrors.Errorf("folder %s: %w", cf.Path, err)
+		}
+	}
+	folders := eng.Folders()
+
+	// Control
+	if args.Ctrl != "" {
+		invites := invite.NewServer(node.Host)
+		defer invites.Close()
+		hs := eng.Handlers()
+		hs.Invite = inviteFunc(invites, folders, args.Folders)
+		hs.Join = joinFunc(node)
+		srv := ctrl.NewServer(args.Ctrl, hs)
+		defer srv.Close()
+		go func() {
+			if err := srv.ListenAndServe(); err != nil {
+				log.Errorw("control", "error", err)
+			}
+		}()
 	}
-	defer node.Close()
-	log.Printf("Peer: %s\n", node.Host.ID())
 
-	// Packet
-	node.Host.SetStreamHandler(snap.Protocol, snap.RWHandler(node))
+	// Metrics
+	if args.Metrics != "" {
+		srv := metrics.NewServer(args.Metrics)
+		defer srv.Close()
+		go func() {
+			if err := srv.ListenAndServe(); err != nil {
+				log.Errorw("metrics", "error", err)
+			}
+		}()
+	}
+
+	// Reload
+	rescan := make(chan struct{}, 1)
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-hup:
+			}
+			log.Infow("reloading")
+			if next, err := parseArgs(os.Args[1:]); err != nil {
+				log.Errorw("reload config", "error", err)
+			} else {
+				if err := setupLogging(next); err != nil {
+					log.Errorw("reload logging", "error", err)
+				}
+				lim.Set(next.Limits)
+				for _, f := range folders {
+					for _, cf := range next.Folders {
+						if cf.Rendezvous == f.Group.Rendezvous {
+							f.SetLimits(cf.Limits)
+						}
+					}
+				}
+			}
+			select {
+			case rescan <- struct{}{}:
+			default:
+			}
+		}
+	}()
 
 	// Synchornize
-	go snap.SnapWatcher(node, args.SyncDir)
+	eng.Run(ctx, rescan)
 
-	// Event Watcher
-	snap.SyncWatcher(node, args.SyncDir)
+	log.Infow("shutting down")
+	return nil
 }
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"path/filepath"
+	"time"
+
+	"golang.org/x/xerrors"
+
+	"github.com/threecorp/peerdrive/pkg/client"
+	"github.com/threecorp/peerdrive/pkg/ctrl"
+)
+
+// runPause pauses a folder of the running daemon, or resumes it when cmd is
+// resume.
+func runPause(cmd string, argv []string) error {
+	fs := flag.NewFlagSet(cmd, flag.ExitOnError)
+	addr := fs.String("ctrl", ctrl.DefaultAddr, "Control interface address")
+	if err := fs.Parse(argv); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return xerrors.Errorf("usage: peerdrive %s [-ctrl addr] <folder>", cmd)
+	}
+	folder, err := filepath.Abs(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	c := client.New(client.Options{Addr: *addr})
+	done := "Paused"
+	if cmd == "resume" {
+		err, done = c.Resume(ctx, folder), "Resumed"
+	} else {
+		err = c.Pause(ctx, folder)
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%s %s\n", done, folder)
+	return nil
+}
+
+// runRescan publishes what changed in a folder of the running daemon, or in
+// every folder, without waiting for the watchers.
+func runRescan(argv []string) error {
+	fs := flag.NewFlagSet("rescan", flag.ExitOnError)
+	addr := fs.String("ctrl", ctrl.DefaultAddr, "Control interface address")
+	if err := fs.Parse(argv); err != nil {
+		return err
+	}
+	if fs.NArg() > 1 {
+		return xerrors.New("usage: peerdrive rescan [-ctrl addr] [folder]")
+	}
+	folder := ""
+	if fs.NArg() == 1 {
+		var err error
+		if folder, err = filepath.Abs(fs.Arg(0)); err != nil {
+			return err
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	return client.New(client.Options{Addr: *addr}).Rescan(ctx, folder)
+}
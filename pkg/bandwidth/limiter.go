@@ -0,0 +1,194 @@
+package bandwidth
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	manet "github.com/multiformats/go-multiaddr/net"
+	"golang.org/x/time/rate"
+
+	"github.com/threecorp/peerdrive/pkg/clock"
+)
+
+// Limits are rates in bytes per second, zero is unlimited.
+type Limits struct {
+	Up   int64
+	Down int64
+}
+
+// Config holds the limits applied to snap streams and bitswap. LAN and WAN
+// apply per peer depending on the connection, Peers override both.
+type Config struct {
+	Global   Limits
+	LAN      Limits
+	WAN      Limits
+	Peers    map[peer.ID]Limits `json:",omitempty"`
+	Schedule []Rule             `json:",omitempty"`
+}
+
+// MarshalJSON writes peer IDs as text. encoding/json takes the raw bytes of
+// a string kinded map key, even though it reads keys with UnmarshalText.
+func (c Config) MarshalJSON() ([]byte, error) {
+	type config Config
+	peers := make(map[string]Limits, len(c.Peers))
+	for id, l := range c.Peers {
+		peers[id.String()] = l
+	}
+	return json.Marshal(struct {
+		config
+		Peers map[string]Limits `json:",omitempty"`
+	}{config(c), peers})
+}
+
+const minBurst = 32 << 10
+
+type pair struct {
+	up   *rate.Limiter
+	down *rate.Limiter
+}
+
+func newPair(l Limits) *pair {
+	p := &pair{up: rate.NewLimiter(rate.Inf, minBurst), down: rate.NewLimiter(rate.Inf, minBurst)}
+	p.set(l)
+	return p
+}
+
+func (p *pair) set(l Limits) {
+	setRate(p.up, l.Up)
+	setRate(p.down, l.Down)
+}
+
+func setRate(rl *rate.Limiter, bps int64) {
+	if bps <= 0 {
+		rl.SetLimit(rate.Inf)
+		return
+	}
+	burst := int(bps)
+	if burst < minBurst {
+		burst = minBurst
+	}
+	rl.SetLimit(rate.Limit(bps))
+	rl.SetBurst(burst)
+}
+
+type peerKey struct {
+	id  peer.ID
+	lan bool
+}
+
+// Limiter shapes stream traffic globally and per peer. Its config can be
+// replaced at runtime, streams already open pick the new rates up.
+type Limiter struct {
+	clock   clock.Clock // of the schedule
+	mu      sync.Mutex
+	cfg     Config
+	global  *pair
+	peers   map[peerKey]*pair
+	renamed map[peer.ID]peer.ID // peers that rotated their identity
+}
+
+// New is a limiter of cfg, following its schedule on clk, nil is
+// clock.Real.
+func New(cfg Config, clk clock.Clock) *Limiter {
+	l := &Limiter{clock: clock.OrReal(clk), global: newPair(Limits{}), peers: map[peerKey]*pair{}, renamed: map[peer.ID]peer.ID{}}
+	l.Set(cfg)
+	return l
+}
+
+func (l *Limiter) Config() Config {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.cfg
+}
+
+func (l *Limiter) Set(cfg Config) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.set(cfg)
+}
+
+func (l *Limiter) set(cfg Config) {
+	if len(l.renamed) > 0 && len(cfg.Peers) > 0 {
+		peers := make(map[peer.ID]Limits, len(cfg.Peers))
+		for id, lim := range cfg.Peers {
+			if next, ok := l.renamed[id]; ok {
+				id = next
+			}
+			peers[id] = lim
+		}
+		cfg.Peers = peers
+	}
+	l.cfg = cfg
+	l.global.set(cfg.Active(l.clock.Now()))
+	for k, p := range l.peers {
+		p.set(l.peerLimits(k))
+	}
+}
+
+// Rename moves the limits of old, a peer that rotated its identity, to
+// next. Configs set later get the same treatment.
+func (l *Limiter) Rename(old, next peer.ID) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for id, to := range l.renamed {
+		if to == old {
+			l.renamed[id] = next
+		}
+	}
+	l.renamed[old] = next
+	l.set(l.cfg)
+}
+
+// Run follows the schedule until ctx is done.
+func (l *Limiter) Run(ctx context.Context) {
+	ticker := l.clock.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C():
+			now := l.clock.Now()
+			l.mu.Lock()
+			l.global.set(l.cfg.Active(now))
+			l.mu.Unlock()
+		}
+	}
+}
+
+func (l *Limiter) peerLimits(k peerKey) Limits {
+	if lim, ok := l.cfg.Peers[k.id]; ok {
+		return lim
+	}
+	if k.lan {
+		return l.cfg.LAN
+	}
+	return l.cfg.WAN
+}
+
+func (l *Limiter) pairs(s network.Stream) []*pair {
+	k := peerKey{id: s.Conn().RemotePeer(), lan: isLAN(s.Conn())}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	p, ok := l.peers[k]
+	if !ok {
+		p = newPair(l.peerLimits(k))
+		l.peers[k] = p
+	}
+	return []*pair{l.global, p}
+}
+
+func isLAN(c network.Conn) bool {
+	ma := c.RemoteMultiaddr()
+	return manet.IsPrivateAddr(ma) || manet.IsIPLoopback(ma)
+}
@@ -0,0 +1,99 @@
+package bandwidth
+
+import (
+	"strings"
+	"time"
+
+	"golang.org/x/xerrors"
+)
+
+// Rule replaces the global limits between Start and End ("15:04", local
+// time) on Days ("mon".."sun", empty is every day). End before Start spans
+// midnight.
+type Rule struct {
+	Days   []string `json:",omitempty"`
+	Start  string
+	End    string
+	Limits Limits
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+func (r *Rule) Validate() error {
+	for _, d := range r.Days {
+		if _, ok := weekdays[strings.ToLower(d)]; !ok {
+			return xerrors.Errorf("schedule day %q, want mon..sun", d)
+		}
+	}
+	if _, err := time.Parse("15:04", r.Start); err != nil {
+		return xerrors.Errorf("schedule start %q: %w", r.Start, err)
+	}
+	if _, err := time.Parse("15:04", r.End); err != nil {
+		return xerrors.Errorf("schedule end %q: %w", r.End, err)
+	}
+	return nil
+}
+
+func (r *Rule) Match(now time.Time) bool {
+	start, err := time.Parse("15:04", r.Start)
+	if err != nil {
+		return false
+	}
+	end, err := time.Parse("15:04", r.End)
+	if err != nil {
+		return false
+	}
+	clock := now.Hour()*60 + now.Minute()
+	from := start.Hour()*60 + start.Minute()
+	to := end.Hour()*60 + end.Minute()
+
+	day := now.Weekday()
+	if to < from && clock < to {
+		day = (day + 6) % 7 // the rule started yesterday
+	}
+	if len(r.Days) != 0 && !r.onDay(day) {
+		return false
+	}
+
+	if from <= to {
+		return from <= clock && clock < to
+	}
+	return clock >= from || clock < to
+}
+
+func (r *Rule) onDay(day time.Weekday) bool {
+	for _, d := range r.Days {
+		if weekdays[strings.ToLower(d)] == day {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *Config) Validate() error {
+	for i := range c.Schedule {
+		if err := c.Schedule[i].Validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Active returns the global limits in effect at now, the first matching
+// rule wins.
+func (c *Config) Active(now time.Time) Limits {
+	for i := range c.Schedule {
+		if c.Schedule[i].Match(now) {
+			return c.Schedule[i].Limits
+		}
+	}
+	return c.Global
+}
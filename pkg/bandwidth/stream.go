@@ -0,0 +1,121 @@
+package bandwidth
+
+import (
+	"context"
+
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+)
+
+// stream waits for its limits until closed or reset, what ends the waits
+// with an error.
+type stream struct {
+	network.Stream
+	pairs  []*pair
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+func newStream(s network.Stream, pairs []*pair) *stream {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &stream{Stream: s, pairs: pairs, ctx: ctx, cancel: cancel}
+}
+
+// WrapStream rate limits reads and writes of s.
+func (l *Limiter) WrapStream(s network.Stream) network.Stream {
+	return newStream(s, l.pairs(s))
+}
+
+func (s *stream) Close() error {
+	s.cancel()
+	return s.Stream.Close()
+}
+
+func (s *stream) Reset() error {
+	s.cancel()
+	return s.Stream.Reset()
+}
+
+func (s *stream) Read(b []byte) (int, error) {
+	if len(b) > minBurst {
+		b = b[:minBurst]
+	}
+	n, err := s.Stream.Read(b)
+	if n > 0 {
+		for _, p := range s.pairs {
+			if werr := p.down.WaitN(s.ctx, n); werr != nil {
+				return n, werr
+			}
+		}
+	}
+	return n, err
+}
+
+func (s *stream) Write(b []byte) (int, error) {
+	written := 0
+	for len(b) > 0 {
+		chunk := b
+		if len(chunk) > minBurst {
+			chunk = chunk[:minBurst]
+		}
+		for _, p := range s.pairs {
+			if err := p.up.WaitN(s.ctx, len(chunk)); err != nil {
+				return written, err
+			}
+		}
+		n, err := s.Stream.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		b = b[n:]
+	}
+	return written, nil
+}
+
+type limitedHost struct {
+	host.Host
+	l *Limiter
+}
+
+// WrapHost rate limits every stream opened or accepted through the host,
+// like the snap protocol and bitswap.
+func WrapHost(h host.Host, l *Limiter) host.Host {
+	return &limitedHost{Host: h, l: l}
+}
+
+func (h *limitedHost) NewStream(ctx context.Context, p peer.ID, pids ...protocol.ID) (network.Stream, error) {
+	s, err := h.Host.NewStream(ctx, p, pids...)
+	if err != nil {
+		return nil, err
+	}
+	return h.l.WrapStream(s), nil
+}
+
+func (h *limitedHost) SetStreamHandler(pid protocol.ID, handler network.StreamHandler) {
+	h.Host.SetStreamHandler(pid, func(s network.Stream) { handler(h.l.WrapStream(s)) })
+}
+
+func (h *limitedHost) SetStreamHandlerMatch(pid protocol.ID, m func(protocol.ID) bool, handler network.StreamHandler) {
+	h.Host.SetStreamHandlerMatch(pid, m, func(s network.Stream) { handler(h.l.WrapStream(s)) })
+}
+
+// Shaper limits a set of streams on top of the Limiter, like the ones of
+// a single folder.
+type Shaper struct {
+	p *pair
+}
+
+func NewShaper(l Limits) *Shaper {
+	return &Shaper{p: newPair(l)}
+}
+
+func (sh *Shaper) Set(l Limits) {
+	sh.p.set(l)
+}
+
+func (sh *Shaper) WrapStream(s network.Stream) network.Stream {
+	return newStream(s, []*pair{sh.p})
+}
@@ -0,0 +1,102 @@
+package bus
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Type is the kind of sync activity an Event reports.
+type Type string
+
+const (
+	LocalChangeDetected Type = "LocalChangeDetected" // the watcher saw Path change
+	RemoteChangeApplied Type = "RemoteChangeApplied" // Peer's change of Path was written or removed
+	TransferStarted     Type = "TransferStarted"
+	TransferProgress    Type = "TransferProgress"
+	TransferFinished    Type = "TransferFinished" // Error is set when it will be retried or failed
+	ConflictCreated     Type = "ConflictCreated"  // a concurrent edit of Peer replaced the local Path, kept as Copy
+	PeerConnected       Type = "PeerConnected"
+	PeerDisconnected    Type = "PeerDisconnected"
+	PeerJoined          Type = "PeerJoined" // Peer was found sharing the folder of Group
+	PeerLeft            Type = "PeerLeft"   // Peer of Group disconnected
+	FolderError         Type = "FolderError"
+)
+
+// Event is one piece of sync activity. IDs grow by one per event of the
+// daemon, a gap tells a subscriber it missed some.
+type Event struct {
+	ID     uint64    `json:"id"`
+	Type   Type      `json:"type"`
+	Time   time.Time `json:"time"`
+	Folder string    `json:"folder,omitempty"`
+	Group  string    `json:"group,omitempty"`
+	Path   string    `json:"path,omitempty"`
+	Copy   string    `json:"copy,omitempty"` // of a conflict, next to Path
+	Peer   string    `json:"peer,omitempty"`
+	Op     string    `json:"op,omitempty"`
+	Size   int64     `json:"size,omitempty"`
+	Done   int64     `json:"done,omitempty"`
+	Error  string    `json:"error,omitempty"`
+}
+
+// DefaultBuffer is how many events a subscriber may lag behind before
+// newer ones are dropped for it.
+const DefaultBuffer = 256
+
+// Bus hands the events of the daemon to its subscribers. Publishing never
+// blocks, a slow subscriber misses events instead. A nil Bus drops them.
+type Bus struct {
+	id atomic.Uint64
+
+	mu   sync.RWMutex
+	subs map[chan Event]struct{}
+}
+
+func New() *Bus {
+	return &Bus{subs: map[chan Event]struct{}{}}
+}
+
+// Publish stamps ev with the next ID and, unless set, the current time.
+func (b *Bus) Publish(ev Event) {
+	if b == nil {
+		return
+	}
+	ev.ID = b.id.Add(1)
+	if ev.Time.IsZero() {
+		ev.Time = time.Now()
+	}
+
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	for ch := range b.subs {
+		select {
+		case ch <- ev:
+		default: // lagging behind
+		}
+	}
+}
+
+// Subscribe returns the events published from now on, until cancel is
+// called. buf <= 0 is DefaultBuffer.
+func (b *Bus) Subscribe(buf int) (events <-chan Event, cancel func()) {
+	if buf <= 0 {
+		buf = DefaultBuffer
+	}
+	ch := make(chan Event, buf)
+
+	b.mu.Lock()
+	b.subs[ch] = struct{}{}
+	b.mu.Unlock()
+
+	once := sync.Once{}
+	return ch, func() {
+		once.Do(func() {
+			b.mu.Lock()
+			delete(b.subs, ch)
+			b.mu.Unlock()
+			close(ch)
+		})
+	}
+}
@@ -0,0 +1,224 @@
+// Package client talks to a running daemon through its local control
+// interface, see pkg/ctrl.
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"golang.org/x/xerrors"
+
+	"github.com/threecorp/peerdrive/pkg/bandwidth"
+	"github.com/threecorp/peerdrive/pkg/bus"
+	"github.com/threecorp/peerdrive/pkg/ctrl"
+)
+
+// Options are the settings of a client.
+type Options struct {
+	Addr string       // of the control interface
+	HTTP *http.Client // nil is http.DefaultClient
+}
+
+func DefaultOptions() Options {
+	return Options{Addr: ctrl.DefaultAddr}
+}
+
+// Client calls the daemon listening on Options.Addr. Folders are named by
+// their absolute path.
+type Client struct {
+	opts Options
+}
+
+func New(opts Options) *Client {
+	if opts.Addr == "" {
+		opts.Addr = ctrl.DefaultAddr
+	}
+	if opts.HTTP == nil {
+		opts.HTTP = http.DefaultClient
+	}
+	return &Client{opts: opts}
+}
+
+// Status is the peers, folders and transfers of the daemon.
+func (c *Client) Status(ctx context.Context) (*ctrl.Status, error) {
+	st := &ctrl.Status{}
+	if err := c.call(ctx, http.MethodGet, "/status", nil, st); err != nil {
+		return nil, err
+	}
+	return st, nil
+}
+
+// Folder is the status of folder.
+func (c *Client) Folder(ctx context.Context, folder string) (*ctrl.Folder, error) {
+	st, err := c.Status(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for i := range st.Folders {
+		if st.Folders[i].Path == folder {
+			return &st.Folders[i], nil
+		}
+	}
+	return nil, xerrors.Errorf("no folder %s", folder)
+}
+
+func (c *Client) Limits(ctx context.Context) (*bandwidth.Config, error) {
+	cfg := &bandwidth.Config{}
+	if err := c.call(ctx, http.MethodGet, "/limits", nil, cfg); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// SetLimits replaces the bandwidth limits, cfg becomes the ones applied.
+func (c *Client) SetLimits(ctx context.Context, cfg *bandwidth.Config) error {
+	return c.call(ctx, http.MethodPut, "/limits", cfg, cfg)
+}
+
+// Pause stops syncing folder until Resume, its files are still served to
+// peers.
+func (c *Client) Pause(ctx context.Context, folder string) error {
+	return c.call(ctx, http.MethodPost, "/pause", &ctrl.Pause{Folder: folder, Paused: true}, &ctrl.Pause{})
+}
+
+// Resume syncs folder again, what changed meanwhile included.
+func (c *Client) Resume(ctx context.Context, folder string) error {
+	return c.call(ctx, http.MethodPost, "/pause", &ctrl.Pause{Folder: folder}, &ctrl.Pause{})
+}
+
+// Rescan publishes what changed in folder without waiting for its watcher,
+// in every folder when empty.
+func (c *Client) Rescan(ctx context.Context, folder string) error {
+	return c.call(ctx, http.MethodPost, "/rescan", &ctrl.Rescan{Folder: folder}, &ctrl.Rescan{})
+}
+
+// Revert drops the local changes of a receive-only folder.
+func (c *Client) Revert(ctx context.Context, folder string) (int, error) {
+	rv := &ctrl.Revert{Folder: folder}
+	if err := c.call(ctx, http.MethodPost, "/revert", rv, rv); err != nil {
+		return 0, err
+	}
+	return rv.Reverted, nil
+}
+
+// Invite makes a single-use token for folder, valid for ttl.
+func (c *Client) Invite(ctx context.Context, folder string, ttl time.Duration) (string, error) {
+	inv := &ctrl.Invite{Folder: folder, TTL: ttl}
+	if err := c.call(ctx, http.MethodPost, "/invite", inv, inv); err != nil {
+		return "", err
+	}
+	return inv.Token, nil
+}
+
+// Join redeems token with the inviter, the daemon trusts the peers of the
+// folder from then on.
+func (c *Client) Join(ctx context.Context, token string) (*ctrl.Join, error) {
+	j := &ctrl.Join{Token: token}
+	if err := c.call(ctx, http.MethodPost, "/join", j, j); err != nil {
+		return nil, err
+	}
+	return j, nil
+}
+
+// Subscription is the stream of events of the daemon from the time it was
+// made.
+type Subscription struct {
+	resp *http.Response
+	dec  *json.Decoder
+}
+
+// Subscribe follows the events of the daemon until ctx is done or Close.
+func (c *Client) Subscribe(ctx context.Context) (*Subscription, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.url("/events"), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.opts.HTTP.Do(req)
+	if err != nil {
+		return nil, xerrors.Errorf("GET /events: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		return nil, httpError(http.MethodGet, "/events", resp)
+	}
+	return &Subscription{resp: resp, dec: json.NewDecoder(resp.Body)}, nil
+}
+
+// Next waits for the next event. It fails once the subscription is closed
+// or its ctx is done.
+func (s *Subscription) Next() (*bus.Event, error) {
+	ev := &bus.Event{}
+	if err := s.dec.Decode(ev); err != nil {
+		return nil, xerrors.Errorf("GET /events decode: %w", err)
+	}
+	return ev, nil
+}
+
+func (s *Subscription) Close() error {
+	return s.resp.Body.Close()
+}
+
+// Watch calls fn with the events of the daemon until ctx is done, which is
+// no error, or fn fails.
+func (c *Client) Watch(ctx context.Context, fn func(ev *bus.Event) error) error {
+	sub, err := c.Subscribe(ctx)
+	if err != nil {
+		return err
+	}
+	defer sub.Close()
+
+	for {
+		ev, err := sub.Next()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		if err := fn(ev); err != nil {
+			return err
+		}
+	}
+}
+
+func (c *Client) url(path string) string {
+	return fmt.Sprintf("http://%s%s", c.opts.Addr, path)
+}
+
+func (c *Client) call(ctx context.Context, method, path string, in, out any) error {
+	var body io.Reader
+	if in != nil {
+		data, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.url(path), body)
+	if err != nil {
+		return err
+	}
+	resp, err := c.opts.HTTP.Do(req)
+	if err != nil {
+		return xerrors.Errorf("%s %s: %w", method, path, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return httpError(method, path, resp)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return xerrors.Errorf("%s %s decode: %w", method, path, err)
+	}
+	return nil
+}
+
+func httpError(method, path string, resp *http.Response) error {
+	msg, _ := io.ReadAll(resp.Body)
+	return xerrors.Errorf("%s %s: %s %s", method, path, resp.Status, bytes.TrimSpace(msg))
+}
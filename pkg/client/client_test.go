@@ -0,0 +1,147 @@
+package client
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/xerrors"
+
+	"github.com/threecorp/peerdrive/pkg/bus"
+	"github.com/threecorp/peerdrive/pkg/ctrl"
+	"github.com/threecorp/peerdrive/pkg/harness"
+)
+
+// serve answers the control interface of nd in process, like its daemon
+// would, until the test ends.
+func serve(t *testing.T, nd *harness.Node) *Client {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := ctrl.NewServer("", nd.Engine.Handlers())
+	go srv.Serve(ln)
+	t.Cleanup(func() { srv.Close() })
+	return New(Options{Addr: ln.Addr().String()})
+}
+
+func TestStatus(t *testing.T) {
+	h := harness.New(t, 2, harness.DefaultOptions())
+	a := h.Nodes[0]
+	c := serve(t, a)
+	ctx := context.Background()
+
+	st, err := c.Status(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.Peer != a.ID().String() {
+		t.Errorf("peer %s, want %s", st.Peer, a.ID())
+	}
+	f, err := c.Folder(ctx, a.Dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.Paused {
+		t.Errorf("%s paused", f.Path)
+	}
+	if _, err := c.Folder(ctx, "/nowhere"); err == nil {
+		t.Error("status of /nowhere")
+	}
+}
+
+// TestPause writes on a paused node, which keeps the change to itself until
+// resumed.
+func TestPause(t *testing.T) {
+	h := harness.New(t, 2, harness.DefaultOptions())
+	a, b := h.Nodes[0], h.Nodes[1]
+	c := serve(t, a)
+	ctx := context.Background()
+
+	a.Write("a.txt", "one")
+	h.WaitTree(map[string]string{"a.txt": "one"})
+
+	if err := c.Pause(ctx, a.Dir); err != nil {
+		t.Fatal(err)
+	}
+	f, err := c.Folder(ctx, a.Dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !f.Paused {
+		t.Fatalf("%s not paused", a.Dir)
+	}
+	a.Write("a.txt", "two")
+	b.Write("b.txt", "beta")
+	time.Sleep(time.Second) // some syncs of the harness
+	if got := b.Read("a.txt"); got != "one" {
+		t.Errorf("synced %q while paused", got)
+	}
+	if _, ok := a.Tree()["b.txt"]; ok {
+		t.Error("applied b.txt while paused")
+	}
+
+	if err := c.Resume(ctx, a.Dir); err != nil {
+		t.Fatal(err)
+	}
+	h.WaitTree(map[string]string{"a.txt": "two", "b.txt": "beta"})
+
+	if err := c.Pause(ctx, "/nowhere"); err == nil {
+		t.Error("paused /nowhere")
+	}
+}
+
+// TestRescan publishes a change the watcher of the node would only see in
+// an hour.
+func TestRescan(t *testing.T) {
+	opts := harness.DefaultOptions()
+	opts.Folder.Interval = time.Hour
+	h := harness.New(t, 2, opts)
+	a := h.Nodes[0]
+	c := serve(t, a)
+
+	a.Write("a.txt", "alpha")
+	h.Wait("rescanned", func() error {
+		if err := c.Rescan(context.Background(), a.Dir); err != nil {
+			return err
+		}
+		if got := h.Nodes[1].Tree()["a.txt"]; got != "alpha" {
+			return xerrors.Errorf("a.txt %q", got)
+		}
+		return nil
+	})
+}
+
+func TestSubscribe(t *testing.T) {
+	h := harness.New(t, 2, harness.DefaultOptions())
+	a, b := h.Nodes[0], h.Nodes[1]
+	c := serve(t, a)
+	ctx, cancel := context.WithTimeout(context.Background(), h.Opts.Timeout)
+	defer cancel()
+
+	sub, err := c.Subscribe(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+
+	b.Write("b.txt", "beta")
+	for {
+		ev, err := sub.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ev.Type == bus.RemoteChangeApplied && ev.Path == "b.txt" {
+			break
+		}
+	}
+	cancel()
+	for { // what was buffered, then the end
+		if _, err := sub.Next(); err != nil {
+			break
+		}
+	}
+}
@@ -0,0 +1,80 @@
+// Package clock is the time of a node, replaced in simulations to skew it
+// against its peers.
+package clock
+
+import "time"
+
+// Clock tells the time and waits for it.
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+	NewTicker(d time.Duration) Ticker
+	NewTimer(d time.Duration) Timer
+	AfterFunc(d time.Duration, f func()) Timer // C of the timer is nil
+}
+
+// Ticker sends the time on C every period until stopped.
+type Ticker interface {
+	C() <-chan time.Time
+	Stop()
+}
+
+// Timer sends the time on C once, like time.Timer.
+type Timer interface {
+	C() <-chan time.Time
+	Stop() bool
+	Reset(d time.Duration) bool
+}
+
+// Real is the system clock.
+var Real Clock = real{}
+
+type real struct{}
+
+func (real) Now() time.Time                         { return time.Now() }
+func (real) After(d time.Duration) <-chan time.Time { return time.After(d) }
+func (real) NewTicker(d time.Duration) Ticker       { return realTicker{time.NewTicker(d)} }
+func (real) NewTimer(d time.Duration) Timer         { return realTimer{time.NewTimer(d)} }
+
+func (real) AfterFunc(d time.Duration, f func()) Timer {
+	return realTimer{time.AfterFunc(d, f)}
+}
+
+type realTicker struct{ t *time.Ticker }
+
+func (t realTicker) C() <-chan time.Time { return t.t.C }
+func (t realTicker) Stop()               { t.t.Stop() }
+
+type realTimer struct{ t *time.Timer }
+
+func (t realTimer) C() <-chan time.Time        { return t.t.C }
+func (t realTimer) Stop() bool                 { return t.t.Stop() }
+func (t realTimer) Reset(d time.Duration) bool { return t.t.Reset(d) }
+
+// Since is the time elapsed on c since t.
+func Since(c Clock, t time.Time) time.Duration {
+	return c.Now().Sub(t)
+}
+
+// Skewed is c running ahead by skew, or behind when negative. Waits take as
+// long as on c.
+func Skewed(c Clock, skew time.Duration) Clock {
+	return skewed{Clock: c, skew: skew}
+}
+
+type skewed struct {
+	Clock
+	skew time.Duration
+}
+
+func (s skewed) Now() time.Time {
+	return s.Clock.Now().Add(s.skew)
+}
+
+// OrReal is c, or Real when c is nil.
+func OrReal(c Clock) Clock {
+	if c == nil {
+		return Real
+	}
+	return c
+}
@@ -0,0 +1,344 @@
+package config
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/xerrors"
+	"gopkg.in/yaml.v3"
+
+	"github.com/threecorp/peerdrive/pkg/bandwidth"
+	"github.com/threecorp/peerdrive/pkg/ctrl"
+	"github.com/threecorp/peerdrive/pkg/dev"
+	"github.com/threecorp/peerdrive/pkg/hook"
+	"github.com/threecorp/peerdrive/pkg/identity"
+	"github.com/threecorp/peerdrive/pkg/logging"
+	"github.com/threecorp/peerdrive/pkg/metrics"
+	"github.com/threecorp/peerdrive/pkg/p2p"
+	"github.com/threecorp/peerdrive/pkg/snap"
+	"github.com/threecorp/peerdrive/pkg/watch"
+)
+
+type (
+	// Timing holds the intervals that used to be hard-coded.
+	Timing struct {
+		Rebroadcast time.Duration // CRDT heads
+		Discovery   time.Duration // DHT advertise and find peers
+		KeepAlive   time.Duration `yaml:"keep_alive"`
+		Settle      time.Duration // quiet time after local changes before a snapshot
+		WriteDelay  time.Duration `yaml:"write_delay"`    // before a changed file is looked at
+		WriteSize   int64         `yaml:"write_min_size"` // larger files are watched until their mtime holds
+		WriteCheck  time.Duration `yaml:"write_check"`
+	}
+	Versioning struct {
+		Keep int // old copies of files replaced or removed by peers, 0 is off
+	}
+	// Folder is a sync folder and the group it is shared with.
+	Folder struct {
+		Path       string
+		Rendezvous string
+		Ignore     dev.Ignore
+		Mode       snap.Mode
+		Versioning Versioning
+		Limits     bandwidth.Limits // on top of the node limits
+		Password   string           // end-to-end encrypts the folder for untrusted peers
+		Hooks      hook.Config
+	}
+	// Identity is the key file of the node.
+	Identity struct {
+		Path string        // empty is in the per-user config dir
+		Type identity.Type // of a new key
+	}
+	Config struct {
+		Identity    Identity
+		Name        string // of the device, told to peers, empty is the hostname
+		Port        int
+		Ctrl        string
+		Metrics     string // Prometheus /metrics address, empty disables it
+		Log         logging.Options
+		Watcher     watch.Backend
+		Poll        time.Duration
+		Workers     int
+		PeerWorkers int           `yaml:"peer_workers"`
+		PartialAge  time.Duration `yaml:"partial_age"`
+		Limits      bandwidth.Config
+		Timing      Timing
+		Folders     []Folder
+	}
+)
+
+func Default() *Config {
+	nd, so := p2p.DefaultOptions(), snap.DefaultOptions()
+	return &Config{
+		Identity:    Identity{Type: identity.Ed25519},
+		Port:        nd.Port,
+		Ctrl:        ctrl.DefaultAddr,
+		Metrics:     metrics.DefaultAddr,
+		Log:         logging.DefaultOptions(),
+		Watcher:     so.Watcher,
+		Poll:        so.Interval,
+		Workers:     so.Transfer.Workers,
+		PeerWorkers: so.Transfer.PerPeer,
+		PartialAge:  so.PartialAge,
+		Timing: Timing{
+			Rebroadcast: nd.RebroadcastInterval,
+			Discovery:   nd.DiscoveryInterval,
+			KeepAlive:   nd.KeepAliveInterval,
+			Settle:      so.Settle,
+			WriteDelay:  so.WriteCheck.Delay,
+			WriteSize:   so.WriteCheck.MinSize,
+			WriteCheck:  so.WriteCheck.Interval,
+		},
+	}
+}
+
+// Load reads a YAML config file over the defaults. Relative folder paths
+// are taken from the directory of the file.
+func Load(name string) (*Config, error) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := Default()
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(cfg); err != nil {
+		return nil, xerrors.Errorf("%s: %w", name, err)
+	}
+
+	base := filepath.Dir(name)
+	if cfg.Identity.Path != "" {
+		if cfg.Identity.Path, err = expandPath(base, cfg.Identity.Path); err != nil {
+			return nil, err
+		}
+	}
+	for i := range cfg.Folders {
+		path, err := expandPath(base, cfg.Folders[i].Path)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Folders[i].Path = path
+	}
+	return cfg, nil
+}
+
+func expandPath(base, path string) (string, error) {
+	if path == "~" || strings.HasPrefix(path, "~/") {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "", err
+		}
+		path = filepath.Join(home, path[1:])
+	}
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(base, path)
+	}
+	return filepath.Abs(path)
+}
+
+// Validate checks the settings and the folders, and fills in the key type
+// and folder modes.
+func (c *Config) Validate() error {
+	t, err := identity.ParseType(string(c.Identity.Type))
+	if err != nil {
+		return xerrors.Errorf("identity: %w", err)
+	}
+	c.Identity.Type = t
+	if err := c.Log.Validate(); err != nil {
+		return xerrors.Errorf("log: %w", err)
+	}
+	if c.Port < 0 || c.Port > 65535 {
+		return xerrors.Errorf("port %d out of range", c.Port)
+	}
+	if _, err := watch.ParseBackend(string(c.Watcher)); err != nil {
+		return err
+	}
+	if c.Poll <= 0 {
+		return xerrors.Errorf("poll %s, want a positive interval", c.Poll)
+	}
+	if c.Workers <= 0 || c.PeerWorkers <= 0 {
+		return xerrors.Errorf("workers %d and peer_workers %d, want at least 1", c.Workers, c.PeerWorkers)
+	}
+	if c.PartialAge <= 0 {
+		return xerrors.Errorf("partial_age %s, want a positive age", c.PartialAge)
+	}
+	if err := c.Limits.Validate(); err != nil {
+		return xerrors.Errorf("limits: %w", err)
+	}
+	for name, d := range map[string]time.Duration{
+		"rebroadcast": c.Timing.Rebroadcast,
+		"discovery":   c.Timing.Discovery,
+		"keep_alive":  c.Timing.KeepAlive,
+		"settle":      c.Timing.Settle,
+		"write_check": c.Timing.WriteCheck,
+	} {
+		if d <= 0 {
+			return xerrors.Errorf("timing %s %s, want a positive interval", name, d)
+		}
+	}
+	if c.Timing.WriteDelay < 0 || c.Timing.WriteSize < 0 {
+		return xerrors.New("timing write_delay and write_min_size can't be negative")
+	}
+
+	if len(c.Folders) == 0 {
+		return xerrors.New("no folder, set -rv and -sdir or add one to the config file")
+	}
+	paths, rvs := map[string]bool{}, map[string]bool{}
+	for i := range c.Folders {
+		f := &c.Folders[i]
+		if err := f.validate(); err != nil {
+			return xerrors.Errorf("folder %s: %w", f.Path, err)
+		}
+		if rvs[f.Rendezvous] {
+			return xerrors.Errorf("folder %s: rendezvous used by another folder", f.Path)
+		}
+		rvs[f.Rendezvous] = true
+		for p := range paths {
+			if within(p, f.Path) || within(f.Path, p) {
+				return xerrors.Errorf("folder %s overlaps %s", f.Path, p)
+			}
+		}
+		paths[f.Path] = true
+	}
+	return nil
+}
+
+func (f *Folder) validate() error {
+	if f.Rendezvous == "" {
+		return xerrors.New("missing rendezvous")
+	}
+	fi, err := os.Stat(f.Path)
+	if err != nil {
+		return err
+	}
+	if !fi.IsDir() {
+		return xerrors.New("not a directory")
+	}
+	mode, err := snap.ParseMode(string(f.Mode))
+	if err != nil {
+		return err
+	}
+	f.Mode = mode
+	if f.Password != "" && f.Mode == snap.Relay {
+		return xerrors.Errorf("%s stores sealed content as is, it takes no password", snap.Relay)
+	}
+	if err := f.Ignore.Validate(); err != nil {
+		return err
+	}
+	if f.Versioning.Keep < 0 {
+		return xerrors.Errorf("versioning keep %d can't be negative", f.Versioning.Keep)
+	}
+	if f.Limits.Up < 0 || f.Limits.Down < 0 {
+		return xerrors.New("limits can't be negative")
+	}
+	if err := f.Hooks.Validate(); err != nil {
+		return xerrors.Errorf("hooks: %w", err)
+	}
+	return nil
+}
+
+func within(dir, path string) bool {
+	rel, err := filepath.Rel(dir, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// IdentityOptions locate the key file, its passphrase comes from the
+// environment only.
+func (c *Config) IdentityOptions() identity.Options {
+	opts := identity.DefaultOptions()
+	opts.Path = c.Identity.Path
+	if c.Identity.Type != "" {
+		opts.Type = c.Identity.Type
+	}
+	return opts
+}
+
+// NodeOptions are the p2p settings of the config.
+func (c *Config) NodeOptions() p2p.Options {
+	return p2p.Options{
+		Name:                c.Name,
+		Port:                c.Port,
+		RebroadcastInterval: c.Timing.Rebroadcast,
+		DiscoveryInterval:   c.Timing.Discovery,
+		KeepAliveInterval:   c.Timing.KeepAlive,
+		MDNS:                true,
+	}
+}
+
+// FolderOptions are the snap settings of folder f.
+func (c *Config) FolderOptions(f *Folder) snap.Options {
+	opts := snap.DefaultOptions()
+	opts.Mode = f.Mode
+	opts.Watcher = c.Watcher
+	opts.Interval = c.Poll
+	opts.Settle = c.Timing.Settle
+	opts.WriteCheck = dev.WriteCheck{Delay: c.Timing.WriteDelay, MinSize: c.Timing.WriteSize, Interval: c.Timing.WriteCheck}
+	opts.Transfer.Workers = c.Workers
+	opts.Transfer.PerPeer = c.PeerWorkers
+	opts.PartialAge = c.PartialAge
+	opts.Ignore = f.Ignore
+	opts.Versions = f.Versioning.Keep
+	opts.Limits = f.Limits
+	opts.Password = f.Password
+	opts.Hooks = f.Hooks
+	return opts
+}
+
+// AddFolder appends f to the folders of the config file name, creating the
+// file when missing. The rest of the file, comments included, is kept.
+func AddFolder(name string, f Folder) error {
+	entry := struct {
+		Path       string
+		Rendezvous string
+		Mode       snap.Mode  `yaml:",omitempty"`
+		Ignore     dev.Ignore `yaml:",omitempty"`
+		Password   string     `yaml:",omitempty"`
+	}{f.Path, f.Rendezvous, f.Mode, f.Ignore, f.Password}
+	item := &yaml.Node{}
+	if err := item.Encode(entry); err != nil {
+		return err
+	}
+
+	doc := &yaml.Node{}
+	data, err := os.ReadFile(name)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := yaml.Unmarshal(data, doc); err != nil {
+		return xerrors.Errorf("%s: %w", name, err)
+	}
+	if doc.Kind == 0 {
+		doc = &yaml.Node{Kind: yaml.DocumentNode, Content: []*yaml.Node{{Kind: yaml.MappingNode, Tag: "!!map"}}}
+	}
+	root := doc.Content[0]
+	if root.Kind != yaml.MappingNode {
+		return xerrors.Errorf("%s: not a mapping", name)
+	}
+
+	var folders *yaml.Node
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		if root.Content[i].Value == "folders" {
+			folders = root.Content[i+1]
+		}
+	}
+	if folders == nil || folders.Kind != yaml.SequenceNode {
+		if folders != nil {
+			return xerrors.Errorf("%s: folders is not a list", name)
+		}
+		folders = &yaml.Node{Kind: yaml.SequenceNode, Tag: "!!seq"}
+		root.Content = append(root.Content, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: "folders"}, folders)
+	}
+	folders.Content = append(folders.Content, item)
+
+	buf := bytes.NewBuffer(nil)
+	enc := yaml.NewEncoder(buf)
+	enc.SetIndent(2)
+	if err := enc.Encode(doc); err != nil {
+		return err
+	}
+	return os.WriteFile(name, buf.Bytes(), 0600)
+}
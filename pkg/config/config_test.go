@@ -0,0 +1,142 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/threecorp/peerdrive/pkg/hook"
+	"github.com/threecorp/peerdrive/pkg/snap"
+)
+
+func TestValidate(t *testing.T) {
+	dir := t.TempDir()
+	a, b := filepath.Join(dir, "a"), filepath.Join(dir, "b")
+	for _, d := range []string{a, b, filepath.Join(a, "sub")} {
+		if err := os.MkdirAll(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	file := filepath.Join(dir, "file")
+	if err := os.WriteFile(file, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		name string
+		edit func(c *Config)
+		want string // in the error, empty for none
+	}{
+		{"default", func(c *Config) {}, ""},
+		{"two folders", func(c *Config) { c.Folders = append(c.Folders, Folder{Path: b, Rendezvous: "rv2"}) }, ""},
+		{"no folder", func(c *Config) { c.Folders = nil }, "no folder"},
+		{"identity type", func(c *Config) { c.Identity.Type = "dsa" }, "identity"},
+		{"port", func(c *Config) { c.Port = 70000 }, "port 70000"},
+		{"watcher", func(c *Config) { c.Watcher = "inotify" }, "inotify"},
+		{"poll", func(c *Config) { c.Poll = 0 }, "poll"},
+		{"workers", func(c *Config) { c.PeerWorkers = 0 }, "peer_workers"},
+		{"partial age", func(c *Config) { c.PartialAge = -time.Hour }, "partial_age"},
+		{"timing", func(c *Config) { c.Timing.KeepAlive = 0 }, "keep_alive"},
+		{"write delay", func(c *Config) { c.Timing.WriteDelay = -time.Second }, "write_delay"},
+		{"rendezvous", func(c *Config) { c.Folders[0].Rendezvous = "" }, "missing rendezvous"},
+		{"missing path", func(c *Config) { c.Folders[0].Path = filepath.Join(dir, "nowhere") }, "nowhere"},
+		{"not a directory", func(c *Config) { c.Folders[0].Path = file }, "not a directory"},
+		{"mode", func(c *Config) { c.Folders[0].Mode = "mirror" }, "mirror"},
+		{"relay password", func(c *Config) { c.Folders[0].Mode, c.Folders[0].Password = snap.Relay, "secret" }, "no password"},
+		{"ignore", func(c *Config) { c.Folders[0].Ignore = []string{"["} }, "ignore pattern"},
+		{"versioning", func(c *Config) { c.Folders[0].Versioning.Keep = -1 }, "versioning"},
+		{"limits", func(c *Config) { c.Folders[0].Limits.Up = -1 }, "limits"},
+		{"hook", func(c *Config) { c.Folders[0].Hooks.OnConflict = []hook.Hook{{}} }, "missing command"},
+		{"same rendezvous", func(c *Config) { c.Folders = append(c.Folders, Folder{Path: b, Rendezvous: "rv"}) }, "rendezvous used"},
+		{"nested", func(c *Config) {
+			c.Folders = append(c.Folders, Folder{Path: filepath.Join(a, "sub"), Rendezvous: "rv2"})
+		}, "overlaps"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			c := Default()
+			c.Folders = []Folder{{Path: a, Rendezvous: "rv"}}
+			tt.edit(c)
+			err := c.Validate()
+			switch {
+			case tt.want == "" && err != nil:
+				t.Errorf("error %v", err)
+			case tt.want != "" && err == nil:
+				t.Errorf("no error, want %q", tt.want)
+			case tt.want != "" && !strings.Contains(err.Error(), tt.want):
+				t.Errorf("error %v, want %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidateFillsIn(t *testing.T) {
+	c := Default()
+	c.Identity.Type = ""
+	c.Folders = []Folder{{Path: t.TempDir(), Rendezvous: "rv"}}
+	if err := c.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if c.Identity.Type == "" || c.Folders[0].Mode != snap.SendReceive {
+		t.Errorf("identity type %q and mode %q, want the defaults", c.Identity.Type, c.Folders[0].Mode)
+	}
+}
+
+func TestLoad(t *testing.T) {
+	dir := t.TempDir()
+	name := filepath.Join(dir, "peerdrive.yaml")
+	data := "port: 7000\nfolders:\n  - path: docs\n    rendezvous: rv\n"
+	if err := os.WriteFile(name, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+	c, err := Load(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Port != 7000 || c.Poll != Default().Poll {
+		t.Errorf("port %d and poll %s, want 7000 over the defaults", c.Port, c.Poll)
+	}
+	if want := filepath.Join(dir, "docs"); len(c.Folders) != 1 || c.Folders[0].Path != want {
+		t.Errorf("folders %v, want %s", c.Folders, want)
+	}
+
+	if err := os.WriteFile(name, []byte("prot: 7000\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Load(name); err == nil {
+		t.Error("unknown field loaded")
+	}
+}
+
+// TestAddFolder keeps what the file had, comments included.
+func TestAddFolder(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "peerdrive.yaml")
+	if err := AddFolder(name, Folder{Path: "/a", Rendezvous: "rv"}); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(name, append([]byte("# mine\nport: 7000\n"), data...), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := AddFolder(name, Folder{Path: "/b", Rendezvous: "rv2", Mode: snap.Relay}); err != nil {
+		t.Fatal(err)
+	}
+
+	if data, err = os.ReadFile(name); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), "# mine") {
+		t.Errorf("comment dropped:\n%s", data)
+	}
+	c, err := Load(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Port != 7000 || len(c.Folders) != 2 || c.Folders[1].Mode != snap.Relay {
+		t.Errorf("port %d and folders %v", c.Port, c.Folders)
+	}
+}
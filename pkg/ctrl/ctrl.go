@@ -0,0 +1,296 @@
+package ctrl
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"time"
+
+	"golang.org/x/xerrors"
+
+	"github.com/threecorp/peerdrive/pkg/bandwidth"
+	"github.com/threecorp/peerdrive/pkg/bus"
+)
+
+// DefaultAddr is where the daemon listens for local control requests.
+const DefaultAddr = "127.0.0.1:6869"
+
+type (
+	Transfer struct {
+		Folder  string
+		Path    string
+		Peer    string
+		State   string
+		Size    int64
+		Done    int64
+		Attempt int
+		Error   string    `json:",omitempty"`
+		Started time.Time `json:",omitempty"`
+	}
+	Folder struct {
+		Path    string
+		Mode    string
+		Local   int       `json:",omitempty"` // receive-only changes, see RevertFolder
+		Dropped int64     `json:",omitempty"` // unsigned, forged or replayed snapshots
+		Paused  bool      `json:",omitempty"`
+		State   string    // ok, error or stopped
+		Error   string    `json:",omitempty"`
+		Since   time.Time `json:",omitempty"`
+	}
+	// Peer is a device sharing a folder.
+	Peer struct {
+		ID        string
+		Name      string   `json:",omitempty"`
+		Addrs     []string `json:",omitempty"`
+		Connected bool
+		Latency   time.Duration `json:",omitempty"`
+		LastSeen  time.Time     `json:",omitempty"`
+		Folders   []string      // shared, by path
+	}
+	Status struct {
+		Peer      string
+		Peers     []Peer
+		Folders   []Folder
+		Transfers []Transfer
+	}
+	Revert struct {
+		Folder   string
+		Reverted int
+	}
+	// Pause pauses Folder, or resumes it when Paused is false.
+	Pause struct {
+		Folder string
+		Paused bool
+	}
+	// Rescan publishes what changed in Folder, every folder when empty.
+	Rescan struct {
+		Folder string `json:",omitempty"`
+	}
+	Invite struct {
+		Folder string
+		TTL    time.Duration `json:",omitempty"`
+		Token  string        `json:",omitempty"`
+	}
+	// Join is the folder offered to a device joining with Token, and the
+	// peers it trusts.
+	Join struct {
+		Token      string
+		Rendezvous string   `json:",omitempty"`
+		Ignore     []string `json:",omitempty"`
+		Password   string   `json:",omitempty"`
+		Trusted    []string `json:",omitempty"`
+	}
+)
+
+// Handlers are what the control interface exposes of the daemon.
+type Handlers struct {
+	Status  func() *Status
+	Limiter *bandwidth.Limiter
+	Revert  func(ctx context.Context, folder string) (int, error)
+	Pause   func(ctx context.Context, folder string, paused bool) error
+	Rescan  func(ctx context.Context, folder string) error
+	Invite  func(ctx context.Context, folder string, ttl time.Duration) (string, error)
+	Join    func(ctx context.Context, token string) (*Join, error)
+	Events  *bus.Bus
+}
+
+// Server is the daemon's local control interface, JSON over HTTP.
+type Server struct {
+	srv *http.Server
+	mux *http.ServeMux
+	hs  Handlers
+}
+
+func NewServer(addr string, hs Handlers) *Server {
+	s := &Server{mux: http.NewServeMux(), hs: hs}
+	s.srv = &http.Server{Addr: addr, Handler: s.mux, ReadHeaderTimeout: 10 * time.Second}
+
+	s.mux.HandleFunc("/status", s.handleStatus)
+	s.mux.HandleFunc("/limits", s.handleLimits)
+	s.mux.HandleFunc("/revert", s.handleRevert)
+	s.mux.HandleFunc("/pause", s.handlePause)
+	s.mux.HandleFunc("/rescan", s.handleRescan)
+	s.mux.HandleFunc("/invite", s.handleInvite)
+	s.mux.HandleFunc("/join", s.handleJoin)
+	s.mux.HandleFunc("/events", s.handleEvents)
+	return s
+}
+
+func (s *Server) ListenAndServe() error {
+	ln, err := net.Listen("tcp", s.srv.Addr)
+	if err != nil {
+		return xerrors.Errorf("control listen %s: %w", s.srv.Addr, err)
+	}
+	return s.Serve(ln)
+}
+
+// Serve answers the requests accepted on ln until Close.
+func (s *Server) Serve(ln net.Listener) error {
+	if err := s.srv.Serve(ln); err != nil && !xerrors.Is(err, http.ErrServerClosed) {
+		return xerrors.Errorf("control serve: %w", err)
+	}
+	return nil
+}
+
+func (s *Server) Close() error {
+	return s.srv.Close()
+}
+
+func (s *Server) handleStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, s.hs.Status())
+}
+
+func (s *Server) handleLimits(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, s.hs.Limiter.Config())
+	case http.MethodPut:
+		cfg := bandwidth.Config{}
+		if err := json.NewDecoder(r.Body).Decode(&cfg); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := cfg.Validate(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		s.hs.Limiter.Set(cfg)
+		writeJSON(w, s.hs.Limiter.Config())
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *Server) handleRevert(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	rv := Revert{}
+	if err := json.NewDecoder(r.Body).Decode(&rv); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	n, err := s.hs.Revert(r.Context(), rv.Folder)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	rv.Reverted = n
+	writeJSON(w, rv)
+}
+
+func (s *Server) handlePause(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	p := Pause{}
+	if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := s.hs.Pause(r.Context(), p.Folder, p.Paused); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, p)
+}
+
+func (s *Server) handleRescan(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	rs := Rescan{}
+	if err := json.NewDecoder(r.Body).Decode(&rs); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := s.hs.Rescan(r.Context(), rs.Folder); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, rs)
+}
+
+func (s *Server) handleInvite(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	inv := Invite{}
+	if err := json.NewDecoder(r.Body).Decode(&inv); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	token, err := s.hs.Invite(r.Context(), inv.Folder, inv.TTL)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	inv.Token = token
+	writeJSON(w, inv)
+}
+
+func (s *Server) handleJoin(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	j := Join{}
+	if err := json.NewDecoder(r.Body).Decode(&j); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	joined, err := s.hs.Join(r.Context(), j.Token)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, joined)
+}
+
+// handleEvents streams the events of the daemon as JSON lines until the
+// client goes away.
+func (s *Server) handleEvents(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok || s.hs.Events == nil {
+		http.Error(w, "events not supported", http.StatusNotImplemented)
+		return
+	}
+	events, cancel := s.hs.Events.Subscribe(0)
+	defer cancel()
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	enc := json.NewEncoder(w)
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case ev := <-events:
+			if err := enc.Encode(ev); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
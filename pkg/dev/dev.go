@@ -2,9 +2,10 @@ package dev
 
 const (
 	DatastoreName  = ".dssnap"
-	PrivateKeyName = ".pkey"
+	PrivateKeyName = ".pkey"      // key file of older versions, see identity.Load
+	TempName       = ".peerdrive" // work area inside the sync folder
 )
 
 var (
-	IgnoreNames = []string{".git", DatastoreName, PrivateKeyName}
+	IgnoreNames = []string{".git", DatastoreName, PrivateKeyName, TempName}
 )
@@ -5,6 +5,8 @@ import (
 	"path"
 	"strings"
 	"time"
+
+	"github.com/threecorp/peerdrive/pkg/clock"
 )
 
 func FileSize(name string) int64 {
@@ -24,26 +26,51 @@ func FileMTime(name string) int64 {
 	return mtime
 }
 
-func IsFileWritten(path string) (bool, int64) {
+func IsFileWritten(path string, interval time.Duration) (bool, int64) {
+	return isFileWritten(path, interval, clock.Real)
+}
+
+func isFileWritten(path string, interval time.Duration, c clock.Clock) (bool, int64) {
 	mtime1 := FileMTime(path)
-	time.Sleep(1 * time.Second)
+	<-c.After(interval)
 	mtime2 := FileMTime(path)
 	return mtime1 != mtime2, mtime2
 }
 
-func UntilWritten(path string) {
-	time.Sleep(30 * time.Millisecond)
+// WriteCheck waits for a file being written to settle before it is hashed.
+type WriteCheck struct {
+	Delay    time.Duration // before the first look
+	MinSize  int64         // smaller files are taken as written
+	Interval time.Duration // between mtime checks of larger files
+	Clock    clock.Clock   // of the waits, nil is clock.Real
+}
+
+func DefaultWriteCheck() WriteCheck {
+	return WriteCheck{
+		Delay:    30 * time.Millisecond,
+		MinSize:  20 << 10,
+		Interval: time.Second,
+	}
+}
+
+func (wc WriteCheck) UntilWritten(path string) {
+	c := clock.OrReal(wc.Clock)
+	<-c.After(wc.Delay)
 	size := FileSize(path)
-	if size > 1024*20 {
+	if size > wc.MinSize {
 		for {
-			if isWritten, _ := IsFileWritten(path); !isWritten {
+			if isWritten, _ := isFileWritten(path, wc.Interval, c); !isWritten {
 				break
 			}
-			time.Sleep(100 * time.Millisecond)
+			<-c.After(100 * time.Millisecond)
 		}
 	}
 }
 
+func UntilWritten(path string) {
+	DefaultWriteCheck().UntilWritten(path)
+}
+
 func RelativePath(syncDir string, pathName string) string {
 	return path.Join("./", strings.ReplaceAll(pathName, syncDir, ""))
 }
@@ -0,0 +1,78 @@
+package dev
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+)
+
+// BlockSize is the unit a file is hashed (and transferred) in.
+const BlockSize = 1 << 20
+
+// BlockSums returns the sha256 digest of every BlockSize block of the file.
+func BlockSums(name string) ([][]byte, error) {
+	return BlockSumsOf(name, BlockSize)
+}
+
+// BlockSumsOf is BlockSums in blocks of another size, like sealed content.
+func BlockSumsOf(name string, blockSize int64) ([][]byte, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	sums := [][]byte{}
+	buf := make([]byte, blockSize)
+	for {
+		n, err := io.ReadFull(f, buf)
+		if n > 0 {
+			sum := sha256.Sum256(buf[:n])
+			sums = append(sums, sum[:])
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return sums, nil
+}
+
+// SumsHash folds block digests into the content hash of a file. Hashing over
+// the block digests lets a single block be verified against a block list that
+// was itself verified against the file hash.
+func SumsHash(sums [][]byte) string {
+	h := sha256.New()
+	for _, sum := range sums {
+		h.Write(sum)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func FileHash(name string) (string, error) {
+	return FileHashOf(name, BlockSize)
+}
+
+func FileHashOf(name string, blockSize int64) (string, error) {
+	sums, err := BlockSumsOf(name, blockSize)
+	if err != nil {
+		return "", err
+	}
+	return SumsHash(sums), nil
+}
+
+func BytesHash(data []byte) string {
+	sums := [][]byte{}
+	for off := 0; off < len(data); off += BlockSize {
+		end := off + BlockSize
+		if end > len(data) {
+			end = len(data)
+		}
+		sum := sha256.Sum256(data[off:end])
+		sums = append(sums, sum[:])
+	}
+	return SumsHash(sums)
+}
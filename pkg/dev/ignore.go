@@ -0,0 +1,47 @@
+package dev
+
+import (
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/xerrors"
+)
+
+// Ignore holds the glob patterns of a folder on top of IgnoreNames. A
+// pattern with a slash matches the path from the folder root, one without
+// matches any file or directory name beneath it.
+type Ignore []string
+
+func (ig Ignore) Validate() error {
+	for _, p := range ig {
+		if _, err := filepath.Match(p, ""); err != nil {
+			return xerrors.Errorf("ignore pattern %q: %w", p, err)
+		}
+	}
+	return nil
+}
+
+// Match tells whether relPath or one of its parent directories is ignored.
+func (ig Ignore) Match(relPath string) bool {
+	relPath = filepath.ToSlash(relPath)
+	for _, name := range IgnoreNames {
+		if relPath == name || strings.HasPrefix(relPath, name+"/") {
+			return true
+		}
+	}
+
+	parts := strings.Split(relPath, "/")
+	for i := range parts {
+		sub := strings.Join(parts[:i+1], "/")
+		for _, p := range ig {
+			if strings.Contains(p, "/") {
+				if ok, _ := filepath.Match(strings.TrimPrefix(p, "/"), sub); ok {
+					return true
+				}
+			} else if ok, _ := filepath.Match(p, parts[i]); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
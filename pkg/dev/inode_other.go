@@ -0,0 +1,10 @@
+//go:build !unix
+
+package dev
+
+import "os"
+
+// FileInode is not available, files are compared by size and mtime only.
+func FileInode(fi os.FileInfo) uint64 {
+	return 0
+}
@@ -0,0 +1,261 @@
+// Package engine runs a node syncing folders, what the daemon does, for a
+// service embedding peerdrive. Everything an engine uses comes in its
+// Options, so several can run in one process. They share what is process
+// wide: the sinks of event.SetSinks for engines without Options.Sinks, and
+// metrics.Registry, where folder and peer metrics are labelled and
+// connected_peers adds up the engines.
+package engine
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"golang.org/x/xerrors"
+
+	"github.com/threecorp/peerdrive/pkg/bandwidth"
+	"github.com/threecorp/peerdrive/pkg/bus"
+	"github.com/threecorp/peerdrive/pkg/ctrl"
+	"github.com/threecorp/peerdrive/pkg/event"
+	"github.com/threecorp/peerdrive/pkg/index"
+	"github.com/threecorp/peerdrive/pkg/p2p"
+	"github.com/threecorp/peerdrive/pkg/snap"
+)
+
+// Options are the settings of an engine. The node ones name its store, key,
+// host and discovery, see p2p.Options.
+type Options struct {
+	Node   p2p.Options
+	Limits bandwidth.Config
+	Events *bus.Bus      // of the node and every folder, nil makes one
+	Sinks  []event.Sink  // show the sync activity of every folder, nil is those of event.SetSinks
+	Drain  time.Duration // how long Close waits for running transfers
+}
+
+func DefaultOptions() Options {
+	return Options{
+		Node:  p2p.DefaultOptions(),
+		Drain: 30 * time.Second,
+	}
+}
+
+// Engine is a node and the folders it syncs.
+type Engine struct {
+	Node    *p2p.Node
+	Limiter *bandwidth.Limiter
+	Events  *bus.Bus
+
+	opts    Options
+	mu      sync.Mutex
+	folders []*snap.Folder
+}
+
+// New starts the node of opts until ctx is done or Close.
+func New(ctx context.Context, opts Options) (*Engine, error) {
+	if opts.Events == nil {
+		opts.Events = bus.New()
+	}
+	lim := bandwidth.New(opts.Limits, opts.Node.Clock)
+	go lim.Run(ctx)
+
+	nopts := opts.Node
+	nopts.Events = opts.Events
+	node, err := p2p.NewNode(ctx, nopts, lim)
+	if err != nil {
+		return nil, xerrors.Errorf("node: %w", err)
+	}
+	node.OnRotate(lim.Rename)
+	return &Engine{Node: node, Limiter: lim, Events: opts.Events, opts: opts}, nil
+}
+
+// Open joins the group of rendezvous and brings the index of dir up to
+// date. The folder syncs with Run.
+func (e *Engine) Open(ctx context.Context, dir, rendezvous string, opts snap.Options) (*snap.Folder, error) {
+	g, err := e.Node.Join(rendezvous)
+	if err != nil {
+		return nil, xerrors.Errorf("join: %w", err)
+	}
+	iopts := index.Options{Ignore: opts.Ignore, ReceiveOnly: opts.Mode == snap.ReceiveOnly}
+	idx, err := index.Open(ctx, e.Node.Store, index.IndexKey.ChildString(g.ID), e.Node.Host.ID(), iopts)
+	if err != nil {
+		return nil, xerrors.Errorf("index: %w", err)
+	}
+	if opts.Mode != snap.Relay { // a relay has no tree to index
+		if _, err := idx.Reconcile(ctx, dir); err != nil {
+			return nil, xerrors.Errorf("index reconcile: %w", err)
+		}
+	}
+	if opts.Events == nil {
+		opts.Events = e.Events
+	}
+	if opts.Sinks == nil {
+		opts.Sinks = e.opts.Sinks
+	}
+	f, err := snap.NewFolder(g, idx, dir, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	e.mu.Lock()
+	e.folders = append(e.folders, f)
+	e.mu.Unlock()
+	return f, nil
+}
+
+// Folders are the open folders, in order.
+func (e *Engine) Folders() []*snap.Folder {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	return append([]*snap.Folder{}, e.folders...)
+}
+
+// Run syncs the folders open so far until ctx is done, a value on rescan
+// rescans every one of them.
+func (e *Engine) Run(ctx context.Context, rescan <-chan struct{}) {
+	folders := e.Folders()
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-rescan:
+			}
+			for _, f := range folders {
+				f.Rescan()
+			}
+		}
+	}()
+
+	wg := sync.WaitGroup{}
+	for _, f := range folders {
+		wg.Add(1)
+		go func(f *snap.Folder) {
+			defer wg.Done()
+			f.Run(ctx, nil)
+		}(f)
+	}
+	wg.Wait()
+}
+
+// Close waits up to Options.Drain for running transfers, then closes the
+// node, its store last.
+func (e *Engine) Close() error {
+	ctx, cancel := context.WithTimeout(context.Background(), e.opts.Drain)
+	defer cancel()
+	for _, f := range e.Folders() {
+		f.Transfers.Drain(ctx)
+	}
+	return e.Node.Close()
+}
+
+// Handlers serve the control interface with the engine, but for invites
+// and joins, which need the config of the daemon.
+func (e *Engine) Handlers() ctrl.Handlers {
+	return ctrl.Handlers{
+		Status:  e.Status,
+		Limiter: e.Limiter,
+		Revert: func(ctx context.Context, folder string) (int, error) {
+			f, err := e.folder(folder)
+			if err != nil {
+				return 0, err
+			}
+			return f.Revert(ctx)
+		},
+		Pause: func(ctx context.Context, folder string, paused bool) error {
+			f, err := e.folder(folder)
+			if err != nil {
+				return err
+			}
+			if paused {
+				f.Pause()
+			} else {
+				f.Resume()
+			}
+			return nil
+		},
+		Rescan: func(ctx context.Context, folder string) error {
+			if folder == "" {
+				for _, f := range e.Folders() {
+					f.Rescan()
+				}
+				return nil
+			}
+			f, err := e.folder(folder)
+			if err != nil {
+				return err
+			}
+			f.Rescan()
+			return nil
+		},
+		Events: e.Events,
+	}
+}
+
+func (e *Engine) folder(dir string) (*snap.Folder, error) {
+	for _, f := range e.Folders() {
+		if f.Dir == dir {
+			return f, nil
+		}
+	}
+	return nil, xerrors.Errorf("no folder %s", dir)
+}
+
+// Status is the peers sharing a folder, the folders and transfers of the engine.
+func (e *Engine) Status() *ctrl.Status {
+	st := &ctrl.Status{Peer: e.Node.Host.ID().String(), Peers: []ctrl.Peer{}, Folders: []ctrl.Folder{}, Transfers: []ctrl.Transfer{}}
+	dirs := map[string][]string{} // of groups
+	for _, f := range e.Folders() {
+		dirs[f.Group.ID] = append(dirs[f.Group.ID], f.Dir)
+
+		hs := f.Health.State()
+		st.Folders = append(st.Folders, ctrl.Folder{
+			Path:    f.Dir,
+			Mode:    string(f.Mode()),
+			Local:   f.LocalChanges(),
+			Dropped: f.Dropped(),
+			Paused:  f.Paused(),
+			State:   hs.State,
+			Error:   hs.Error,
+			Since:   hs.Since,
+		})
+
+		for _, it := range f.Transfers.Status() {
+			tr := ctrl.Transfer{
+				Folder:  f.Dir,
+				Path:    it.Path,
+				Peer:    it.Peer.String(),
+				State:   it.State.String(),
+				Size:    it.Size,
+				Done:    it.Done(),
+				Attempt: it.Attempt,
+				Started: it.Started,
+			}
+			if it.Err != nil {
+				tr.Error = it.Err.Error()
+			}
+			st.Transfers = append(st.Transfers, tr)
+		}
+	}
+	for _, info := range e.Node.Peers.List() {
+		p := ctrl.Peer{
+			ID:        info.ID.String(),
+			Name:      info.Name,
+			Connected: info.Connected,
+			Latency:   info.Latency,
+			LastSeen:  info.LastSeen,
+			Folders:   []string{},
+		}
+		for _, g := range info.Groups {
+			p.Folders = append(p.Folders, dirs[g]...)
+		}
+		if len(p.Folders) == 0 {
+			continue // a DHT or relay peer
+		}
+		for _, ma := range info.Addrs {
+			p.Addrs = append(p.Addrs, ma.String())
+		}
+		st.Peers = append(st.Peers, p)
+	}
+	return st
+}
@@ -2,69 +2,152 @@ package event
 
 import (
 	"fmt"
+	"io"
+	"os"
+	"sync"
 
 	"github.com/gookit/color"
+
+	"github.com/threecorp/peerdrive/pkg/logging"
+)
+
+// Direction tells sent changes from received ones.
+type Direction int
+
+const (
+	Sent Direction = iota
+	Received
+)
+
+func (d Direction) String() string {
+	if d == Received {
+		return "received"
+	}
+	return "sent"
+}
+
+// Sink shows the sync activity of the daemon, like a changed path being
+// sent to peers.
+type Sink interface {
+	Show(d Direction, what, path string)
+}
+
+var (
+	sinkMu sync.RWMutex
+	sinks  = []Sink{NewPrettySink(os.Stdout)}
 )
 
-func dispStyle(ev *Event) func(a ...any) string {
-	switch ev.Op {
-	case Write:
-		return color.New(color.FgLightGreen, color.Bold).Render
-	case Read:
-		return color.New(color.Gray, color.Bold).Render
-	case Remove:
-		return color.New(color.FgLightRed, color.Bold).Render
-	default:
-		return color.New(color.FgWhite).Render
+// SetSinks replaces where the sync activity is shown, none hides it.
+func SetSinks(s ...Sink) {
+	sinkMu.Lock()
+	defer sinkMu.Unlock()
+
+	sinks = s
+}
+
+func show(d Direction, what, path string) {
+	sinkMu.RLock()
+	defer sinkMu.RUnlock()
+
+	for _, s := range sinks {
+		s.Show(d, what, path)
+	}
+}
+
+// PrettySink prints arrows in colors for a terminal.
+type PrettySink struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func NewPrettySink(w io.Writer) *PrettySink {
+	return &PrettySink{w: w}
+}
+
+var styles = map[string]color.Style{
+	Write.String():  color.New(color.FgLightGreen, color.Bold),
+	Read.String():   color.New(color.Gray, color.Bold),
+	Remove.String(): color.New(color.FgLightRed, color.Bold),
+	"Renamed":       color.New(color.FgLightYellow, color.Bold),
+	"Created":       color.New(color.FgLightBlue, color.Bold),
+	"Written":       color.New(color.FgLightGreen, color.Bold),
+	"Removed":       color.New(color.FgLightRed, color.Bold),
+	"Changed":       color.New(color.FgLightGreen, color.Bold),
+	"Deleted":       color.New(color.FgLightRed, color.Bold),
+}
+
+func (s *PrettySink) Show(d Direction, what, path string) {
+	arrow := "⫸"
+	if d == Received {
+		arrow = "⫷"
+	}
+	style, ok := styles[what]
+	if !ok {
+		style = color.New(color.FgWhite)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	fmt.Fprintf(s.w, "%s %s %s\n", arrow, style.Render(what), color.Gray.Render(path))
+}
+
+// LogSink logs the sync activity at info level, with the other structured
+// logs of the daemon.
+type LogSink struct{}
+
+var syncLog = logging.Logger("sync")
+
+func (LogSink) Show(d Direction, what, path string) {
+	syncLog.Infow(what, "direction", d.String(), "path", path)
+}
+
+// Display shows the sync activity of a folder on its sinks, nil on those
+// of SetSinks.
+type Display []Sink
+
+func (ds Display) show(d Direction, what, path string) {
+	if ds == nil {
+		show(d, what, path)
+		return
+	}
+	for _, s := range ds {
+		s.Show(d, what, path)
 	}
 }
 
-func DispSender(ev *Event) {
-	fmt.Printf("%s %s %s\n", "⫸", dispStyle(ev)(ev.String()), color.Gray.Render(ev.Path))
+func (ds Display) Sender(ev *Event) {
+	ds.show(Sent, ev.String(), ev.Path)
 }
 
-func DispRecver(ev *Event) {
-	fmt.Printf("%s %s %s\n", "⫷", dispStyle(ev)(ev.String()), color.Gray.Render(ev.Path))
+func (ds Display) Recver(ev *Event) {
+	ds.show(Received, ev.String(), ev.Path)
 }
 
-func DispSendRenamed(path string) {
-	eventColor := color.New(color.FgLightYellow, color.Bold).Render
-	pathColor := color.New(color.Gray, color.Bold).Render
-	fmt.Printf("%s %s %s\n", "⫸", eventColor("Renamed"), pathColor(path))
+func (ds Display) SendRenamed(path string) {
+	ds.show(Sent, "Renamed", path)
 }
 
-func DispSendCreated(path string) {
-	eventColor := color.New(color.FgLightBlue, color.Bold).Render
-	pathColor := color.New(color.Gray, color.Bold).Render
-	fmt.Printf("%s %s %s\n", "⫸", eventColor("Created"), pathColor(path))
+func (ds Display) SendCreated(path string) {
+	ds.show(Sent, "Created", path)
 }
 
-func DispSendWritten(path string) {
-	eventColor := color.New(color.FgLightGreen, color.Bold).Render
-	pathColor := color.New(color.Gray, color.Bold).Render
-	fmt.Printf("%s %s %s\n", "⫸", eventColor("Written"), pathColor(path))
+func (ds Display) SendWritten(path string) {
+	ds.show(Sent, "Written", path)
 }
 
-func DispSendRemoved(path string) {
-	eventColor := color.New(color.FgLightRed, color.Bold).Render
-	pathColor := color.New(color.Gray, color.Bold).Render
-	fmt.Printf("%s %s %s\n", "⫸", eventColor("Removed"), pathColor(path))
+func (ds Display) SendRemoved(path string) {
+	ds.show(Sent, "Removed", path)
 }
 
-func DispSendChanged(path string) {
-	eventColor := color.New(color.FgLightGreen, color.Bold).Render
-	pathColor := color.New(color.Gray, color.Bold).Render
-	fmt.Printf("%s %s %s\n", "⫸", eventColor("Changed"), pathColor(path))
+func (ds Display) SendChanged(path string) {
+	ds.show(Sent, "Changed", path)
 }
 
-func DispRecvChanged(path string) {
-	eventColor := color.New(color.FgLightGreen, color.Bold).Render
-	pathColor := color.New(color.Gray, color.Bold).Render
-	fmt.Printf("%s %s %s\n", "⫷", eventColor("Changed"), pathColor(path))
+func (ds Display) RecvChanged(path string) {
+	ds.show(Received, "Changed", path)
 }
 
-func DispRecvDeleted(path string) {
-	eventColor := color.New(color.FgLightRed, color.Bold).Render
-	pathColor := color.New(color.Gray, color.Bold).Render
-	fmt.Printf("%s %s %s\n", "⫷", eventColor("Deleted"), pathColor(path))
+func (ds Display) RecvDeleted(path string) {
+	ds.show(Received, "Deleted", path)
 }
@@ -1,12 +1,16 @@
 package event
 
 import (
+	"io"
 	"io/ioutil"
 	"os"
-	"path"
+	"path/filepath"
+	"strings"
 	"time"
 
 	"golang.org/x/xerrors"
+
+	"github.com/threecorp/peerdrive/pkg/dev"
 )
 
 type Op uint
@@ -15,12 +19,14 @@ const (
 	Write Op = iota
 	Read
 	Remove
+	Sums
 )
 
 var ops = map[Op]string{
 	Write:  "WRITE",
 	Read:   "READ",
 	Remove: "REMOVE",
+	Sums:   "SUMS",
 }
 
 func (e Op) String() string {
@@ -30,21 +36,46 @@ func (e Op) String() string {
 	return "???"
 }
 
+// MaxLength caps the byte range a single Read returns.
+const MaxLength = 4 * dev.BlockSize
+
 type Event struct {
 	Op
 	Path string
 	Data []byte
 	Time time.Time
+
+	// Read of a byte range when Length is set, Size is the whole file
+	Offset int64
+	Length int64
+	Size   int64
+	// Sums are the block digests of the file, see dev.BlockSums
+	Sums [][]byte
 }
 
-func (ev *Event) Write() error {
+// FullPath resolves the relative ev.Path under syncDir, refusing paths that
+// climb out of it.
+func (ev *Event) FullPath(syncDir string) (string, error) {
+	name := filepath.Join(syncDir, filepath.FromSlash(ev.Path))
+	rel, err := filepath.Rel(syncDir, name)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", xerrors.Errorf("%s error path %s is outside of %s", ev.String(), ev.Path, syncDir)
+	}
+	return name, nil
+}
+
+func (ev *Event) Write(syncDir string) error {
+	name, err := ev.FullPath(syncDir)
+	if err != nil {
+		return err
+	}
 	// Create peer's dir
-	dir := path.Dir(ev.Path)
+	dir := filepath.Dir(name)
 	if err := os.MkdirAll(dir, 0750); err != nil {
 		return xerrors.Errorf("%s error mkdirAll %s: %w", ev.String(), dir, err)
 	}
 	// Create peer's file
-	f, err := os.Create(ev.Path)
+	f, err := os.Create(name)
 	if err != nil {
 		return xerrors.Errorf("%s error open %s: %w", ev.String(), ev.Path, err)
 	}
@@ -56,7 +87,7 @@ func (ev *Event) Write() error {
 	}
 	// Write a data to peer's file modtime
 	if !ev.Time.IsZero() {
-		if err := os.Chtimes(ev.Path, time.Now(), ev.Time); err != nil {
+		if err := os.Chtimes(name, time.Now(), ev.Time); err != nil {
 			return xerrors.Errorf("%s error write modtime: %w", ev.String(), err)
 		}
 	}
@@ -64,30 +95,89 @@ func (ev *Event) Write() error {
 	return nil
 }
 
-func (ev *Event) Read() error {
+func (ev *Event) Read(syncDir string) error {
+	name, err := ev.FullPath(syncDir)
+	if err != nil {
+		return err
+	}
+	return ev.ReadFile(name)
+}
+
+// ReadFile reads the data of ev.Path from name, like a relay's blob.
+func (ev *Event) ReadFile(name string) error {
 	if len(ev.Data) != 0 {
 		return xerrors.Errorf("%s error Data is not empty", ev.String())
 	}
 
-	// Open local's file
-	// Read a data to local's file
-	data, err := ioutil.ReadFile(ev.Path)
+	fi, err := os.Stat(name)
+	if err != nil {
+		return xerrors.Errorf("%s error info %s: %w", ev.String(), ev.Path, err)
+	}
+	ev.Time = fi.ModTime()
+	ev.Size = fi.Size()
+
+	if ev.Length == 0 {
+		// Open local's file
+		// Read a data to local's file
+		data, err := ioutil.ReadFile(name)
+		if err != nil {
+			return xerrors.Errorf("%s error read %s: %w", ev.String(), ev.Path, err)
+		}
+		ev.Data = data
+		return nil
+	}
+
+	f, err := os.Open(name)
+	if err != nil {
+		return xerrors.Errorf("%s error open %s: %w", ev.String(), ev.Path, err)
+	}
+	defer f.Close()
+
+	if ev.Length > MaxLength {
+		ev.Length = MaxLength
+	}
+	data := make([]byte, ev.Length)
+	n, err := f.ReadAt(data, ev.Offset)
+	if err != nil && err != io.EOF {
+		return xerrors.Errorf("%s error read %s at %d: %w", ev.String(), ev.Path, ev.Offset, err)
+	}
+	ev.Data = data[:n]
+
+	return nil
+}
+
+func (ev *Event) ReadSums(syncDir string) error {
+	name, err := ev.FullPath(syncDir)
 	if err != nil {
-		return xerrors.Errorf("%s error read %s: %w", ev.String(), ev.Path, err)
+		return err
 	}
-	ev.Data = data
+	return ev.ReadSumsFile(name, dev.BlockSize)
+}
 
-	fi, err := os.Stat(ev.Path)
+// ReadSumsFile reads the block sums of ev.Path from name, in blocks of
+// blockSize.
+func (ev *Event) ReadSumsFile(name string, blockSize int64) error {
+	fi, err := os.Stat(name)
 	if err != nil {
 		return xerrors.Errorf("%s error info %s: %w", ev.String(), ev.Path, err)
 	}
+	sums, err := dev.BlockSumsOf(name, blockSize)
+	if err != nil {
+		return xerrors.Errorf("%s error sums %s: %w", ev.String(), ev.Path, err)
+	}
 	ev.Time = fi.ModTime()
+	ev.Size = fi.Size()
+	ev.Sums = sums
 
 	return nil
 }
 
-func (ev *Event) Remove() error {
-	if err := os.Remove(ev.Path); err != nil {
+func (ev *Event) Remove(syncDir string) error {
+	name, err := ev.FullPath(syncDir)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(name); err != nil {
 		return xerrors.Errorf("%s error remove %s: %w", ev.String(), ev.Path, err)
 	}
 	return nil
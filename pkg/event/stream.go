@@ -7,9 +7,21 @@ import (
 	"encoding/gob"
 	"io"
 
+	"github.com/libp2p/go-libp2p/core/network"
 	"golang.org/x/xerrors"
+
+	"github.com/threecorp/peerdrive/pkg/metrics"
 )
 
+// remotePeer names the peer at the other end of stream, empty when it is
+// not a libp2p stream.
+func remotePeer(stream any) string {
+	if s, ok := stream.(network.Stream); ok {
+		return s.Conn().RemotePeer().String()
+	}
+	return ""
+}
+
 func WriteStream(stream io.Writer, ev *Event) error {
 	b := bytes.NewBuffer(nil)
 	if err := gob.NewEncoder(b).Encode(ev); err != nil {
@@ -30,6 +42,9 @@ func WriteStream(stream io.Writer, ev *Event) error {
 	if err := writer.Flush(); err != nil {
 		return xerrors.Errorf("%s error flushing writer: %w", err)
 	}
+	if id := remotePeer(stream); id != "" {
+		metrics.SentBytes.WithLabelValues(id).Add(float64(len(packetSize) + len(buf)))
+	}
 
 	return nil
 }
@@ -44,6 +59,9 @@ func ReadStream(stream io.Reader, ev *Event) error {
 	if _, err := io.ReadFull(stream, data); err != nil {
 		return xerrors.Errorf("error read message from stream: %w", err)
 	}
+	if id := remotePeer(stream); id != "" {
+		metrics.ReceivedBytes.WithLabelValues(id).Add(float64(len(packetSize) + len(data)))
+	}
 	if err := gob.NewDecoder(bytes.NewBuffer(data)).Decode(ev); err != nil {
 		return xerrors.Errorf("error read message from stream: %w", err)
 	}
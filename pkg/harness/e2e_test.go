@@ -0,0 +1,425 @@
+package harness
+
+import (
+	"context"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/test"
+	"golang.org/x/xerrors"
+
+	"github.com/threecorp/peerdrive/pkg/bus"
+	"github.com/threecorp/peerdrive/pkg/dev"
+	"github.com/threecorp/peerdrive/pkg/p2p"
+	"github.com/threecorp/peerdrive/pkg/snap"
+)
+
+func TestAdd(t *testing.T) {
+	h := New(t, 3, DefaultOptions())
+
+	h.Nodes[0].Write("a.txt", "alpha")
+	h.Nodes[1].Write("dir/sub/b.txt", "beta")
+	h.WaitTree(map[string]string{"a.txt": "alpha", "dir/sub/b.txt": "beta"})
+}
+
+func TestModify(t *testing.T) {
+	h := New(t, 3, DefaultOptions())
+
+	h.Nodes[0].Write("a.txt", "one")
+	h.WaitTree(map[string]string{"a.txt": "one"})
+
+	h.Nodes[1].Write("a.txt", "two, longer")
+	h.WaitTree(map[string]string{"a.txt": "two, longer"})
+
+	h.Nodes[2].Write("a.txt", "three")
+	h.WaitTree(map[string]string{"a.txt": "three"})
+}
+
+func TestDelete(t *testing.T) {
+	h := New(t, 3, DefaultOptions())
+
+	h.Nodes[0].Write("a.txt", "alpha")
+	h.Nodes[0].Write("b.txt", "beta")
+	h.WaitTree(map[string]string{"a.txt": "alpha", "b.txt": "beta"})
+
+	h.Nodes[2].Remove("a.txt")
+	h.WaitTree(map[string]string{"b.txt": "beta"})
+}
+
+func TestRename(t *testing.T) {
+	h := New(t, 2, DefaultOptions())
+
+	h.Nodes[0].Write("old.txt", "content")
+	h.WaitTree(map[string]string{"old.txt": "content"})
+
+	h.Nodes[1].Rename("old.txt", "dir/new.txt")
+	h.WaitTree(map[string]string{"dir/new.txt": "content"})
+}
+
+// TestPassword syncs a folder whose names and content only travel sealed.
+func TestPassword(t *testing.T) {
+	opts := DefaultOptions()
+	opts.Folder.Password = "secret"
+	h := New(t, 2, opts)
+
+	large := strings.Repeat("sealed ", 1<<18)
+	h.Nodes[0].Write("a.txt", "alpha")
+	h.Nodes[1].Write("dir/b.txt", large)
+	h.WaitTree(map[string]string{"a.txt": "alpha", "dir/b.txt": large})
+}
+
+// TestSameContent adds copies of a file at once, downloaded through the
+// same partial one after the other.
+func TestSameContent(t *testing.T) {
+	h := New(t, 3, DefaultOptions())
+
+	data := strings.Repeat("copied ", 1<<16)
+	want := map[string]string{}
+	for _, path := range []string{"a.txt", "b.txt", "dir/c.txt", "dir/d.txt"} {
+		h.Nodes[0].Write(path, data)
+		want[path] = data
+	}
+	h.WaitTree(want)
+}
+
+// TestConflict edits a file on both sides of a partition, the newer edit
+// wins everywhere and the older one is kept as a conflict copy by its author.
+func TestConflict(t *testing.T) {
+	h := New(t, 2, DefaultOptions())
+	a, b := h.Nodes[0], h.Nodes[1]
+
+	a.Write("doc.txt", "base")
+	h.WaitTree(map[string]string{"doc.txt": "base"})
+
+	h.Partition(a, b)
+	events, cancel := a.Events.Subscribe(0)
+	defer cancel()
+
+	now := time.Now()
+	a.Write("doc.txt", "edited by a")
+	chtimes(t, a.path("doc.txt"), now.Add(-time.Minute))
+	b.Write("doc.txt", "edited by b")
+	chtimes(t, b.path("doc.txt"), now)
+	h.Wait("published", func() error {
+		if err := published(a, "doc.txt"); err != nil {
+			return err
+		}
+		return published(b, "doc.txt")
+	})
+
+	h.Heal(a, b)
+	h.Wait("conflict copy", func() error {
+		tree, err := h.converged()
+		if err != nil {
+			return err
+		}
+		if len(tree) != 2 || tree["doc.txt"] != "edited by b" {
+			return xerrors.Errorf("tree %v", tree)
+		}
+		for path, data := range tree {
+			if strings.HasPrefix(path, "doc.conflict-") && strings.HasSuffix(path, ".txt") && data == "edited by a" {
+				return nil
+			}
+		}
+		return xerrors.Errorf("no conflict copy in %v", tree)
+	})
+
+	h.Wait("conflict event", func() error {
+		for {
+			select {
+			case ev := <-events:
+				if ev.Type == bus.ConflictCreated && ev.Path == "doc.txt" && strings.HasPrefix(ev.Copy, "doc.conflict-") {
+					return nil
+				}
+			default:
+				return os.ErrNotExist
+			}
+		}
+	})
+}
+
+func TestLateJoiner(t *testing.T) {
+	h := New(t, 2, DefaultOptions())
+
+	h.Nodes[0].Write("a.txt", "alpha")
+	h.Nodes[1].Write("b.txt", "beta")
+	h.Nodes[1].Remove("b.txt")
+	h.Nodes[1].Write("c.txt", "gamma")
+	h.WaitTree(map[string]string{"a.txt": "alpha", "c.txt": "gamma"})
+
+	late := h.Add()
+	h.WaitTree(map[string]string{"a.txt": "alpha", "c.txt": "gamma"})
+
+	late.Write("d.txt", "delta")
+	h.WaitTree(map[string]string{"a.txt": "alpha", "c.txt": "gamma", "d.txt": "delta"})
+}
+
+// TestPeers partitions two nodes, each sees the other leave the folder, and
+// join it again once healed.
+func TestPeers(t *testing.T) {
+	h := New(t, 2, DefaultOptions())
+	a, b := h.Nodes[0], h.Nodes[1]
+	g := a.Folder.Group
+
+	h.Wait("joined", func() error {
+		if !g.Member(b.ID()) {
+			return xerrors.Errorf("%s not in %v", b.Name, g.Peers())
+		}
+		return nil
+	})
+	info, ok := a.P2P.Peers.Get(b.ID())
+	if !ok || !info.Connected || len(info.Groups) != 1 || info.Groups[0] != g.ID {
+		t.Fatalf("peer info %+v", info)
+	}
+
+	events, cancel := a.Events.Subscribe(0)
+	defer cancel()
+	h.Partition(a, b)
+	h.Wait("left", func() error {
+		for {
+			select {
+			case ev := <-events:
+				if ev.Type == bus.PeerLeft && ev.Group == g.ID && ev.Peer == b.ID().String() {
+					return nil
+				}
+			default:
+				return os.ErrNotExist
+			}
+		}
+	})
+	if g.Member(b.ID()) || len(g.Peers()) > 0 {
+		t.Errorf("peers %v once partitioned", g.Peers())
+	}
+	if info, _ := a.P2P.Peers.Get(b.ID()); info.Connected || info.LastSeen.IsZero() {
+		t.Errorf("peer info %+v once partitioned", info)
+	}
+
+	h.Heal(a, b)
+	h.Wait("joined again", func() error {
+		if !g.Member(b.ID()) {
+			return xerrors.Errorf("%s not in %v", b.Name, g.Peers())
+		}
+		return nil
+	})
+}
+
+// TestRedial trusts two nodes of each other but never lets discovery run,
+// they connect by redialing, again once one restarts with the peers it
+// stored, and ping each other.
+func TestRedial(t *testing.T) {
+	opts := DefaultOptions()
+	opts.Node.DiscoveryInterval = time.Hour
+	h := New(t, 2, opts)
+	a, b := h.Nodes[0], h.Nodes[1]
+
+	es := []*p2p.TrustEntry{}
+	for _, nd := range h.Nodes {
+		es = append(es, &p2p.TrustEntry{Peer: nd.ID(), Addrs: []string{nd.addr.String()}, By: a.ID(), Added: time.Now()})
+	}
+	for _, nd := range h.Nodes {
+		if _, err := nd.Folder.Group.Trust.Add(context.Background(), es...); err != nil {
+			t.Fatal(err)
+		}
+	}
+	a.Write("a.txt", "alpha")
+	h.WaitTree(map[string]string{"a.txt": "alpha"})
+
+	b.Stop()
+	if err := b.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if info, ok := b.P2P.Peers.Get(a.ID()); !ok || len(info.Addrs) == 0 || len(info.Groups) != 1 {
+		t.Errorf("stored peer %+v", info)
+	}
+	a.Write("b.txt", "beta")
+	h.WaitTree(map[string]string{"a.txt": "alpha", "b.txt": "beta"})
+
+	h.Wait("pinged", func() error {
+		if info, _ := a.P2P.Peers.Get(b.ID()); info.Latency <= 0 {
+			return xerrors.Errorf("peer %+v", info)
+		}
+		return nil
+	})
+}
+
+// TestTrust vouches for a device while a trusted node is away, which learns
+// it once back.
+func TestTrust(t *testing.T) {
+	h := New(t, 3, DefaultOptions())
+	a, b, c := h.Nodes[0], h.Nodes[1], h.Nodes[2]
+	ctx := context.Background()
+
+	es := []*p2p.TrustEntry{}
+	for _, nd := range h.Nodes {
+		es = append(es, &p2p.TrustEntry{Peer: nd.ID(), Addrs: []string{nd.addr.String()}, By: a.ID(), Added: time.Now()})
+	}
+	for _, nd := range h.Nodes {
+		if _, err := nd.Folder.Group.Trust.Add(ctx, es...); err != nil {
+			t.Fatal(err)
+		}
+	}
+	a.Write("a.txt", "alpha")
+	h.WaitTree(map[string]string{"a.txt": "alpha"})
+
+	c.Stop()
+	device, err := test.RandPeerID()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Folder.Group.Vouch(ctx, &p2p.TrustEntry{Peer: device, By: a.ID(), Added: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+	trusted := func(nd *Node) func() error {
+		return func() error {
+			if !nd.Folder.Group.Trust.Contains(device) {
+				return xerrors.Errorf("%s does not trust %s", nd.Name, device)
+			}
+			return nil
+		}
+	}
+	h.Wait("vouched", trusted(b))
+	if err := c.Start(); err != nil {
+		t.Fatal(err)
+	}
+	h.Wait("told again", trusted(c))
+}
+
+// TestTrustOpen vouches in an open group, which only closes where it was
+// done.
+func TestTrustOpen(t *testing.T) {
+	h := New(t, 2, DefaultOptions())
+	a, b := h.Nodes[0], h.Nodes[1]
+
+	a.Write("a.txt", "alpha")
+	h.WaitTree(map[string]string{"a.txt": "alpha"})
+
+	device, err := test.RandPeerID()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Folder.Group.Vouch(context.Background(), &p2p.TrustEntry{Peer: device, By: a.ID(), Added: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+	if a.Folder.Group.Trust.Open() || !a.Folder.Group.Trust.Contains(b.ID()) {
+		t.Fatalf("%s left out of its closed group", b.Name)
+	}
+	h.Wait("announce refused", func() error {
+		if b.Folder.Group.Refused() == 0 {
+			return os.ErrNotExist
+		}
+		return nil
+	})
+	if !b.Folder.Group.Trust.Open() {
+		t.Errorf("%s closed by a peer", b.Name)
+	}
+	b.Write("b.txt", "beta")
+	h.WaitTree(map[string]string{"a.txt": "alpha", "b.txt": "beta"})
+}
+
+// TestReplayed has a peer put an older snapshot of another one again, which
+// the third one drops.
+func TestReplayed(t *testing.T) {
+	h := New(t, 3, DefaultOptions())
+	a, b, c := h.Nodes[0], h.Nodes[1], h.Nodes[2]
+	ctx := context.Background()
+
+	b.Write("a.txt", "one")
+	h.WaitTree(map[string]string{"a.txt": "one"})
+	old, err := a.Folder.Group.DS.Get(ctx, snap.PeerSnapKey(b.ID()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.Write("a.txt", "two")
+	h.WaitTree(map[string]string{"a.txt": "two"})
+
+	if err := a.Folder.Group.DS.Put(ctx, snap.PeerSnapKey(b.ID()), old); err != nil {
+		t.Fatal(err)
+	}
+	h.Wait("dropped", func() error {
+		if n := c.Folder.Dropped(); n != 1 {
+			return xerrors.Errorf("%d dropped", n)
+		}
+		return nil
+	})
+	h.WaitTree(map[string]string{"a.txt": "two"})
+}
+
+// TestReplayedRestart replays an older snapshot of a stopped peer, which a
+// restarted peer still drops, and the author puts its latest one again once
+// back.
+func TestReplayedRestart(t *testing.T) {
+	h := New(t, 3, DefaultOptions())
+	a, b, c := h.Nodes[0], h.Nodes[1], h.Nodes[2]
+	ctx := context.Background()
+
+	b.Write("a.txt", "one")
+	h.WaitTree(map[string]string{"a.txt": "one"})
+	old, err := a.Folder.Group.DS.Get(ctx, snap.PeerSnapKey(b.ID()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	replayed, err := snap.Verify(a.Folder.Group.ID, old)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.Write("a.txt", "two")
+	h.WaitTree(map[string]string{"a.txt": "two"})
+
+	b.Stop()
+	if err := a.Folder.Group.DS.Put(ctx, snap.PeerSnapKey(b.ID()), old); err != nil {
+		t.Fatal(err)
+	}
+	h.Wait("dropped", func() error {
+		if n := c.Folder.Dropped(); n != 1 {
+			return xerrors.Errorf("%d dropped", n)
+		}
+		return nil
+	})
+	c.Stop()
+	if err := c.Start(); err != nil {
+		t.Fatal(err)
+	}
+	h.Wait("dropped after a restart", func() error {
+		if n := c.Folder.Dropped(); n != 1 {
+			return xerrors.Errorf("%d dropped", n)
+		}
+		return nil
+	})
+
+	if err := b.Start(); err != nil {
+		t.Fatal(err)
+	}
+	h.Wait("latest put again", func() error {
+		data, err := c.Folder.Group.DS.Get(ctx, snap.PeerSnapKey(b.ID()))
+		if err != nil {
+			return err
+		}
+		s, err := snap.Verify(c.Folder.Group.ID, data)
+		if err != nil {
+			return err
+		}
+		if s.Seq <= replayed.Seq {
+			return xerrors.Errorf("seq %d, replayed %d", s.Seq, replayed.Seq)
+		}
+		return nil
+	})
+	h.WaitTree(map[string]string{"a.txt": "two"})
+}
+
+func chtimes(t *testing.T, path string, mtime time.Time) {
+	t.Helper()
+	if err := os.Chtimes(path, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// published tells whether the index of nd sent its last change of rel.
+func published(nd *Node, rel string) error {
+	e, ok := nd.Folder.Index.Get(rel)
+	if !ok || !e.Synced || e.Hash != dev.BytesHash([]byte(nd.Read(rel))) {
+		return os.ErrNotExist
+	}
+	return nil
+}
@@ -0,0 +1,219 @@
+package harness
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	crdt "github.com/ipfs/go-ds-crdt"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+	"golang.org/x/xerrors"
+
+	"github.com/threecorp/peerdrive/pkg/clock"
+	"github.com/threecorp/peerdrive/pkg/snap"
+)
+
+// Faults are the failures injected into a harness, drawn from Seed. Each
+// stream, broadcast and clock draws from a source of its own, seeded with
+// what it is, so a draw doesn't depend on which goroutine asks first. The
+// zero value injects none.
+type Faults struct {
+	Seed      int64
+	DropRate  float64       // of snap streams and CRDT broadcasts, 0 to 1
+	MaxDelay  time.Duration // of opening a snap stream, and of a reordered broadcast
+	Reorder   bool          // delivers broadcasts out of order, delayed up to MaxDelay
+	ClockSkew time.Duration // of each node's clock at most, either way
+}
+
+var errDropped = xerrors.New("dropped by fault injection")
+
+// faults draws the failures of Faults, while on.
+type faults struct {
+	Faults
+	on atomic.Bool
+
+	mu    sync.Mutex
+	names map[peer.ID]string // of the nodes, peer IDs differ between runs
+	count map[string]int     // draws of each key so far
+}
+
+func newFaults(opts Faults) *faults {
+	f := &faults{Faults: opts, names: map[peer.ID]string{}, count: map[string]int{}}
+	f.on.Store(true)
+	return f
+}
+
+// name records the node name of id.
+func (f *faults) name(id peer.ID, name string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.names[id] = name
+}
+
+// source is the source of the next draw of key, the nth of key seeded with
+// Seed, key and n.
+func (f *faults) source(key string) *rand.Rand {
+	f.mu.Lock()
+	n := f.count[key]
+	f.count[key]++
+	f.mu.Unlock()
+
+	h := fnv.New64a()
+	fmt.Fprintf(h, "%s/%d", key, n)
+	return rand.New(rand.NewSource(f.Seed ^ int64(h.Sum64())))
+}
+
+// streamKey names the snap streams of pid from one node to another.
+func (f *faults) streamKey(from, to peer.ID, pid protocol.ID) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return fmt.Sprintf("stream/%s/%s/%s", f.names[from], f.names[to], pid)
+}
+
+func (f *faults) drop(rnd *rand.Rand) bool {
+	return f.on.Load() && f.DropRate > 0 && rnd.Float64() < f.DropRate
+}
+
+func (f *faults) delay(rnd *rand.Rand) time.Duration {
+	if !f.on.Load() || f.MaxDelay <= 0 {
+		return 0
+	}
+	return time.Duration(rnd.Float64() * float64(f.MaxDelay))
+}
+
+// clock is the clock of the node name, skewed by up to ClockSkew.
+func (f *faults) clock(name string) clock.Clock {
+	if f.ClockSkew <= 0 {
+		return clock.Real
+	}
+	skew := 2*f.source("clock/"+name).Float64() - 1
+	return clock.Skewed(clock.Real, time.Duration(skew*float64(f.ClockSkew)))
+}
+
+// host wraps h so that snap streams fail, the transport of the folder sync.
+// The streams of pubsub and bitswap are left alone, their faults are those
+// of the broadcasts.
+func (f *faults) host(h host.Host) host.Host {
+	if f.DropRate <= 0 && f.MaxDelay <= 0 {
+		return h
+	}
+	return &faultHost{Host: h, f: f}
+}
+
+// broadcaster is the p2p Options.Broadcast of the node name, nil without
+// faults on broadcasts.
+func (f *faults) broadcaster(name string) func(crdt.Broadcaster) crdt.Broadcaster {
+	if f.DropRate <= 0 && !f.Reorder {
+		return nil
+	}
+	return func(b crdt.Broadcaster) crdt.Broadcaster {
+		return newFaultBroadcaster(b, f, "broadcast/"+name)
+	}
+}
+
+func isSnap(pids ...protocol.ID) bool {
+	for _, pid := range pids {
+		if strings.HasPrefix(string(pid), snap.Protocol) {
+			return true
+		}
+	}
+	return false
+}
+
+type faultHost struct {
+	host.Host
+	f *faults
+}
+
+// NewStream opens a snap stream late, or not at all.
+func (h *faultHost) NewStream(ctx context.Context, p peer.ID, pids ...protocol.ID) (network.Stream, error) {
+	if isSnap(pids...) {
+		rnd := h.f.source(h.f.streamKey(h.ID(), p, pids[0]))
+		select {
+		case <-time.After(h.f.delay(rnd)):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		if h.f.drop(rnd) {
+			return nil, xerrors.Errorf("new stream to %s: %w", p, errDropped)
+		}
+	}
+	return h.Host.NewStream(ctx, p, pids...)
+}
+
+// SetStreamHandler resets served snap streams midway, the peer sees a
+// transfer break off.
+func (h *faultHost) SetStreamHandler(pid protocol.ID, handler network.StreamHandler) {
+	if isSnap(pid) {
+		inner := handler
+		handler = func(s network.Stream) {
+			rnd := h.f.source("served/" + h.f.streamKey(s.Conn().RemotePeer(), h.ID(), pid))
+			if h.f.drop(rnd) {
+				time.AfterFunc(h.f.delay(rnd), func() { s.Reset() })
+			}
+			inner(s)
+		}
+	}
+	h.Host.SetStreamHandler(pid, handler)
+}
+
+// faultBroadcaster delivers what its inner broadcaster receives late, out
+// of order or never. The CRDT rebroadcasts its heads, lost ones come again.
+type faultBroadcaster struct {
+	crdt.Broadcaster
+	f   *faults
+	key string // of the draws
+
+	out  chan []byte
+	done chan struct{}
+	err  error // once done
+}
+
+func newFaultBroadcaster(inner crdt.Broadcaster, f *faults, key string) *faultBroadcaster {
+	b := &faultBroadcaster{Broadcaster: inner, f: f, key: key, out: make(chan []byte), done: make(chan struct{})}
+	go b.receive()
+	return b
+}
+
+func (b *faultBroadcaster) receive() {
+	for {
+		data, err := b.Broadcaster.Next()
+		if err != nil {
+			b.err = err
+			close(b.done)
+			return
+		}
+		rnd := b.f.source(b.key)
+		if b.f.drop(rnd) {
+			continue
+		}
+		deliver := func() {
+			select {
+			case b.out <- data:
+			case <-b.done:
+			}
+		}
+		if !b.f.Reorder {
+			deliver()
+			continue
+		}
+		time.AfterFunc(b.f.delay(rnd), deliver)
+	}
+}
+
+func (b *faultBroadcaster) Next() ([]byte, error) {
+	select {
+	case data := <-b.out:
+		return data, nil
+	case <-b.done:
+		return nil, b.err
+	}
+}
@@ -0,0 +1,565 @@
+// Package harness runs peerdrive nodes in one process, on a simulated
+// libp2p network with in-memory stores and a temp sync folder each, for
+// end-to-end tests that need no network access.
+package harness
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/discovery"
+	"github.com/libp2p/go-libp2p/core/peer"
+	mocknet "github.com/libp2p/go-libp2p/p2p/net/mock"
+	"github.com/multiformats/go-multiaddr"
+	"golang.org/x/xerrors"
+
+	"github.com/threecorp/peerdrive/pkg/bus"
+	"github.com/threecorp/peerdrive/pkg/clock"
+	"github.com/threecorp/peerdrive/pkg/engine"
+	"github.com/threecorp/peerdrive/pkg/event"
+	"github.com/threecorp/peerdrive/pkg/logging"
+	"github.com/threecorp/peerdrive/pkg/p2p"
+	"github.com/threecorp/peerdrive/pkg/snap"
+	"github.com/threecorp/peerdrive/pkg/watch"
+)
+
+// Options are the settings of every node of a harness, with intervals far
+// shorter than the daemon's so that tests converge in seconds.
+type Options struct {
+	Rendezvous string
+	Node       p2p.Options  // the intervals, Host, Datastore and Discovery are set per node
+	Folder     snap.Options // Events and Clock are set per node
+	Faults     Faults
+	Timeout    time.Duration
+}
+
+func DefaultOptions() Options {
+	nopts := p2p.DefaultOptions()
+	nopts.RebroadcastInterval = 300 * time.Millisecond
+	nopts.DiscoveryInterval = 200 * time.Millisecond
+	nopts.KeepAliveInterval = time.Second
+	nopts.MDNS = false // the mocknet is the network
+
+	fopts := snap.DefaultOptions()
+	fopts.Watcher = watch.Poll
+	fopts.Interval = 100 * time.Millisecond
+	fopts.Settle = 100 * time.Millisecond
+	fopts.Transfer.Backoff = 100 * time.Millisecond
+	fopts.Transfer.MaxBackoff = time.Second
+
+	return Options{
+		Rendezvous: "harness",
+		Node:       nopts,
+		Folder:     fopts,
+		Timeout:    30 * time.Second,
+	}
+}
+
+// Harness is a set of nodes sharing one folder over a mocknet.
+type Harness struct {
+	T     testing.TB
+	Net   mocknet.Mocknet
+	Opts  Options
+	Nodes []*Node
+
+	disc   *Rendezvous
+	faults *faults
+	ctx    context.Context
+	dir    string // of the folders
+
+	mu  sync.Mutex
+	cut map[[2]peer.ID]bool // partitioned pairs, kept across restarts
+}
+
+// New starts n nodes, all linked to each other. They are stopped and their
+// folders removed when the test ends.
+func New(t testing.TB, n int, opts Options) *Harness {
+	t.Helper()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	h := &Harness{
+		T:      t,
+		Net:    mocknet.New(),
+		Opts:   opts,
+		disc:   NewRendezvous(),
+		faults: newFaults(opts.Faults),
+		ctx:    ctx,
+		dir:    t.TempDir(),
+		cut:    map[[2]peer.ID]bool{},
+	}
+	t.Cleanup(func() { // before dir is removed
+		for _, nd := range h.Nodes {
+			nd.Stop()
+		}
+		cancel()
+		h.Net.Close()
+	})
+	for i := 0; i < n; i++ {
+		h.Add()
+	}
+	return h
+}
+
+// Add starts one more node, linked to every other, like a peer joining
+// late.
+func (h *Harness) Add() *Node {
+	h.T.Helper()
+
+	key, _, err := crypto.GenerateEd25519Key(rand.Reader)
+	if err != nil {
+		h.T.Fatal(err)
+	}
+	i := len(h.Nodes)
+	name := fmt.Sprintf("n%d", i)
+	dir := filepath.Join(h.dir, name)
+	if err := os.Mkdir(dir, 0755); err != nil {
+		h.T.Fatal(err)
+	}
+	nd := &Node{
+		Name:   name,
+		Dir:    dir,
+		Key:    key,
+		Store:  dssync.MutexWrap(datastore.NewMapDatastore()),
+		Events: bus.New(),
+		Clock:  h.faults.clock(name),
+		h:      h,
+		addr:   multiaddr.StringCast(fmt.Sprintf("/ip4/10.0.%d.%d/tcp/4001", i/250, i%250+1)),
+	}
+	if err := nd.Start(); err != nil {
+		h.T.Fatalf("%s: %v", nd.Name, err)
+	}
+	h.Nodes = append(h.Nodes, nd)
+	return nd
+}
+
+// WaitConverged waits until every running node has the same tree, and
+// returns it.
+func (h *Harness) WaitConverged() map[string]string {
+	h.T.Helper()
+
+	var tree map[string]string
+	h.Wait("converged", func() error {
+		var err error
+		tree, err = h.converged()
+		return err
+	})
+	return tree
+}
+
+// WaitTree waits until every running node has the tree want, paths mapped
+// to contents.
+func (h *Harness) WaitTree(want map[string]string) {
+	h.T.Helper()
+
+	h.Wait("tree", func() error {
+		for _, nd := range h.Running() {
+			if err := diffTrees(want, nd.Tree()); err != nil {
+				return xerrors.Errorf("%s: %w", nd.Name, err)
+			}
+		}
+		return nil
+	})
+}
+
+// Wait polls cond until it returns nil, and fails the test with its last
+// error past Options.Timeout.
+func (h *Harness) Wait(what string, cond func() error) {
+	h.T.Helper()
+
+	deadline := time.Now().Add(h.Opts.Timeout)
+	for {
+		err := cond()
+		if err == nil {
+			return
+		}
+		if time.Now().After(deadline) {
+			h.T.Fatalf("%s: not after %s: %v", what, h.Opts.Timeout, err)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// Partition cuts the link between a and b, and their connections, until
+// Heal. Restarts keep it cut.
+func (h *Harness) Partition(a, b *Node) {
+	h.T.Helper()
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.cut[pair(a.ID(), b.ID())] = true
+	if len(h.Net.LinksBetweenPeers(a.ID(), b.ID())) == 0 {
+		return // one of them is stopped
+	}
+	if err := h.Net.UnlinkPeers(a.ID(), b.ID()); err != nil {
+		h.T.Fatal(err)
+	}
+	if err := h.Net.DisconnectPeers(a.ID(), b.ID()); err != nil {
+		h.T.Fatal(err)
+	}
+}
+
+// Heal links a and b again, discovery connects them.
+func (h *Harness) Heal(a, b *Node) {
+	h.T.Helper()
+
+	running := a.Running() && b.Running()
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	delete(h.cut, pair(a.ID(), b.ID()))
+	if !running {
+		return // linked on start
+	}
+	if err := h.link(a.ID(), b.ID()); err != nil {
+		h.T.Fatal(err)
+	}
+}
+
+// HealAll heals every partition.
+func (h *Harness) HealAll() {
+	h.T.Helper()
+
+	for i, a := range h.Nodes {
+		for _, b := range h.Nodes[i+1:] {
+			h.Heal(a, b)
+		}
+	}
+}
+
+// SetFaults turns the injected faults on or off, they are on from New.
+func (h *Harness) SetFaults(on bool) {
+	h.faults.on.Store(on)
+}
+
+// link links a and b unless they are, or their pair is cut. The caller
+// holds mu.
+func (h *Harness) link(a, b peer.ID) error {
+	if h.cut[pair(a, b)] || len(h.Net.LinksBetweenPeers(a, b)) > 0 {
+		return nil
+	}
+	_, err := h.Net.LinkPeers(a, b)
+	return err
+}
+
+func pair(a, b peer.ID) [2]peer.ID {
+	if b < a {
+		a, b = b, a
+	}
+	return [2]peer.ID{a, b}
+}
+
+// Running are the nodes that are not stopped.
+func (h *Harness) Running() []*Node {
+	nodes := []*Node{}
+	for _, nd := range h.Nodes {
+		if nd.Running() {
+			nodes = append(nodes, nd)
+		}
+	}
+	return nodes
+}
+
+func (h *Harness) converged() (map[string]string, error) {
+	nodes := h.Running()
+	if len(nodes) == 0 {
+		return nil, xerrors.New("no node running")
+	}
+	first := nodes[0].Tree()
+	for _, nd := range nodes[1:] {
+		if err := diffTrees(first, nd.Tree()); err != nil {
+			return nil, xerrors.Errorf("%s against %s: %w", nd.Name, nodes[0].Name, err)
+		}
+	}
+	return first, nil
+}
+
+// diffTrees tells the first paths where got differs from want.
+func diffTrees(want, got map[string]string) error {
+	diffs := []string{}
+	for path, w := range want {
+		if g, ok := got[path]; !ok {
+			diffs = append(diffs, "missing "+path)
+		} else if g != w {
+			diffs = append(diffs, fmt.Sprintf("%s is %q, want %q", path, clip(g), clip(w)))
+		}
+	}
+	for path := range got {
+		if _, ok := want[path]; !ok {
+			diffs = append(diffs, "extra "+path)
+		}
+	}
+	if len(diffs) == 0 {
+		return nil
+	}
+	sort.Strings(diffs)
+	return xerrors.New(strings.Join(diffs, ", "))
+}
+
+// clip shortens a large content to its start in a message.
+func clip(data string) string {
+	if len(data) > 40 {
+		return data[:40] + "..."
+	}
+	return data
+}
+
+// Node is one peer of the harness, its store kept across restarts.
+type Node struct {
+	Name   string
+	Dir    string
+	Key    crypto.PrivKey
+	Store  datastore.Batching
+	Events *bus.Bus
+	Clock  clock.Clock // skewed by Faults.ClockSkew
+	Engine *engine.Engine
+	P2P    *p2p.Node // of Engine
+	Folder *snap.Folder
+
+	h      *Harness
+	addr   multiaddr.Multiaddr
+	mu     sync.Mutex
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// Start brings the node up on the mocknet, linked to every other node, and
+// starts syncing its folder.
+func (nd *Node) Start() error {
+	nd.mu.Lock()
+	defer nd.mu.Unlock()
+
+	if nd.cancel != nil {
+		return xerrors.Errorf("%s is running", nd.Name)
+	}
+	h := nd.h
+	host, err := h.Net.AddPeer(nd.Key, nd.addr)
+	if err != nil {
+		return err
+	}
+	h.faults.name(host.ID(), nd.Name)
+	h.mu.Lock()
+	for _, other := range h.Nodes {
+		if other == nd || !other.Running() {
+			continue
+		}
+		if err := h.link(host.ID(), other.ID()); err != nil {
+			h.mu.Unlock()
+			return err
+		}
+	}
+	h.mu.Unlock()
+
+	ctx, cancel := context.WithCancel(h.ctx)
+	eopts := engine.Options{Node: h.Opts.Node, Events: nd.Events, Sinks: []event.Sink{event.LogSink{}}, Drain: time.Second}
+	eopts.Node.Key = nd.Key
+	eopts.Node.Host = h.faults.host(host)
+	eopts.Node.Datastore = nopDatastore{nd.Store} // kept for a restart
+	eopts.Node.Discovery = h.disc.Client(host.ID(), host.Addrs())
+	eopts.Node.Broadcast = h.faults.broadcaster(nd.Name)
+	eopts.Node.Clock = nd.Clock
+	eopts.Node.Logger = logging.Logger("p2p").With("node", nd.Name)
+	eng, err := engine.New(ctx, eopts)
+	if err != nil {
+		cancel()
+		return err
+	}
+	fopts := h.Opts.Folder
+	fopts.Clock = nd.Clock
+	fopts.Logger = logging.Logger("snap").With("node", nd.Name)
+	f, err := eng.Open(ctx, nd.Dir, h.Opts.Rendezvous, fopts)
+	if err != nil {
+		cancel()
+		eng.Close()
+		return err
+	}
+
+	nd.Engine, nd.P2P, nd.Folder = eng, eng.Node, f
+	nd.cancel, nd.done = cancel, make(chan struct{})
+	go func() {
+		defer close(nd.done)
+		eng.Run(ctx, nil)
+	}()
+	return nil
+}
+
+// Stop stops syncing and takes the node off the mocknet, its folder and
+// store stay for Start.
+func (nd *Node) Stop() {
+	nd.mu.Lock()
+	defer nd.mu.Unlock()
+
+	if nd.cancel == nil {
+		return
+	}
+	nd.h.disc.Unregister(nd.P2P.Host.ID())
+	nd.cancel()
+	<-nd.done
+	if err := nd.Engine.Close(); err != nil {
+		nd.h.T.Logf("%s close: %v", nd.Name, err)
+	}
+	// links are by peer, the next start would find the ones of this host
+	for _, other := range nd.h.Net.Peers() {
+		nd.h.Net.UnlinkPeers(nd.ID(), other)
+	}
+	nd.cancel, nd.Engine, nd.P2P, nd.Folder = nil, nil, nil, nil
+}
+
+func (nd *Node) Running() bool {
+	nd.mu.Lock()
+	defer nd.mu.Unlock()
+
+	return nd.cancel != nil
+}
+
+func (nd *Node) ID() peer.ID {
+	id, _ := peer.IDFromPrivateKey(nd.Key)
+	return id
+}
+
+func (nd *Node) path(rel string) string {
+	return filepath.Join(nd.Dir, filepath.FromSlash(rel))
+}
+
+// Write creates or replaces the file rel of the folder with data.
+func (nd *Node) Write(rel, data string) {
+	nd.h.T.Helper()
+
+	path := nd.path(rel)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		nd.h.T.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+		nd.h.T.Fatal(err)
+	}
+	now := nd.Clock.Now()
+	if err := os.Chtimes(path, now, now); err != nil {
+		nd.h.T.Fatal(err)
+	}
+}
+
+// Remove deletes the file rel of the folder.
+func (nd *Node) Remove(rel string) {
+	nd.h.T.Helper()
+
+	if err := os.Remove(nd.path(rel)); err != nil {
+		nd.h.T.Fatal(err)
+	}
+}
+
+// Rename moves the file old of the folder to next.
+func (nd *Node) Rename(old, next string) {
+	nd.h.T.Helper()
+
+	if err := os.MkdirAll(filepath.Dir(nd.path(next)), 0755); err != nil {
+		nd.h.T.Fatal(err)
+	}
+	if err := os.Rename(nd.path(old), nd.path(next)); err != nil {
+		nd.h.T.Fatal(err)
+	}
+}
+
+// Read is the content of the file rel, empty when it is missing.
+func (nd *Node) Read(rel string) string {
+	data, _ := os.ReadFile(nd.path(rel))
+	return string(data)
+}
+
+// Tree maps the paths of the synced files of the folder to their content,
+// ignored ones and the work area left out.
+func (nd *Node) Tree() map[string]string {
+	ignore := nd.h.Opts.Folder.Ignore
+	tree := map[string]string{}
+	filepath.WalkDir(nd.Dir, func(path string, de fs.DirEntry, err error) error {
+		if err != nil || path == nd.Dir {
+			return nil
+		}
+		rel, _ := filepath.Rel(nd.Dir, path)
+		rel = filepath.ToSlash(rel)
+		if ignore.Match(rel) {
+			if de.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if de.Type().IsRegular() {
+			data, _ := os.ReadFile(path)
+			tree[rel] = string(data)
+		}
+		return nil
+	})
+	return tree
+}
+
+// nopDatastore keeps the store of a node open when the node is closed.
+type nopDatastore struct {
+	datastore.Batching
+}
+
+func (nopDatastore) Close() error { return nil }
+
+// Rendezvous is an in-memory discovery shared by the nodes of a harness,
+// standing in for the DHT.
+type Rendezvous struct {
+	mu    sync.Mutex
+	peers map[string]map[peer.ID]peer.AddrInfo
+}
+
+func NewRendezvous() *Rendezvous {
+	return &Rendezvous{peers: map[string]map[peer.ID]peer.AddrInfo{}}
+}
+
+// Client is the discovery of the peer id, listening on addrs.
+func (r *Rendezvous) Client(id peer.ID, addrs []multiaddr.Multiaddr) discovery.Discovery {
+	return &rendezvousClient{r: r, info: peer.AddrInfo{ID: id, Addrs: addrs}}
+}
+
+// Unregister forgets id in every namespace, like a peer gone offline.
+func (r *Rendezvous) Unregister(id peer.ID) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, peers := range r.peers {
+		delete(peers, id)
+	}
+}
+
+type rendezvousClient struct {
+	r    *Rendezvous
+	info peer.AddrInfo
+}
+
+func (c *rendezvousClient) Advertise(ctx context.Context, ns string, opts ...discovery.Option) (time.Duration, error) {
+	c.r.mu.Lock()
+	defer c.r.mu.Unlock()
+
+	if c.r.peers[ns] == nil {
+		c.r.peers[ns] = map[peer.ID]peer.AddrInfo{}
+	}
+	c.r.peers[ns][c.info.ID] = c.info
+	return time.Second, nil
+}
+
+func (c *rendezvousClient) FindPeers(ctx context.Context, ns string, opts ...discovery.Option) (<-chan peer.AddrInfo, error) {
+	c.r.mu.Lock()
+	defer c.r.mu.Unlock()
+
+	ch := make(chan peer.AddrInfo, len(c.r.peers[ns]))
+	for _, info := range c.r.peers[ns] {
+		ch <- info
+	}
+	close(ch)
+	return ch, nil
+}
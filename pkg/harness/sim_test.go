@@ -0,0 +1,205 @@
+package harness
+
+import (
+	"flag"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/xerrors"
+)
+
+var (
+	seed  = flag.Int64("seed", 0, "seed of the draws of TestSimulation, 0 picks one; not a replay of a run")
+	steps = flag.Int("steps", 40, "steps of TestSimulation")
+)
+
+// TestSimulation edits, partitions and restarts nodes at random over a
+// faulty network, then checks that they converge without losing a write:
+// every content written and not replaced or deleted by the node that held
+// it is still somewhere in the tree, if only as a conflict copy. The nodes
+// run in real time, libp2p and the CRDT with them, so the seed it logs
+// doesn't replay a failure: the steps it logs tell what happened.
+func TestSimulation(t *testing.T) {
+	if testing.Short() {
+		t.Skip("long")
+	}
+	s := *seed
+	if s == 0 {
+		s = time.Now().UnixNano()
+	}
+	t.Logf("seed %d", s)
+
+	opts := DefaultOptions()
+	opts.Faults = Faults{Seed: s, DropRate: 0.1, MaxDelay: 200 * time.Millisecond, Reorder: true, ClockSkew: 2 * time.Second}
+	opts.Timeout = 2 * time.Minute
+	sm := &sim{h: New(t, 3, opts), rnd: rand.New(rand.NewSource(s)), live: map[string]bool{}}
+
+	for i := 0; i < *steps; i++ {
+		sm.step()
+		time.Sleep(time.Duration(sm.rnd.Intn(300)) * time.Millisecond)
+	}
+
+	h := sm.h
+	h.SetFaults(false)
+	h.HealAll()
+	for _, nd := range h.Nodes {
+		if !nd.Running() {
+			if err := nd.Start(); err != nil {
+				t.Fatalf("%s: %v", nd.Name, err)
+			}
+		}
+	}
+	h.Wait("converged without lost writes", func() error {
+		tree, err := h.converged()
+		if err != nil {
+			return err
+		}
+		return sm.lost(tree)
+	})
+}
+
+// sim drives the steps of TestSimulation, live are the ids of the contents
+// that must survive.
+type sim struct {
+	h    *Harness
+	rnd  *rand.Rand
+	n    int
+	live map[string]bool
+}
+
+func (sm *sim) step() {
+	h := sm.h
+	running := h.Running()
+	switch r := sm.rnd.Intn(100); {
+	case r < 30:
+		nd := sm.pick(running)
+		sm.write(nd, fmt.Sprintf("d%d/f%d.txt", sm.rnd.Intn(3), sm.n))
+	case r < 55:
+		nd := sm.pick(running)
+		if rel, ok := sm.file(nd); ok {
+			delete(sm.live, id(nd.Read(rel)))
+			sm.write(nd, rel)
+		}
+	case r < 65:
+		nd := sm.pick(running)
+		if rel, ok := sm.file(nd); ok {
+			delete(sm.live, id(nd.Read(rel)))
+			h.T.Logf("%s: remove %s", nd.Name, rel)
+			os.Remove(nd.path(rel))
+		}
+	case r < 75:
+		nd := sm.pick(running)
+		if rel, ok := sm.file(nd); ok {
+			sm.n++
+			next := fmt.Sprintf("d%d/r%d.txt", sm.rnd.Intn(3), sm.n)
+			h.T.Logf("%s: rename %s to %s", nd.Name, rel, next)
+			os.MkdirAll(filepath.Dir(nd.path(next)), 0755)
+			os.Rename(nd.path(rel), nd.path(next))
+		}
+	case r < 85:
+		a, b := sm.pick(h.Nodes), sm.pick(h.Nodes)
+		if a != b {
+			h.T.Logf("partition %s %s", a.Name, b.Name)
+			h.Partition(a, b)
+		}
+	case r < 90:
+		a, b := sm.pick(h.Nodes), sm.pick(h.Nodes)
+		if a != b {
+			h.T.Logf("heal %s %s", a.Name, b.Name)
+			h.Heal(a, b)
+		}
+	default:
+		sm.restart(running)
+	}
+}
+
+// restart starts a stopped node, or stops one, a node in the middle of a
+// transfer preferably.
+func (sm *sim) restart(running []*Node) {
+	h := sm.h
+	if len(running) < len(h.Nodes) {
+		for _, nd := range h.Nodes {
+			if !nd.Running() {
+				h.T.Logf("%s: start", nd.Name)
+				if err := nd.Start(); err != nil {
+					h.T.Fatalf("%s: %v", nd.Name, err)
+				}
+			}
+		}
+		return
+	}
+	busy := []*Node{}
+	for _, nd := range running {
+		if nd.Folder.Transfers.Len() > 0 {
+			busy = append(busy, nd)
+		}
+	}
+	nd := sm.pick(running)
+	if len(busy) > 0 {
+		nd = sm.pick(busy)
+	}
+	h.T.Logf("%s: stop", nd.Name)
+	nd.Stop()
+}
+
+// write writes a new content to rel of nd, a large one at times so that
+// restarts and dropped streams hit a transfer midway.
+func (sm *sim) write(nd *Node, rel string) {
+	sm.n++
+	c := fmt.Sprintf("c%d", sm.n)
+	size := sm.rnd.Intn(64)
+	if sm.rnd.Intn(5) == 0 {
+		size = 1<<20 + sm.rnd.Intn(1<<20)
+	}
+	sm.h.T.Logf("%s: write %s %s, %d bytes", nd.Name, rel, c, size)
+	sm.live[c] = true
+	nd.Write(rel, c+"\n"+strings.Repeat("x", size))
+}
+
+func (sm *sim) pick(nodes []*Node) *Node {
+	return nodes[sm.rnd.Intn(len(nodes))]
+}
+
+// file picks a file of the tree of nd.
+func (sm *sim) file(nd *Node) (string, bool) {
+	paths := []string{}
+	for rel := range nd.Tree() {
+		paths = append(paths, rel)
+	}
+	if len(paths) == 0 {
+		return "", false
+	}
+	sort.Strings(paths)
+	return paths[sm.rnd.Intn(len(paths))], true
+}
+
+// lost tells the live contents missing from tree.
+func (sm *sim) lost(tree map[string]string) error {
+	found := map[string]bool{}
+	for _, data := range tree {
+		found[id(data)] = true
+	}
+	missing := []string{}
+	for c := range sm.live {
+		if !found[c] {
+			missing = append(missing, c)
+		}
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+	sort.Strings(missing)
+	return xerrors.Errorf("lost %s", strings.Join(missing, ", "))
+}
+
+// id is the first line of a content written by sim.
+func id(data string) string {
+	c, _, _ := strings.Cut(data, "\n")
+	return c
+}
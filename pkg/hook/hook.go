@@ -0,0 +1,241 @@
+package hook
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"time"
+
+	"golang.org/x/xerrors"
+
+	"github.com/threecorp/peerdrive/pkg/bus"
+	"github.com/threecorp/peerdrive/pkg/dev"
+	"github.com/threecorp/peerdrive/pkg/logging"
+)
+
+var log = logging.Logger("hook")
+
+const (
+	DefaultDebounce = time.Second
+	DefaultTimeout  = time.Minute
+)
+
+// maxEnvPaths caps PEERDRIVE_PATHS, stdin has every event.
+const maxEnvPaths = 100
+
+// waitDelay is how long a killed hook may keep its output open, through
+// processes it started, before it is waited for no more.
+const waitDelay = time.Second
+
+// Hook is a command run by the shell on sync events of a folder, from the
+// folder's directory. The events are on stdin as a JSON array and sum up in
+// PEERDRIVE_* environment variables.
+type Hook struct {
+	Command  string
+	Paths    []string      // globs like ignore, empty matches every path
+	Debounce time.Duration // quiet time gathering events into one run
+	Timeout  time.Duration // the command is killed past it, with what it started
+}
+
+// Config are the hooks of a folder by what triggers them.
+type Config struct {
+	OnRemoteChange []Hook `yaml:"on_remote_change"` // peers' changes were applied
+	OnConflict     []Hook `yaml:"on_conflict"`      // a concurrent edit replaced a local one
+	OnPeerConnect  []Hook `yaml:"on_peer_connect"`  // a peer sharing the folder was found
+}
+
+type trigger struct {
+	name  string
+	typ   bus.Type
+	hooks []Hook
+}
+
+func (c *Config) triggers() []trigger {
+	return []trigger{
+		{"on_remote_change", bus.RemoteChangeApplied, c.OnRemoteChange},
+		{"on_conflict", bus.ConflictCreated, c.OnConflict},
+		{"on_peer_connect", bus.PeerJoined, c.OnPeerConnect},
+	}
+}
+
+func (c *Config) Validate() error {
+	for _, t := range c.triggers() {
+		for i, h := range t.hooks {
+			if strings.TrimSpace(h.Command) == "" {
+				return xerrors.Errorf("%s[%d]: missing command", t.name, i)
+			}
+			if err := dev.Ignore(h.Paths).Validate(); err != nil {
+				return xerrors.Errorf("%s[%d]: %w", t.name, i, err)
+			}
+			if h.Debounce < 0 || h.Timeout < 0 {
+				return xerrors.Errorf("%s[%d]: debounce and timeout can't be negative", t.name, i)
+			}
+		}
+	}
+	return nil
+}
+
+// Run runs the hooks of the folder dir, shared with group, on the events
+// of b until ctx is done. Hooks run one batch at a time each, the events
+// of a slow hook queue up and the ones beyond its buffer are dropped, sync
+// never waits for them.
+func Run(ctx context.Context, b *bus.Bus, dir, group string, cfg Config) {
+	if b == nil {
+		return
+	}
+	type target struct {
+		typ bus.Type
+		r   *runner
+	}
+	targets := []target{}
+	for _, t := range cfg.triggers() {
+		for _, h := range t.hooks {
+			r := newRunner(t.name, dir, h)
+			go r.loop(ctx)
+			targets = append(targets, target{t.typ, r})
+		}
+	}
+	if len(targets) == 0 {
+		return
+	}
+
+	events, cancel := b.Subscribe(0)
+	defer cancel()
+	for {
+		var ev bus.Event
+		select {
+		case <-ctx.Done():
+			return
+		case ev = <-events:
+		}
+		for _, t := range targets {
+			if ev.Type != t.typ {
+				continue
+			}
+			switch {
+			case ev.Type == bus.PeerJoined && ev.Group != group:
+				continue
+			case ev.Type != bus.PeerJoined && (ev.Folder != dir || !t.r.match(ev.Path)):
+				continue
+			}
+			select {
+			case t.r.in <- ev:
+			default:
+				log.Warnw("hook is lagging, event dropped", "hook", t.r.name, "folder", dir, "command", t.r.hook.Command)
+			}
+		}
+	}
+}
+
+type runner struct {
+	name string
+	dir  string
+	hook Hook
+	in   chan bus.Event
+}
+
+func newRunner(name, dir string, h Hook) *runner {
+	if h.Debounce <= 0 {
+		h.Debounce = DefaultDebounce
+	}
+	if h.Timeout <= 0 {
+		h.Timeout = DefaultTimeout
+	}
+	return &runner{name: name, dir: dir, hook: h, in: make(chan bus.Event, bus.DefaultBuffer)}
+}
+
+func (r *runner) match(path string) bool {
+	return len(r.hook.Paths) == 0 || dev.Ignore(r.hook.Paths).Match(path)
+}
+
+// loop gathers events until they calm down for the debounce time, then
+// runs the hook with them.
+func (r *runner) loop(ctx context.Context) {
+	timer := time.NewTimer(r.hook.Debounce)
+	timer.Stop()
+	defer timer.Stop()
+
+	batch := []bus.Event{}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case ev := <-r.in:
+			batch = append(batch, ev)
+			if !timer.Stop() {
+				select {
+				case <-timer.C:
+				default:
+				}
+			}
+			timer.Reset(r.hook.Debounce)
+		case <-timer.C:
+			if err := r.run(ctx, batch); err != nil && ctx.Err() == nil {
+				log.Errorw("hook failed", "hook", r.name, "folder", r.dir, "command", r.hook.Command, "error", err)
+			}
+			batch = []bus.Event{}
+		}
+	}
+}
+
+func (r *runner) run(ctx context.Context, batch []bus.Event) error {
+	ctx, cancel := context.WithTimeout(ctx, r.hook.Timeout)
+	defer cancel()
+
+	stdin, err := json.Marshal(batch)
+	if err != nil {
+		return err
+	}
+	shell, flag := "sh", "-c"
+	if runtime.GOOS == "windows" {
+		shell, flag = "cmd", "/C"
+	}
+	cmd := exec.CommandContext(ctx, shell, flag, r.hook.Command)
+	killGroup(cmd)
+	cmd.WaitDelay = waitDelay
+	cmd.Dir = r.dir
+	cmd.Env = append(os.Environ(), r.env(batch)...)
+	cmd.Stdin = bytes.NewReader(stdin)
+	out := bytes.NewBuffer(nil)
+	cmd.Stdout, cmd.Stderr = out, out
+
+	start := time.Now()
+	err = cmd.Run()
+	if ctx.Err() == context.DeadlineExceeded {
+		err = xerrors.Errorf("timed out after %s", r.hook.Timeout)
+	}
+	if err != nil {
+		return xerrors.Errorf("%v, output %q", err, bytes.TrimSpace(out.Bytes()))
+	}
+	log.Debugw("hook ran", "hook", r.name, "folder", r.dir, "command", r.hook.Command,
+		"events", len(batch), "took", time.Since(start), "output", out.String())
+	return nil
+}
+
+// env sums batch up for scripts that don't read stdin.
+func (r *runner) env(batch []bus.Event) []string {
+	paths, peers := []string{}, []string{}
+	seenPath, seenPeer := map[string]bool{}, map[string]bool{}
+	for _, ev := range batch {
+		if ev.Path != "" && !seenPath[ev.Path] && len(paths) < maxEnvPaths {
+			seenPath[ev.Path] = true
+			paths = append(paths, ev.Path)
+		}
+		if ev.Peer != "" && !seenPeer[ev.Peer] {
+			seenPeer[ev.Peer] = true
+			peers = append(peers, ev.Peer)
+		}
+	}
+	return []string{
+		"PEERDRIVE_HOOK=" + r.name,
+		"PEERDRIVE_FOLDER=" + r.dir,
+		fmt.Sprintf("PEERDRIVE_COUNT=%d", len(batch)),
+		"PEERDRIVE_PATHS=" + strings.Join(paths, "\n"),
+		"PEERDRIVE_PEERS=" + strings.Join(peers, "\n"),
+	}
+}
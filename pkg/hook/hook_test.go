@@ -0,0 +1,166 @@
+package hook
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/threecorp/peerdrive/pkg/bus"
+)
+
+func TestValidate(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		cfg  Config
+		want string // in the error, empty for none
+	}{
+		{"none", Config{}, ""},
+		{"command", Config{OnConflict: []Hook{{Command: "true", Paths: []string{"*.txt"}}}}, ""},
+		{"missing command", Config{OnRemoteChange: []Hook{{Command: " "}}}, "on_remote_change[0]: missing command"},
+		{"paths", Config{OnConflict: []Hook{{Command: "true", Paths: []string{"["}}}}, "on_conflict[0]"},
+		{"debounce", Config{OnPeerConnect: []Hook{{Command: "true", Debounce: -time.Second}}}, "negative"},
+		{"timeout", Config{OnPeerConnect: []Hook{{Command: "true"}, {Command: "true", Timeout: -time.Second}}}, "on_peer_connect[1]"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.cfg.Validate()
+			switch {
+			case tt.want == "" && err != nil:
+				t.Errorf("error %v", err)
+			case tt.want != "" && err == nil:
+				t.Errorf("no error, want %q", tt.want)
+			case tt.want != "" && !strings.Contains(err.Error(), tt.want):
+				t.Errorf("error %v, want %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func skipWindows(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("hooks are sh commands here")
+	}
+}
+
+// wait polls for the file name for a few seconds, calling poke each time.
+func wait(t *testing.T, name string, poke func()) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		if _, err := os.Stat(name); err == nil {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("no %s", name)
+		}
+		poke()
+	}
+}
+
+// TestRun runs a hook once on the events of its folder and paths that came
+// within the debounce time, once a peer of its group made the other ready.
+func TestRun(t *testing.T) {
+	skipWindows(t)
+	dir := t.TempDir()
+	b := bus.New()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	cfg := Config{
+		OnRemoteChange: []Hook{{
+			Command:  `cat > "$PEERDRIVE_HOOK.json"; printf '%s\n%s' "$PEERDRIVE_COUNT" "$PEERDRIVE_PATHS" > env`,
+			Paths:    []string{"*.txt"},
+			Debounce: 100 * time.Millisecond,
+		}},
+		OnConflict:    []Hook{{Command: `cat > conflict.json`, Debounce: 10 * time.Millisecond}},
+		OnPeerConnect: []Hook{{Command: `echo "$PEERDRIVE_PEERS" > ready`, Debounce: 10 * time.Millisecond}},
+	}
+	go Run(ctx, b, dir, "group", cfg)
+	wait(t, filepath.Join(dir, "ready"), func() {
+		b.Publish(bus.Event{Type: bus.PeerJoined, Group: "other", Peer: "q"})
+		b.Publish(bus.Event{Type: bus.PeerJoined, Group: "group", Peer: "p"})
+	})
+	if ready, err := os.ReadFile(filepath.Join(dir, "ready")); err != nil || string(ready) != "p\n" {
+		t.Errorf("peers %q, error %v", ready, err)
+	}
+
+	for _, ev := range []bus.Event{
+		{Type: bus.RemoteChangeApplied, Folder: dir, Path: "a.txt"},
+		{Type: bus.RemoteChangeApplied, Folder: dir, Path: "b.bin"},                       // other paths
+		{Type: bus.RemoteChangeApplied, Folder: "/elsewhere", Path: "c.txt"},              // other folder
+		{Type: bus.ConflictCreated, Folder: dir, Path: "d.txt", Copy: "d.conflict-1.txt"}, // other trigger
+		{Type: bus.RemoteChangeApplied, Folder: dir, Path: "dir/e.txt", Peer: "p"},
+		{Type: bus.RemoteChangeApplied, Folder: dir, Path: "a.txt"},
+	} {
+		b.Publish(ev)
+	}
+
+	name := filepath.Join(dir, "env")
+	wait(t, name, func() {})
+	time.Sleep(50 * time.Millisecond) // written
+	env, err := os.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "3\na.txt\ndir/e.txt"; string(env) != want {
+		t.Errorf("env %q, want %q", env, want)
+	}
+	data, err := os.ReadFile(filepath.Join(dir, "on_remote_change.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	evs := []bus.Event{}
+	if err := json.Unmarshal(data, &evs); err != nil {
+		t.Fatal(err)
+	}
+	if len(evs) != 3 || evs[1].Path != "dir/e.txt" || evs[1].Peer != "p" {
+		t.Errorf("stdin %s", data)
+	}
+
+	name = filepath.Join(dir, "conflict.json")
+	wait(t, name, func() {})
+	time.Sleep(50 * time.Millisecond) // written
+	data, err = os.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	evs = []bus.Event{}
+	if err := json.Unmarshal(data, &evs); err != nil {
+		t.Fatal(err)
+	}
+	if len(evs) != 1 || evs[0].Path != "d.txt" || evs[0].Copy != "d.conflict-1.txt" {
+		t.Errorf("conflict stdin %s", data)
+	}
+}
+
+// TestTimeout kills a hook past its timeout, with what it started.
+func TestTimeout(t *testing.T) {
+	skipWindows(t)
+	dir := t.TempDir()
+	r := newRunner("on_conflict", dir, Hook{Command: "(sleep 1; touch late) & sleep 10", Timeout: 100 * time.Millisecond})
+
+	start := time.Now()
+	err := r.run(context.Background(), nil)
+	if err == nil || !strings.Contains(err.Error(), "timed out") {
+		t.Errorf("error %v, want a timeout", err)
+	}
+	if took := time.Since(start); took > time.Second {
+		t.Errorf("killed after %s", took)
+	}
+	time.Sleep(1500 * time.Millisecond)
+	if _, err := os.Stat(filepath.Join(dir, "late")); !os.IsNotExist(err) {
+		t.Errorf("started process still ran: %v", err)
+	}
+}
+
+func TestFailure(t *testing.T) {
+	skipWindows(t)
+	r := newRunner("on_peer_connect", t.TempDir(), Hook{Command: "echo oops; exit 3"})
+	err := r.run(context.Background(), nil)
+	if err == nil || !strings.Contains(err.Error(), "oops") {
+		t.Errorf("error %v, want the output", err)
+	}
+}
@@ -0,0 +1,9 @@
+//go:build !unix
+
+package hook
+
+import "os/exec"
+
+// killGroup is not available, only the shell is killed. WaitDelay still
+// bounds the wait for what it started.
+func killGroup(cmd *exec.Cmd) {}
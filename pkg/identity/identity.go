@@ -0,0 +1,280 @@
+package identity
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/pem"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"golang.org/x/crypto/scrypt"
+	"golang.org/x/xerrors"
+
+	"github.com/threecorp/peerdrive/pkg/dev"
+	"github.com/threecorp/peerdrive/pkg/logging"
+)
+
+var log = logging.Logger("identity")
+
+// PassphraseEnv names the environment variable holding the passphrase of
+// the key file. Without it keys are stored in plain text, still 0600.
+const PassphraseEnv = "PEERDRIVE_PASSPHRASE"
+
+const (
+	plainBlock     = "PEERDRIVE PRIVATE KEY"
+	encryptedBlock = "PEERDRIVE ENCRYPTED PRIVATE KEY"
+)
+
+// Type is the kind of key a new identity gets.
+type Type string
+
+const (
+	Ed25519 Type = "ed25519"
+	ECDSA   Type = "ecdsa"
+	RSA     Type = "rsa"
+)
+
+func ParseType(s string) (Type, error) {
+	switch t := Type(strings.ToLower(s)); t {
+	case Ed25519, ECDSA, RSA:
+		return t, nil
+	case "":
+		return Ed25519, nil
+	default:
+		return "", xerrors.Errorf("unknown key type %q, want %s, %s or %s", s, Ed25519, ECDSA, RSA)
+	}
+}
+
+func (t Type) keyType() int {
+	switch t {
+	case ECDSA:
+		return crypto.ECDSA
+	case RSA:
+		return crypto.RSA
+	default:
+		return crypto.Ed25519
+	}
+}
+
+// Options locate the key file and tell how to create it.
+type Options struct {
+	Path       string // empty is DefaultPath
+	Type       Type   // of a new key
+	Passphrase string // encrypts the key file, empty is plain text
+}
+
+func DefaultOptions() Options {
+	return Options{Type: Ed25519, Passphrase: os.Getenv(PassphraseEnv)}
+}
+
+// Dir is the per-user config directory of peerdrive.
+func Dir() (string, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "peerdrive"), nil
+}
+
+// DefaultPath is the key file in Dir.
+func DefaultPath() (string, error) {
+	dir, err := Dir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "identity.key"), nil
+}
+
+// File is the key file, Path or DefaultPath.
+func (o *Options) File() (string, error) {
+	if o.Path != "" {
+		return o.Path, nil
+	}
+	return DefaultPath()
+}
+
+// Generate makes a new key of type t.
+func Generate(t Type) (crypto.PrivKey, error) {
+	bits := 0
+	if t == RSA {
+		bits = 2048
+	}
+	key, _, err := crypto.GenerateKeyPairWithReader(t.keyType(), bits, rand.Reader)
+	return key, err
+}
+
+// Load reads the key file, creating one on first use. A key file left by
+// older versions in the working directory is taken over, so the peer ID
+// stays the same.
+func Load(opts Options) (crypto.PrivKey, error) {
+	name, err := opts.File()
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := Read(name, opts.Passphrase)
+	if err == nil || !os.IsNotExist(err) {
+		return key, err
+	}
+
+	data, err := os.ReadFile(dev.PrivateKeyName)
+	legacy := err == nil
+	if legacy {
+		if key, err = crypto.UnmarshalPrivateKey(data); err != nil {
+			return nil, xerrors.Errorf("legacy key %s: %w", dev.PrivateKeyName, err)
+		}
+		log.Infow("moving legacy key", "from", dev.PrivateKeyName, "to", name)
+	} else if key, err = Generate(opts.Type); err != nil {
+		return nil, err
+	}
+	if err := Write(name, key, opts.Passphrase); err != nil {
+		return nil, err
+	}
+	if legacy {
+		os.Remove(dev.PrivateKeyName)
+	}
+	return key, nil
+}
+
+// Read reads the key file name, which needs passphrase when encrypted. A
+// file readable by others is made private.
+func Read(name, passphrase string) (crypto.PrivKey, error) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	if fi, err := os.Stat(name); err == nil && fi.Mode().Perm()&0077 != 0 {
+		log.Warnw("key file is readable by others, making it private", "file", name)
+		if err := os.Chmod(name, 0600); err != nil {
+			return nil, err
+		}
+	}
+	key, err := Decode(data, passphrase)
+	if err != nil {
+		return nil, xerrors.Errorf("%s: %w", name, err)
+	}
+	return key, nil
+}
+
+// Write stores key in the file name with 0600 permissions, encrypted when
+// passphrase is set.
+func Write(name string, key crypto.PrivKey, passphrase string) error {
+	data, err := Encode(key, passphrase)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(name), 0700); err != nil {
+		return err
+	}
+
+	tmp := name + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, name)
+}
+
+// Encode is the PEM form of key, encrypted when passphrase is set.
+func Encode(key crypto.PrivKey, passphrase string) ([]byte, error) {
+	raw, err := crypto.MarshalPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	if passphrase == "" {
+		return pem.EncodeToMemory(&pem.Block{Type: plainBlock, Bytes: raw}), nil
+	}
+
+	salt := make([]byte, 16)
+	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+		return nil, err
+	}
+	aead, err := newAEAD(passphrase, salt)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{
+		Type:    encryptedBlock,
+		Headers: map[string]string{"Salt": hex.EncodeToString(salt)},
+		Bytes:   aead.Seal(nonce, nonce, raw, nil),
+	}), nil
+}
+
+// Decode reads a key written by Encode, or the raw key files of older
+// versions.
+func Decode(data []byte, passphrase string) (crypto.PrivKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return crypto.UnmarshalPrivateKey(data)
+	}
+
+	switch block.Type {
+	case plainBlock:
+		return crypto.UnmarshalPrivateKey(block.Bytes)
+	case encryptedBlock:
+		if passphrase == "" {
+			return nil, xerrors.Errorf("key is encrypted, set %s", PassphraseEnv)
+		}
+		salt, err := hex.DecodeString(block.Headers["Salt"])
+		if err != nil {
+			return nil, xerrors.Errorf("key salt: %w", err)
+		}
+		aead, err := newAEAD(passphrase, salt)
+		if err != nil {
+			return nil, err
+		}
+		if len(block.Bytes) < aead.NonceSize() {
+			return nil, xerrors.New("key is truncated")
+		}
+		n := aead.NonceSize()
+		raw, err := aead.Open(nil, block.Bytes[:n], block.Bytes[n:], nil)
+		if err != nil {
+			return nil, xerrors.New("wrong passphrase")
+		}
+		return crypto.UnmarshalPrivateKey(raw)
+	default:
+		return nil, xerrors.Errorf("unknown key block %q", block.Type)
+	}
+}
+
+// Encrypted tells whether the key file data needs a passphrase.
+func Encrypted(data []byte) bool {
+	block, _ := pem.Decode(data)
+	return block != nil && block.Type == encryptedBlock
+}
+
+func newAEAD(passphrase string, salt []byte) (cipher.AEAD, error) {
+	key, err := scrypt.Key([]byte(passphrase), salt, 1<<15, 8, 1, 32)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// TypeOf names the type of key, like Ed25519.
+func TypeOf(key crypto.PubKey) string {
+	switch key.Type() {
+	case crypto.Ed25519:
+		return "Ed25519"
+	case crypto.ECDSA:
+		return "ECDSA"
+	case crypto.RSA:
+		return "RSA"
+	case crypto.Secp256k1:
+		return "Secp256k1"
+	default:
+		return key.Type().String()
+	}
+}
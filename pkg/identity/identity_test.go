@@ -0,0 +1,231 @@
+package identity
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+func TestParseType(t *testing.T) {
+	for _, tt := range []struct {
+		in   string
+		want Type
+		ok   bool
+	}{
+		{"", Ed25519, true},
+		{"ed25519", Ed25519, true},
+		{"ECDSA", ECDSA, true},
+		{"rsa", RSA, true},
+		{"dsa", "", false},
+	} {
+		got, err := ParseType(tt.in)
+		if got != tt.want || (err == nil) != tt.ok {
+			t.Errorf("ParseType(%q) %q, %v", tt.in, got, err)
+		}
+	}
+}
+
+func TestEncode(t *testing.T) {
+	for _, tt := range []struct {
+		name       string
+		typ        Type
+		passphrase string // of Encode
+		decodeWith string
+		want       string // in the error of Decode, empty for none
+	}{
+		{"plain", Ed25519, "", "", ""},
+		{"plain ignores passphrase", Ed25519, "", "secret", ""},
+		{"ecdsa", ECDSA, "", "", ""},
+		{"rsa", RSA, "", "", ""},
+		{"encrypted", Ed25519, "secret", "secret", ""},
+		{"wrong passphrase", Ed25519, "secret", "guess", "wrong passphrase"},
+		{"missing passphrase", Ed25519, "secret", "", PassphraseEnv},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			key, err := Generate(tt.typ)
+			if err != nil {
+				t.Fatal(err)
+			}
+			data, err := Encode(key, tt.passphrase)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if Encrypted(data) != (tt.passphrase != "") {
+				t.Errorf("encrypted %v with passphrase %q", Encrypted(data), tt.passphrase)
+			}
+
+			got, err := Decode(data, tt.decodeWith)
+			if tt.want != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.want) {
+					t.Errorf("error %v, want %q", err, tt.want)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !got.Equals(key) {
+				t.Error("decoded another key")
+			}
+		})
+	}
+}
+
+// TestDecodeLegacy reads the raw key files of older versions.
+func TestDecodeLegacy(t *testing.T) {
+	key, err := Generate(Ed25519)
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, err := crypto.MarshalPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := Decode(raw, "")
+	if err != nil || !got.Equals(key) {
+		t.Errorf("legacy key not decoded: %v", err)
+	}
+}
+
+func TestLoad(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "dir", "identity.key")
+	opts := Options{Path: name, Type: ECDSA, Passphrase: "secret"}
+
+	key, err := Load(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key.Type() != crypto.ECDSA {
+		t.Errorf("new key of type %s", key.Type())
+	}
+	fi, err := os.Stat(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0600 {
+		t.Errorf("key file mode %s", fi.Mode())
+	}
+
+	if err := os.Chmod(name, 0644); err != nil {
+		t.Fatal(err)
+	}
+	again, err := Load(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !again.Equals(key) {
+		t.Error("loaded another key")
+	}
+	if fi, err := os.Stat(name); err != nil || fi.Mode().Perm() != 0600 {
+		t.Errorf("key file readable by others left as is: %v", err)
+	}
+}
+
+func TestRotation(t *testing.T) {
+	keys := make([]crypto.PrivKey, 3)
+	ids := make([]peer.ID, len(keys))
+	for i := range keys {
+		var err error
+		if keys[i], err = Generate(Ed25519); err != nil {
+			t.Fatal(err)
+		}
+		if ids[i], err = peer.IDFromPrivateKey(keys[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	rotate := func(old, next int) *Rotation {
+		r, err := NewRotation(keys[old], keys[next])
+		if err != nil {
+			t.Fatal(err)
+		}
+		return r
+	}
+	forged := rotate(0, 1)
+	forged.New = ids[2]
+
+	for _, tt := range []struct {
+		name      string
+		chain     Chain
+		announcer int
+		want      []peer.ID // nil for an error
+	}{
+		{"none", Chain{}, 0, []peer.ID{}},
+		{"one", Chain{rotate(0, 1)}, 1, []peer.ID{ids[0]}},
+		{"two", Chain{rotate(0, 1), rotate(1, 2)}, 2, []peer.ID{ids[0], ids[1]}},
+		{"other announcer", Chain{rotate(0, 1)}, 2, nil},
+		{"broken chain", Chain{rotate(0, 1), rotate(0, 2)}, 2, nil},
+		{"forged", Chain{forged}, 2, nil},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			data, err := tt.chain.Marshal()
+			if err != nil {
+				t.Fatal(err)
+			}
+			c := Chain{}
+			if err := c.Unmarshal(data); err != nil {
+				t.Fatal(err)
+			}
+			got, err := c.Verify(ids[tt.announcer])
+			if tt.want == nil {
+				if err == nil {
+					t.Errorf("verified %v", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("former IDs %v, want %v", got, tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Fatalf("former IDs %v, want %v", got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+// TestRotations keeps the rotations announced until they expire.
+func TestRotations(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "identity.key")
+	if c, err := ReadRotations(name); err != nil || len(c) != 0 {
+		t.Fatalf("rotations %v, error %v", c, err)
+	}
+
+	keys := make([]crypto.PrivKey, 3)
+	for i := range keys {
+		var err error
+		if keys[i], err = Generate(Ed25519); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expired, err := NewRotation(keys[0], keys[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	expired.Time = expired.Time.Add(-RotationTTL - time.Hour)
+	live, err := NewRotation(keys[1], keys[2])
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range []*Rotation{expired, live} {
+		if err := AddRotation(name, r); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	c, err := ReadRotations(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(c) != 1 || c[0].New != live.New {
+		t.Errorf("rotations %v, want the live one", c)
+	}
+}
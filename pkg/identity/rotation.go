@@ -0,0 +1,144 @@
+package identity
+
+import (
+	"bytes"
+	"encoding/gob"
+	"os"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"golang.org/x/xerrors"
+)
+
+// RotationTTL is how long a rotation keeps being announced, peers offline
+// for longer have to be told the new peer ID some other way.
+const RotationTTL = 30 * 24 * time.Hour
+
+// Rotation tells peers that the device known as the owner of OldKey is
+// now New. It is signed by the old key, and announced by the new one.
+type Rotation struct {
+	OldKey []byte // marshalled public key, peer IDs don't always embed it
+	New    peer.ID
+	Time   time.Time
+	Sig    []byte
+}
+
+func (r *Rotation) payload() []byte {
+	buf := bytes.NewBuffer(nil)
+	buf.WriteString("peerdrive rotation\n")
+	buf.Write(r.OldKey)
+	buf.WriteString(r.New.String())
+	buf.WriteString(r.Time.UTC().Format(time.RFC3339Nano))
+	return buf.Bytes()
+}
+
+// NewRotation signs over from old to next.
+func NewRotation(old, next crypto.PrivKey) (*Rotation, error) {
+	oldKey, err := crypto.MarshalPublicKey(old.GetPublic())
+	if err != nil {
+		return nil, err
+	}
+	id, err := peer.IDFromPrivateKey(next)
+	if err != nil {
+		return nil, err
+	}
+	r := &Rotation{OldKey: oldKey, New: id, Time: time.Now()}
+	if r.Sig, err = old.Sign(r.payload()); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Verify checks the signature, and returns the old peer ID.
+func (r *Rotation) Verify() (peer.ID, error) {
+	pub, err := crypto.UnmarshalPublicKey(r.OldKey)
+	if err != nil {
+		return "", xerrors.Errorf("rotation key: %w", err)
+	}
+	old, err := peer.IDFromPublicKey(pub)
+	if err != nil {
+		return "", err
+	}
+	if ok, err := pub.Verify(r.payload(), r.Sig); err != nil || !ok {
+		return "", xerrors.Errorf("rotation from %s: bad signature", old)
+	}
+	return old, nil
+}
+
+// Chain is the rotations of one device, oldest first.
+type Chain []*Rotation
+
+// Verify checks every rotation and that each leads to the next, the last
+// one to announcer. It returns the former peer IDs of announcer.
+func (c Chain) Verify(announcer peer.ID) ([]peer.ID, error) {
+	olds := make([]peer.ID, 0, len(c))
+	for i, r := range c {
+		old, err := r.Verify()
+		if err != nil {
+			return nil, err
+		}
+		if i > 0 && c[i-1].New != old {
+			return nil, xerrors.Errorf("rotation from %s: chain broken", old)
+		}
+		olds = append(olds, old)
+	}
+	if len(c) > 0 && c[len(c)-1].New != announcer {
+		return nil, xerrors.Errorf("rotation to %s announced by %s", c[len(c)-1].New, announcer)
+	}
+	return olds, nil
+}
+
+func (c Chain) Marshal() ([]byte, error) {
+	buf := bytes.NewBuffer(nil)
+	if err := gob.NewEncoder(buf).Encode(c); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (c *Chain) Unmarshal(data []byte) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(c)
+}
+
+// RotationsPath is where the rotations of the key file name are kept.
+func RotationsPath(name string) string {
+	return name + ".rotations"
+}
+
+// ReadRotations is the chain of the key file name still announced.
+func ReadRotations(name string) (Chain, error) {
+	data, err := os.ReadFile(RotationsPath(name))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	c := Chain{}
+	if err := c.Unmarshal(data); err != nil {
+		return nil, xerrors.Errorf("%s: %w", RotationsPath(name), err)
+	}
+
+	live := c[:0]
+	for _, r := range c {
+		if time.Since(r.Time) < RotationTTL {
+			live = append(live, r)
+		}
+	}
+	return live, nil
+}
+
+// AddRotation keeps r with the rotations of the key file name. Earlier
+// ones stay, so peers that missed one still learn the newest peer ID.
+func AddRotation(name string, r *Rotation) error {
+	c, err := ReadRotations(name)
+	if err != nil {
+		return err
+	}
+	data, err := append(c, r).Marshal()
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(RotationsPath(name), data, 0600)
+}
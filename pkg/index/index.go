@@ -0,0 +1,349 @@
+package index
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"golang.org/x/xerrors"
+
+	"github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+	"github.com/libp2p/go-libp2p/core/peer"
+
+	"github.com/threecorp/peerdrive/pkg/dev"
+)
+
+const (
+	IndexName = "index"
+)
+
+var (
+	IndexKey = datastore.NewKey(IndexName)
+)
+
+// Entry is what this node last knew about a file in the sync folder.
+type Entry struct {
+	Path    string
+	Size    int64
+	MTime   time.Time
+	Inode   uint64
+	Hash    string
+	Block   int64  // block size of a relay's blob, zero is dev.BlockSize
+	Sealed  string // hash of the content sealed with the folder password
+	Version Vector
+	Deleted bool // tombstone, the file was removed
+	Synced  bool // false until the state is published to or received from peers
+	Local   bool // changed locally in a receive-only folder, kept out of the version
+}
+
+func (e *Entry) copy() *Entry {
+	c := *e
+	c.Version = e.Version.Copy()
+	return &c
+}
+
+func (e *Entry) sameStat(fi os.FileInfo) bool {
+	return !e.Deleted &&
+		e.Size == fi.Size() &&
+		e.MTime.Equal(fi.ModTime()) &&
+		e.Inode == dev.FileInode(fi)
+}
+
+// Index is the local record of the sync folder, persisted in the node's
+// datastore so that restarts know what was synced before.
+type Index struct {
+	mu      sync.Mutex
+	ds      datastore.Batching
+	key     datastore.Key
+	self    peer.ID
+	opts    Options
+	entries map[string]*Entry
+}
+
+type Options struct {
+	Ignore      dev.Ignore // neither indexed nor taken for removed
+	ReceiveOnly bool       // local changes are marked Local instead of versioned
+}
+
+// Open loads the index kept under key, like IndexKey.ChildString(folder).
+func Open(ctx context.Context, ds datastore.Batching, key datastore.Key, self peer.ID, opts Options) (*Index, error) {
+	ix := &Index{ds: ds, key: key, self: self, opts: opts, entries: map[string]*Entry{}}
+
+	rs, err := ds.Query(ctx, query.Query{Prefix: key.String()})
+	if err != nil {
+		return nil, xerrors.Errorf("index query: %w", err)
+	}
+	defer rs.Close()
+
+	for r := range rs.Next() {
+		if r.Error != nil {
+			return nil, xerrors.Errorf("index load: %w", r.Error)
+		}
+		e := &Entry{}
+		if err := gob.NewDecoder(bytes.NewReader(r.Value)).Decode(e); err != nil {
+			return nil, xerrors.Errorf("index decode %s: %w", r.Key, err)
+		}
+		ix.entries[e.Path] = e
+	}
+
+	return ix, nil
+}
+
+func (ix *Index) Get(path string) (*Entry, bool) {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+
+	e, ok := ix.entries[path]
+	if !ok {
+		return nil, false
+	}
+	return e.copy(), true
+}
+
+func (ix *Index) Entries() []*Entry {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+
+	es := make([]*Entry, 0, len(ix.entries))
+	for _, e := range ix.entries {
+		es = append(es, e.copy())
+	}
+	return es
+}
+
+// Reconcile brings the index up to date with the files in dir. Only files
+// whose size, mtime or inode moved since the last scan are rehashed, and
+// every real change bumps this node's counter in the version vector. The
+// scan runs unlocked: files that moved again meanwhile are left to the next
+// one, entries recorded meanwhile win.
+func (ix *Index) Reconcile(ctx context.Context, dir string) ([]*Entry, error) {
+	type scan struct {
+		next *Entry // Path, stat and Hash
+		info os.FileInfo
+	}
+	scanned := []scan{}
+	seen := map[string]bool{}
+
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if os.IsNotExist(err) {
+			return nil // removed while walking
+		}
+		if err != nil {
+			return err
+		}
+		relPath := dev.RelativePath(dir, path)
+		if path != dir && ix.opts.Ignore.Match(relPath) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if info.IsDir() {
+			return nil
+		}
+		seen[relPath] = true
+
+		if e, ok := ix.Get(relPath); ok && e.sameStat(info) {
+			return nil
+		}
+		hash, err := dev.FileHash(path)
+		if os.IsNotExist(err) {
+			delete(seen, relPath)
+			return nil
+		}
+		if err != nil {
+			return xerrors.Errorf("hash %s: %w", relPath, err)
+		}
+		next := &Entry{
+			Path:  relPath,
+			Size:  info.Size(),
+			MTime: info.ModTime(),
+			Inode: dev.FileInode(info),
+			Hash:  hash,
+		}
+		scanned = append(scanned, scan{next, info})
+		return nil
+	})
+	if err != nil {
+		return nil, xerrors.Errorf("Reconcile(%s): %w", dir, err)
+	}
+
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+
+	changes := []*Entry{}
+	for _, sc := range scanned {
+		next := sc.next
+		e, ok := ix.entries[next.Path]
+		if ok && e.sameStat(sc.info) {
+			continue // recorded meanwhile
+		}
+		if fi, err := os.Lstat(filepath.Join(dir, next.Path)); err != nil || !next.sameStat(fi) {
+			continue // moved since it was hashed
+		}
+		switch {
+		case !ok && ix.opts.ReceiveOnly:
+			next.Version, next.Local = Vector{}, true
+		case !ok:
+			next.Version = Vector{}.Bump(ix.self)
+		case (e.Deleted || e.Hash != next.Hash) && ix.opts.ReceiveOnly:
+			next.Version, next.Local = e.Version, true
+		case e.Deleted || e.Hash != next.Hash:
+			next.Version = e.Version.Bump(ix.self)
+		default: // touched, same content
+			next.Version = e.Version
+			next.Synced = e.Synced
+			next.Local = e.Local
+			next.Sealed = e.Sealed
+		}
+		changes = append(changes, next)
+	}
+
+	for path, e := range ix.entries {
+		if e.Deleted || seen[path] || ix.opts.Ignore.Match(path) {
+			continue
+		}
+		if _, err := os.Lstat(filepath.Join(dir, path)); !os.IsNotExist(err) {
+			continue // written meanwhile
+		}
+		tomb := &Entry{Path: path, Hash: e.Hash, Deleted: true}
+		if ix.opts.ReceiveOnly {
+			tomb.Version, tomb.Local = e.Version, true
+		} else {
+			tomb.Version = e.Version.Bump(ix.self)
+		}
+		changes = append(changes, tomb)
+	}
+
+	if err := ix.put(ctx, changes...); err != nil {
+		return nil, err
+	}
+	return changes, nil
+}
+
+// Stale tells whether the file path in dir changed since it was indexed, a
+// local edit the next Reconcile picks up. A missing file is not stale.
+func (ix *Index) Stale(dir, path string) bool {
+	fi, err := os.Lstat(filepath.Join(dir, path))
+	if err != nil {
+		return false
+	}
+
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+
+	e, ok := ix.entries[path]
+	return !ok || !e.sameStat(fi)
+}
+
+// Applied records a file that was written or removed on behalf of a peer,
+// e carries the remote hash and version of the file. Merged with a version
+// concurrent to e, the entry is left to publish.
+func (ix *Index) Applied(ctx context.Context, dir string, e *Entry) error {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+
+	next := &Entry{
+		Path:    e.Path,
+		Hash:    e.Hash,
+		Sealed:  e.Sealed,
+		Version: e.Version.Copy(),
+		Deleted: e.Deleted,
+	}
+	if prev, ok := ix.entries[e.Path]; ok {
+		next.Version = prev.Version.Merge(e.Version)
+	}
+	next.Synced = next.Version.Compare(e.Version) == Equal
+	if !e.Deleted {
+		fi, err := os.Stat(filepath.Join(dir, e.Path))
+		if err != nil {
+			return xerrors.Errorf("Applied(%s): %w", e.Path, err)
+		}
+		next.Size = fi.Size()
+		next.MTime = fi.ModTime()
+		next.Inode = dev.FileInode(fi)
+	}
+
+	return ix.put(ctx, next)
+}
+
+// Stored records a file a relay keeps outside of the folder tree, e carries
+// the remote state of the file. The entry is published again as the relay's.
+func (ix *Index) Stored(ctx context.Context, e *Entry) error {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+
+	next := e.copy()
+	next.Synced, next.Local = false, false
+	if prev, ok := ix.entries[e.Path]; ok {
+		next.Version = prev.Version.Merge(e.Version)
+	}
+	return ix.put(ctx, next)
+}
+
+// Seal records the hash of the encrypted content of path, unless the file
+// changed from hash meanwhile.
+func (ix *Index) Seal(ctx context.Context, path, hash, sealed string) error {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+
+	cur, ok := ix.entries[path]
+	if !ok || cur.Deleted || cur.Hash != hash {
+		return nil
+	}
+	next := cur.copy()
+	next.Sealed = sealed
+	return ix.put(ctx, next)
+}
+
+// Published marks entries as synced, unless they changed again meanwhile.
+func (ix *Index) Published(ctx context.Context, es []*Entry) error {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+
+	marks := []*Entry{}
+	for _, e := range es {
+		cur, ok := ix.entries[e.Path]
+		if !ok || cur.Synced || cur.Version.Compare(e.Version) != Equal {
+			continue
+		}
+		next := cur.copy()
+		next.Synced = true
+		marks = append(marks, next)
+	}
+
+	return ix.put(ctx, marks...)
+}
+
+func (ix *Index) put(ctx context.Context, es ...*Entry) error {
+	if len(es) == 0 {
+		return nil
+	}
+
+	batch, err := ix.ds.Batch(ctx)
+	if err != nil {
+		return xerrors.Errorf("index batch: %w", err)
+	}
+	for _, e := range es {
+		buf := bytes.NewBuffer(nil)
+		if err := gob.NewEncoder(buf).Encode(e); err != nil {
+			return xerrors.Errorf("index encode %s: %w", e.Path, err)
+		}
+		if err := batch.Put(ctx, ix.key.Child(datastore.NewKey(e.Path)), buf.Bytes()); err != nil {
+			return xerrors.Errorf("index put %s: %w", e.Path, err)
+		}
+	}
+	if err := batch.Commit(ctx); err != nil {
+		return xerrors.Errorf("index commit: %w", err)
+	}
+
+	for _, e := range es {
+		ix.entries[e.Path] = e
+	}
+	return nil
+}
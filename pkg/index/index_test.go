@@ -0,0 +1,142 @@
+package index
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	"github.com/libp2p/go-libp2p/core/test"
+
+	"github.com/threecorp/peerdrive/pkg/dev"
+)
+
+// self is the node of the index, a real ID since gob decodes it as one.
+var self, _ = test.RandPeerID()
+
+func write(t *testing.T, dir, path, data string) {
+	t.Helper()
+	name := filepath.Join(dir, path)
+	if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(name, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// change is what Reconcile reports of a path.
+type change struct {
+	Version Vector
+	Deleted bool
+	Local   bool
+}
+
+func TestReconcile(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		opts Options
+		then func(t *testing.T, dir string) // between the first scan and the second
+		want map[string]change              // of the second scan
+	}{
+		{
+			name: "unchanged",
+			then: func(t *testing.T, dir string) {},
+			want: map[string]change{},
+		},
+		{
+			name: "added",
+			then: func(t *testing.T, dir string) { write(t, dir, "b.txt", "beta") },
+			want: map[string]change{"b.txt": {Version: Vector{self: 1}}},
+		},
+		{
+			name: "edited",
+			then: func(t *testing.T, dir string) { write(t, dir, "a.txt", "edited") },
+			want: map[string]change{"a.txt": {Version: Vector{self: 2}}},
+		},
+		{
+			name: "touched",
+			then: func(t *testing.T, dir string) {
+				mtime := time.Now().Add(time.Hour)
+				if err := os.Chtimes(filepath.Join(dir, "a.txt"), mtime, mtime); err != nil {
+					t.Fatal(err)
+				}
+			},
+			want: map[string]change{"a.txt": {Version: Vector{self: 1}}},
+		},
+		{
+			name: "removed",
+			then: func(t *testing.T, dir string) { os.Remove(filepath.Join(dir, "a.txt")) },
+			want: map[string]change{"a.txt": {Version: Vector{self: 2}, Deleted: true}},
+		},
+		{
+			name: "ignored",
+			opts: Options{Ignore: dev.Ignore{"*.tmp"}},
+			then: func(t *testing.T, dir string) { write(t, dir, "sub/b.tmp", "tmp") },
+			want: map[string]change{},
+		},
+		{
+			name: "receive-only edit",
+			opts: Options{ReceiveOnly: true},
+			then: func(t *testing.T, dir string) { write(t, dir, "a.txt", "edited") },
+			want: map[string]change{"a.txt": {Version: Vector{}, Local: true}},
+		},
+		{
+			name: "receive-only removal",
+			opts: Options{ReceiveOnly: true},
+			then: func(t *testing.T, dir string) { os.Remove(filepath.Join(dir, "a.txt")) },
+			want: map[string]change{"a.txt": {Version: Vector{}, Deleted: true, Local: true}},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			dir := t.TempDir()
+			ds := dssync.MutexWrap(datastore.NewMapDatastore())
+			ix, err := Open(ctx, ds, IndexKey, self, tt.opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !tt.opts.ReceiveOnly {
+				write(t, dir, "a.txt", "alpha")
+			} else if err := ix.Applied(ctx, dir, applied(t, dir, "a.txt", "alpha")); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := ix.Reconcile(ctx, dir); err != nil {
+				t.Fatal(err)
+			}
+			tt.then(t, dir)
+			changes, err := ix.Reconcile(ctx, dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got := map[string]change{}
+			for _, e := range changes {
+				got[e.Path] = change{Version: e.Version, Deleted: e.Deleted, Local: e.Local}
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("changes %v, want %v", got, tt.want)
+			}
+
+			// a restart knows what was scanned
+			reopened, err := Open(ctx, ds, IndexKey, self, tt.opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if changes, err := reopened.Reconcile(ctx, dir); err != nil || len(changes) != 0 {
+				t.Errorf("reopened changes %v, error %v", changes, err)
+			}
+		})
+	}
+}
+
+// applied writes path like a peer's file applied to dir, unversioned here.
+func applied(t *testing.T, dir, path, data string) *Entry {
+	write(t, dir, path, data)
+	return &Entry{Path: path, Hash: dev.BytesHash([]byte(data)), Version: Vector{}}
+}
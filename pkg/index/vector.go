@@ -0,0 +1,67 @@
+package index
+
+import "github.com/libp2p/go-libp2p/core/peer"
+
+type Order int
+
+const (
+	Equal Order = iota
+	Before
+	After
+	Concurrent
+)
+
+// Vector is a version vector, a change counter per peer that edited a file.
+type Vector map[peer.ID]uint64
+
+func (v Vector) Copy() Vector {
+	c := Vector{}
+	for id, n := range v {
+		c[id] = n
+	}
+	return c
+}
+
+func (v Vector) Bump(id peer.ID) Vector {
+	c := v.Copy()
+	c[id]++
+	return c
+}
+
+func (v Vector) Merge(o Vector) Vector {
+	c := v.Copy()
+	for id, n := range o {
+		if n > c[id] {
+			c[id] = n
+		}
+	}
+	return c
+}
+
+// Compare tells whether v happened Before, After or Concurrent to o.
+func (v Vector) Compare(o Vector) Order {
+	less, greater := false, false
+	for id, n := range v {
+		if n > o[id] {
+			greater = true
+		} else if n < o[id] {
+			less = true
+		}
+	}
+	for id, n := range o {
+		if _, ok := v[id]; !ok && n > 0 {
+			less = true
+		}
+	}
+
+	switch {
+	case less && greater:
+		return Concurrent
+	case less:
+		return Before
+	case greater:
+		return After
+	default:
+		return Equal
+	}
+}
@@ -0,0 +1,72 @@
+package index
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestVectorCompare(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		v, o Vector
+		want Order
+	}{
+		{"empty", Vector{}, Vector{}, Equal},
+		{"nil", nil, Vector{}, Equal},
+		{"zero counter", Vector{"a": 0}, Vector{}, Equal},
+		{"same", Vector{"a": 1, "b": 2}, Vector{"a": 1, "b": 2}, Equal},
+		{"behind", Vector{"a": 1}, Vector{"a": 2}, Before},
+		{"ahead", Vector{"a": 2}, Vector{"a": 1}, After},
+		{"missing peer", Vector{"a": 1}, Vector{"a": 1, "b": 1}, Before},
+		{"extra peer", Vector{"a": 1, "b": 1}, Vector{"a": 1}, After},
+		{"concurrent", Vector{"a": 2, "b": 1}, Vector{"a": 1, "b": 2}, Concurrent},
+		{"disjoint", Vector{"a": 1}, Vector{"b": 1}, Concurrent},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.v.Compare(tt.o); got != tt.want {
+				t.Errorf("Compare %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestVectorMerge(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		v, o Vector
+		want Vector
+	}{
+		{"empty", Vector{}, Vector{}, Vector{}},
+		{"into empty", Vector{}, Vector{"a": 1}, Vector{"a": 1}},
+		{"greatest", Vector{"a": 3, "b": 1}, Vector{"a": 1, "b": 2}, Vector{"a": 3, "b": 2}},
+		{"union", Vector{"a": 1}, Vector{"b": 1}, Vector{"a": 1, "b": 1}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			v := tt.v.Copy()
+			got := tt.v.Merge(tt.o)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Merge %v, want %v", got, tt.want)
+			}
+			if !reflect.DeepEqual(tt.v, v) {
+				t.Errorf("Merge changed its receiver to %v", tt.v)
+			}
+			if got.Compare(tt.v) == Before || got.Compare(tt.o) == Before {
+				t.Errorf("Merge %v before one of its sides", got)
+			}
+		})
+	}
+}
+
+func TestVectorBump(t *testing.T) {
+	v := Vector{"a": 1}
+	got := v.Bump("a").Bump("b")
+	if want := (Vector{"a": 2, "b": 1}); !reflect.DeepEqual(got, want) {
+		t.Errorf("Bump %v, want %v", got, want)
+	}
+	if v["a"] != 1 {
+		t.Errorf("Bump changed its receiver to %v", v)
+	}
+	if got.Compare(v) != After {
+		t.Errorf("bumped %v not after %v", got, v)
+	}
+}
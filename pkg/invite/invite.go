@@ -0,0 +1,225 @@
+package invite
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/gob"
+	"encoding/hex"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/multiformats/go-multiaddr"
+	"golang.org/x/xerrors"
+
+	"github.com/threecorp/peerdrive/pkg/dev"
+	"github.com/threecorp/peerdrive/pkg/p2p"
+)
+
+// Protocol is the handshake of a device joining a folder with a token.
+const Protocol = "/peerdrive/invite/1.0.0"
+
+// DefaultTTL is how long a token stays valid.
+const DefaultTTL = 15 * time.Minute
+
+// tokenPrefix tells tokens apart from rendezvous strings.
+const tokenPrefix = "pdinvite:"
+
+// Token is what an invited device needs to reach the inviter and prove it
+// was invited. It is good for one join before it expires.
+type Token struct {
+	Group   string // folder's group ID
+	Peer    peer.ID
+	Addrs   []string
+	Secret  []byte
+	Expires time.Time
+}
+
+func (t *Token) String() string {
+	buf := bytes.NewBuffer(nil)
+	gob.NewEncoder(buf).Encode(t)
+	return tokenPrefix + base64.RawURLEncoding.EncodeToString(buf.Bytes())
+}
+
+func Parse(s string) (*Token, error) {
+	s = strings.TrimSpace(s)
+	if !strings.HasPrefix(s, tokenPrefix) {
+		return nil, xerrors.New("not an invite token")
+	}
+	data, err := base64.RawURLEncoding.DecodeString(strings.TrimPrefix(s, tokenPrefix))
+	if err != nil {
+		return nil, xerrors.Errorf("invite token: %w", err)
+	}
+	t := &Token{}
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(t); err != nil {
+		return nil, xerrors.Errorf("invite token: %w", err)
+	}
+	if time.Now().After(t.Expires) {
+		return nil, xerrors.Errorf("invite token expired at %s", t.Expires.Format(time.RFC3339))
+	}
+	return t, nil
+}
+
+// Offer is the folder handed over to an invited device, the path and the
+// mode are the device's own choice.
+type Offer struct {
+	Rendezvous string
+	Ignore     dev.Ignore
+	Password   string
+	Trust      []*p2p.TrustEntry
+}
+
+type request struct {
+	Group  string
+	Secret []byte
+}
+
+type response struct {
+	Error string
+	Offer *Offer
+}
+
+type pending struct {
+	group   *p2p.Group
+	offer   Offer
+	expires time.Time
+}
+
+// Server hands out tokens and answers the devices that join with them.
+type Server struct {
+	host host.Host
+
+	mu      sync.Mutex
+	pending map[string]*pending // by secret hash
+}
+
+func NewServer(h host.Host) *Server {
+	s := &Server{host: h, pending: map[string]*pending{}}
+	h.SetStreamHandler(Protocol, s.handle)
+	return s
+}
+
+func (s *Server) Close() {
+	s.host.RemoveStreamHandler(Protocol)
+}
+
+func secretKey(secret []byte) string {
+	sum := sha256.Sum256(secret)
+	return hex.EncodeToString(sum[:])
+}
+
+// Invite makes a token for g, the device that joins with it gets offer
+// and is trusted by the group.
+func (s *Server) Invite(g *p2p.Group, offer Offer, ttl time.Duration) (*Token, error) {
+	if ttl <= 0 {
+		ttl = DefaultTTL
+	}
+	secret := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, secret); err != nil {
+		return nil, err
+	}
+
+	t := &Token{Group: g.ID, Peer: s.host.ID(), Secret: secret, Expires: time.Now().Add(ttl)}
+	for _, ma := range s.host.Addrs() {
+		t.Addrs = append(t.Addrs, ma.String())
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	for k, p := range s.pending {
+		if now.After(p.expires) {
+			delete(s.pending, k)
+		}
+	}
+	s.pending[secretKey(secret)] = &pending{group: g, offer: offer, expires: t.Expires}
+	return t, nil
+}
+
+// take redeems secret once.
+func (s *Server) take(group string, secret []byte) (*pending, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	k := secretKey(secret)
+	p, ok := s.pending[k]
+	if !ok || subtle.ConstantTimeCompare([]byte(p.group.ID), []byte(group)) != 1 {
+		return nil, false
+	}
+	delete(s.pending, k)
+	return p, time.Now().Before(p.expires)
+}
+
+func (s *Server) handle(stream network.Stream) {
+	defer stream.Close()
+	stream.SetDeadline(time.Now().Add(time.Minute))
+	from := stream.Conn().RemotePeer()
+
+	req := &request{}
+	if err := gob.NewDecoder(stream).Decode(req); err != nil {
+		stream.Reset()
+		return
+	}
+	p, ok := s.take(req.Group, req.Secret)
+	if !ok {
+		gob.NewEncoder(stream).Encode(&response{Error: "invalid or used token"})
+		return
+	}
+
+	addrs := []string{stream.Conn().RemoteMultiaddr().String()}
+	entry := &p2p.TrustEntry{Peer: from, Addrs: addrs, By: s.host.ID(), Added: time.Now()}
+	if err := p.group.Vouch(context.Background(), entry); err != nil {
+		gob.NewEncoder(stream).Encode(&response{Error: err.Error()})
+		return
+	}
+	offer := p.offer
+	offer.Trust = p.group.Trust.Entries()
+	gob.NewEncoder(stream).Encode(&response{Offer: &offer})
+}
+
+// Join dials the inviter of t from h and redeems the token. The secure
+// channel proves the inviter is the peer of t, the secret proves h was
+// invited.
+func Join(ctx context.Context, h host.Host, t *Token) (*Offer, error) {
+	info := peer.AddrInfo{ID: t.Peer}
+	for _, s := range t.Addrs {
+		if ma, err := multiaddr.NewMultiaddr(s); err == nil {
+			info.Addrs = append(info.Addrs, ma)
+		}
+	}
+	if err := h.Connect(ctx, info); err != nil {
+		return nil, xerrors.Errorf("dial inviter %s: %w", t.Peer, err)
+	}
+	stream, err := h.NewStream(ctx, t.Peer, Protocol)
+	if err != nil {
+		return nil, xerrors.Errorf("invite stream: %w", err)
+	}
+	defer stream.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		stream.SetDeadline(deadline)
+	}
+
+	if err := gob.NewEncoder(stream).Encode(&request{Group: t.Group, Secret: t.Secret}); err != nil {
+		return nil, xerrors.Errorf("invite request: %w", err)
+	}
+	resp := &response{}
+	if err := gob.NewDecoder(stream).Decode(resp); err != nil {
+		return nil, xerrors.Errorf("invite response: %w", err)
+	}
+	if resp.Error != "" {
+		return nil, xerrors.Errorf("inviter refused: %s", resp.Error)
+	}
+	if resp.Offer == nil || p2p.GroupID(resp.Offer.Rendezvous) != t.Group {
+		return nil, xerrors.New("inviter offered another folder")
+	}
+	return resp.Offer, nil
+}
@@ -0,0 +1,120 @@
+package logging
+
+import (
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	golog "github.com/ipfs/go-log/v2"
+	"github.com/mattn/go-isatty"
+	"go.uber.org/zap"
+	"golang.org/x/xerrors"
+)
+
+// Format is how log lines are written to stderr.
+type Format string
+
+const (
+	Text Format = "text" // colored levels on a terminal
+	JSON Format = "json" // one object per line
+)
+
+func ParseFormat(s string) (Format, error) {
+	switch f := Format(strings.ToLower(s)); f {
+	case Text, JSON:
+		return f, nil
+	case "":
+		return Text, nil
+	default:
+		return "", xerrors.Errorf("unknown log format %q, want %s or %s", s, Text, JSON)
+	}
+}
+
+// Options are the log settings of the daemon.
+type Options struct {
+	Level  string            // of the peerdrive subsystems
+	Format Format            // of stderr
+	Levels map[string]string // by subsystem, libp2p ones like dht included
+}
+
+func DefaultOptions() Options {
+	return Options{Level: "info", Format: Text}
+}
+
+var (
+	mu         sync.Mutex
+	subsystems = map[string]bool{}
+)
+
+// Logger is the logger of a peerdrive subsystem, like snap or p2p. It
+// follows Setup, even when taken before.
+func Logger(name string) *zap.SugaredLogger {
+	mu.Lock()
+	subsystems[name] = true
+	mu.Unlock()
+
+	return &golog.Logger(name).SugaredLogger
+}
+
+// Subsystems names the peerdrive subsystems.
+func Subsystems() []string {
+	mu.Lock()
+	defer mu.Unlock()
+
+	names := make([]string, 0, len(subsystems))
+	for name := range subsystems {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (o Options) Validate() error {
+	if _, err := ParseFormat(string(o.Format)); err != nil {
+		return err
+	}
+	if o.Level != "" {
+		if _, err := golog.LevelFromString(o.Level); err != nil {
+			return xerrors.Errorf("log level: %w", err)
+		}
+	}
+	for name, s := range o.Levels {
+		if _, err := golog.LevelFromString(s); err != nil {
+			return xerrors.Errorf("log level of %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// Setup applies opts to every logger. The libp2p subsystems stay at error
+// unless Levels says otherwise.
+func Setup(opts Options) error {
+	if err := opts.Validate(); err != nil {
+		return err
+	}
+	if opts.Level == "" {
+		opts.Level = DefaultOptions().Level
+	}
+	level, _ := golog.LevelFromString(opts.Level)
+
+	cfg := golog.Config{
+		Format:          golog.PlaintextOutput,
+		Level:           golog.LevelError,
+		SubsystemLevels: map[string]golog.LogLevel{},
+		Stderr:          true,
+	}
+	if opts.Format == JSON {
+		cfg.Format = golog.JSONOutput
+	} else if isatty.IsTerminal(os.Stderr.Fd()) {
+		cfg.Format = golog.ColorizedOutput
+	}
+	for _, name := range Subsystems() {
+		cfg.SubsystemLevels[name] = level
+	}
+	for name, s := range opts.Levels {
+		cfg.SubsystemLevels[name], _ = golog.LevelFromString(s)
+	}
+	golog.SetupLogging(cfg)
+	return nil
+}
@@ -0,0 +1,200 @@
+package metrics
+
+import (
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"golang.org/x/xerrors"
+
+	"github.com/threecorp/peerdrive/pkg/clock"
+)
+
+// DefaultAddr is where the daemon serves /metrics.
+const DefaultAddr = "127.0.0.1:6870"
+
+const namespace = "peerdrive"
+
+// Registry holds every peerdrive metric, apart from the global registry
+// of the prometheus package.
+var Registry = prometheus.NewRegistry()
+
+var (
+	SentBytes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace, Name: "sent_bytes_total", Help: "Bytes sent to peers on snap streams.",
+	}, []string{"peer"})
+	ReceivedBytes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace, Name: "received_bytes_total", Help: "Bytes received from peers on snap streams.",
+	}, []string{"peer"})
+	SentFiles = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace, Name: "sent_files_total", Help: "Files peers started to fetch from this node.",
+	}, []string{"peer"})
+	ReceivedFiles = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace, Name: "received_files_total", Help: "Files fetched from peers.",
+	}, []string{"peer"})
+
+	ScanSeconds = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace, Name: "scan_duration_seconds", Help: "Time taken to reconcile a folder with its index.",
+		Buckets: prometheus.ExponentialBuckets(0.001, 4, 10),
+	}, []string{"folder"})
+	WatcherEvents = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace, Name: "watcher_events_total", Help: "File system events seen by the watchers.",
+	}, []string{"folder", "op"})
+	Errors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace, Name: "errors_total", Help: "Folder errors by the operation that failed.",
+	}, []string{"folder", "op"})
+	DroppedSnapshots = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace, Name: "dropped_snapshots_total", Help: "Snapshots dropped as unsigned, forged or replayed.",
+	}, []string{"folder", "reason"})
+
+	Peers = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: namespace, Name: "connected_peers", Help: "Peers the nodes of the process are connected to.",
+	}, nodes.connected)
+	PingSeconds = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace, Name: "ping_duration_seconds", Help: "Round trip of the pings of peers.",
+		Buckets: prometheus.ExponentialBuckets(0.001, 4, 8),
+	}, []string{"peer"})
+	CRDTPutSeconds = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace, Name: "crdt_put_duration_seconds", Help: "Time taken to put a snapshot in the CRDT.",
+		Buckets: prometheus.ExponentialBuckets(0.001, 4, 10),
+	}, []string{"group"})
+	CRDTSyncSeconds = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace, Name: "crdt_sync_duration_seconds", Help: "Time taken to sync the CRDT with new peers.",
+		Buckets: prometheus.ExponentialBuckets(0.001, 4, 10),
+	}, []string{"group"})
+)
+
+func init() {
+	Registry.MustRegister(
+		SentBytes, ReceivedBytes, SentFiles, ReceivedFiles,
+		ScanSeconds, WatcherEvents, Errors, DroppedSnapshots,
+		Peers, PingSeconds, CRDTPutSeconds, CRDTSyncSeconds,
+		folders,
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+}
+
+// Since observes the seconds elapsed on c since start.
+func Since(o prometheus.Observer, c clock.Clock, start time.Time) {
+	o.Observe(clock.Since(c, start).Seconds())
+}
+
+// FolderStats are the gauges of a folder, read when scraped.
+type FolderStats struct {
+	Queue     int // transfers waiting or running
+	OutOfSync int // files not published yet or waiting for a transfer
+	Heads     int // CRDT heads
+}
+
+var (
+	queueDesc = prometheus.NewDesc(namespace+"_transfer_queue", "Transfers waiting or running.", []string{"folder"}, nil)
+	syncDesc  = prometheus.NewDesc(namespace+"_out_of_sync_files", "Files not published yet or waiting for a transfer.", []string{"folder"}, nil)
+	headsDesc = prometheus.NewDesc(namespace+"_crdt_heads", "Heads of the folder's CRDT.", []string{"folder"}, nil)
+)
+
+type folderCollector struct {
+	mu    sync.Mutex
+	stats map[string]func() FolderStats
+}
+
+var folders = &folderCollector{stats: map[string]func() FolderStats{}}
+
+// WatchFolder reports the stats of folder until the returned func is
+// called.
+func WatchFolder(folder string, stats func() FolderStats) func() {
+	folders.mu.Lock()
+	defer folders.mu.Unlock()
+
+	folders.stats[folder] = stats
+	return func() {
+		folders.mu.Lock()
+		defer folders.mu.Unlock()
+
+		delete(folders.stats, folder)
+	}
+}
+
+func (c *folderCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- queueDesc
+	ch <- syncDesc
+	ch <- headsDesc
+}
+
+func (c *folderCollector) Collect(ch chan<- prometheus.Metric) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for folder, stats := range c.stats {
+		st := stats()
+		ch <- prometheus.MustNewConstMetric(queueDesc, prometheus.GaugeValue, float64(st.Queue), folder)
+		ch <- prometheus.MustNewConstMetric(syncDesc, prometheus.GaugeValue, float64(st.OutOfSync), folder)
+		ch <- prometheus.MustNewConstMetric(headsDesc, prometheus.GaugeValue, float64(st.Heads), folder)
+	}
+}
+
+type nodeCounts struct {
+	mu     sync.Mutex
+	next   int
+	counts map[int]func() int
+}
+
+var nodes = &nodeCounts{counts: map[int]func() int{}}
+
+// WatchNode adds the peers a node is connected to, as told by connected,
+// to the connected_peers of the process until the returned func is called.
+func WatchNode(connected func() int) func() {
+	nodes.mu.Lock()
+	defer nodes.mu.Unlock()
+
+	id := nodes.next
+	nodes.next++
+	nodes.counts[id] = connected
+	return func() {
+		nodes.mu.Lock()
+		defer nodes.mu.Unlock()
+
+		delete(nodes.counts, id)
+	}
+}
+
+func (c *nodeCounts) connected() float64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	n := 0
+	for _, connected := range c.counts {
+		n += connected()
+	}
+	return float64(n)
+}
+
+// Server serves /metrics for Prometheus to scrape.
+type Server struct {
+	srv *http.Server
+}
+
+func NewServer(addr string) *Server {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(Registry, promhttp.HandlerOpts{}))
+	return &Server{srv: &http.Server{Addr: addr, Handler: mux, ReadHeaderTimeout: 10 * time.Second}}
+}
+
+func (s *Server) ListenAndServe() error {
+	ln, err := net.Listen("tcp", s.srv.Addr)
+	if err != nil {
+		return xerrors.Errorf("metrics listen %s: %w", s.srv.Addr, err)
+	}
+	if err := s.srv.Serve(ln); err != nil && !xerrors.Is(err, http.ErrServerClosed) {
+		return xerrors.Errorf("metrics serve: %w", err)
+	}
+	return nil
+}
+
+func (s *Server) Close() error {
+	return s.srv.Close()
+}
@@ -0,0 +1,218 @@
+package p2p
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"sync"
+	"sync/atomic"
+
+	"github.com/ipfs/go-datastore"
+	crdt "github.com/ipfs/go-ds-crdt"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/p2p/discovery/util"
+	"github.com/samber/lo"
+
+	"github.com/threecorp/peerdrive/pkg/metrics"
+)
+
+// Group is the peers sharing one rendezvous, a folder, and their CRDT store.
+type Group struct {
+	ID         string
+	Host       host.Host
+	DS         *crdt.Datastore // datastore.Batching
+	DSPutCh    chan lo.Tuple2[datastore.Key, []byte]
+	DSDelCh    chan datastore.Key
+	Rendezvous string
+	Trust      *Trust
+	Store      datastore.Batching // local only, the node's
+
+	nd *Node
+
+	putMu   sync.Mutex
+	puts    map[datastore.Key][]byte // not delivered to DSPutCh yet
+	putKeys []datastore.Key          // of puts, in order
+	putCh   chan struct{}
+	refused atomic.Int64 // trust announces
+}
+
+// GroupID names a rendezvous in keys and protocols without revealing it.
+func GroupID(rendezvous string) string {
+	sum := sha256.Sum256([]byte(rendezvous))
+	return hex.EncodeToString(sum[:8])
+}
+
+// Join starts discovering the peers of rendezvous and syncing their CRDT
+// store, until the node is closed.
+func (nd *Node) Join(rendezvous string) (*Group, error) {
+	ctx := nd.ctx
+
+	var bcast crdt.Broadcaster
+	bcast, err := crdt.NewPubSubBroadcaster(ctx, nd.PubSub, rendezvous)
+	if err != nil {
+		return nil, err
+	}
+	if nd.opts.Broadcast != nil {
+		bcast = nd.opts.Broadcast(bcast)
+	}
+
+	id := GroupID(rendezvous)
+	trust, err := openTrust(ctx, nd.Store, id)
+	if err != nil {
+		return nil, err
+	}
+
+	g := &Group{
+		ID:         id,
+		Host:       nd.Host,
+		DSPutCh:    make(chan lo.Tuple2[datastore.Key, []byte]),
+		DSDelCh:    make(chan datastore.Key),
+		Rendezvous: rendezvous,
+		Trust:      trust,
+		Store:      nd.Store,
+		nd:         nd,
+		puts:       map[datastore.Key][]byte{},
+		putCh:      make(chan struct{}, 1),
+	}
+
+	crdtOpts := crdt.DefaultOptions()
+	crdtOpts.RebroadcastInterval = nd.opts.RebroadcastInterval
+	crdtOpts.PutHook = func(k datastore.Key, v []byte) { g.dsPutNotify(k, v) }
+	crdtOpts.DeleteHook = func(k datastore.Key) { g.dsDeletedNotify(k) }
+	crdtDS, err := crdt.New(nd.Store, DSKey.ChildString(g.ID), nd.Lite, bcast, crdtOpts)
+	if err != nil {
+		return nil, err
+	}
+	g.DS = crdtDS
+
+	nd.mu.Lock()
+	nd.groups = append(nd.groups, g)
+	nd.mu.Unlock()
+
+	nd.Host.SetStreamHandler(g.trustProtocol(), g.handleTrust)
+	nd.Peers.OnJoin(func(group string, id peer.ID) {
+		if group == g.ID {
+			g.joined(id)
+		}
+	})
+	go g.run(ctx)
+	go g.deliverPuts(ctx)
+	if nd.opts.MDNS {
+		if err := g.discoverMDNS(ctx); err != nil {
+			nd.log.Warnw("MDNS", "group", g.ID, "error", err)
+		}
+	}
+	return g, nil
+}
+
+// Peers are the connected peers sharing the group.
+func (g *Group) Peers() []peer.ID {
+	return g.nd.Peers.Members(g.ID)
+}
+
+// Member tells whether id is a connected peer sharing the group.
+func (g *Group) Member(id peer.ID) bool {
+	return g.nd.Peers.Member(g.ID, id)
+}
+
+// dsPutNotify queues a put for DSPutCh. It runs under a lock of the CRDT,
+// so it never waits for the reader, who may be putting too. A key put again
+// before it is delivered is delivered once, with the last value.
+func (g *Group) dsPutNotify(k datastore.Key, v []byte) {
+	g.nd.log.Debugw("crdt put", "group", g.ID, "key", k, "bytes", len(v))
+	g.putMu.Lock()
+	if _, ok := g.puts[k]; !ok {
+		g.putKeys = append(g.putKeys, k)
+	}
+	g.puts[k] = v
+	g.putMu.Unlock()
+
+	select {
+	case g.putCh <- struct{}{}:
+	default:
+	}
+}
+
+// deliverPuts sends the queued puts to DSPutCh until ctx is done.
+func (g *Group) deliverPuts(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-g.putCh:
+		}
+		for {
+			g.putMu.Lock()
+			if len(g.putKeys) == 0 {
+				g.putMu.Unlock()
+				break
+			}
+			k := g.putKeys[0]
+			v := g.puts[k]
+			g.putKeys = g.putKeys[1:]
+			delete(g.puts, k)
+			g.putMu.Unlock()
+
+			select {
+			case g.DSPutCh <- lo.T2(k, v):
+			case <-ctx.Done():
+				return
+			}
+		}
+	}
+}
+
+func (g *Group) dsDeletedNotify(k datastore.Key) {
+	// g.DSDelCh <- k
+	g.nd.log.Infow("ignored remote delete", "group", g.ID, "key", k) // snapshots carry tombstones instead
+}
+
+func (g *Group) run(ctx context.Context) {
+	go g.announceTrust(ctx)
+
+	// re-advertises by itself until ctx is done
+	util.Advertise(ctx, g.nd.Discovery, g.Rendezvous)
+
+	ticker := g.nd.opts.Clock.NewTicker(g.nd.opts.DiscoveryInterval)
+	defer ticker.Stop()
+	unsynced := false
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C():
+		}
+
+		peerCh, err := g.nd.Discovery.FindPeers(ctx, g.Rendezvous)
+		if err != nil {
+			g.nd.log.Warnw("find peers", "group", g.ID, "error", err)
+			continue
+		}
+
+		for p := range peerCh {
+			if p.ID == g.Host.ID() || len(p.Addrs) == 0 {
+				continue
+			}
+			if err := g.Host.Connect(ctx, p); err != nil {
+				g.nd.log.Debugw("connect", "peer", p.ID, "error", err)
+				continue
+			}
+			if !g.nd.Peers.Join(g.ID, p.ID) {
+				continue
+			}
+			g.nd.log.Infow("connected peer by discovery", "group", g.ID, "peer", p.ID)
+			unsynced = true
+		}
+
+		if unsynced {
+			start := g.nd.opts.Clock.Now()
+			if err := g.DS.Sync(ctx, DSKey); err != nil {
+				g.nd.log.Warnw("CRDT sync, retrying", "group", g.ID, "error", err)
+				continue
+			}
+			metrics.Since(metrics.CRDTSyncSeconds.WithLabelValues(g.ID), g.nd.opts.Clock, start)
+			unsynced = false
+		}
+	}
+}
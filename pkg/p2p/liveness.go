@@ -0,0 +1,193 @@
+package p2p
+
+import (
+	"context"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/p2p/protocol/ping"
+	"github.com/multiformats/go-multiaddr"
+
+	"github.com/threecorp/peerdrive/pkg/metrics"
+	"github.com/threecorp/peerdrive/pkg/retry"
+)
+
+const (
+	pingTimeout  = 10 * time.Second
+	pingFailures = 3 // in a row disconnect a peer, to be redialed
+
+	redialCheck   = time.Second
+	redialTimeout = 10 * time.Second
+
+	peerTTL       = 30 * 24 * time.Hour // stored peers not seen for longer are forgotten, but trusted ones
+	pruneInterval = time.Hour
+)
+
+// keepAlive pings the connected peers of the groups every keep-alive
+// interval until ctx is done, recording their round trip.
+func (nd *Node) keepAlive(ctx context.Context) {
+	ticker := nd.opts.Clock.NewTicker(nd.opts.KeepAliveInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C():
+		}
+		for _, info := range nd.Peers.List() {
+			if info.Connected && len(info.Groups) > 0 {
+				go nd.ping(ctx, info.ID)
+			}
+		}
+	}
+}
+
+func (nd *Node) ping(ctx context.Context, id peer.ID) {
+	ctx, cancel := context.WithTimeout(ctx, pingTimeout)
+	defer cancel()
+
+	res := <-ping.Ping(ctx, nd.Host, id)
+	failures := nd.Peers.pinged(id, res.RTT, res.Error)
+	if res.Error == nil {
+		metrics.PingSeconds.WithLabelValues(id.String()).Observe(res.RTT.Seconds())
+		nd.Host.ConnManager().TagPeer(id, "keep", 100)
+		return
+	}
+	if nd.ctx.Err() != nil {
+		return // closing
+	}
+	nd.log.Debugw("ping", "peer", id, "failures", failures, "error", res.Error)
+	if failures >= pingFailures {
+		nd.log.Infow("peer unreachable, disconnecting", "peer", id, "failures", failures)
+		nd.Host.Network().ClosePeer(id)
+	}
+}
+
+// redial dials the trusted peers of closed groups while they are
+// disconnected, until ctx is done. Open groups trust nobody in particular,
+// discovery finds their peers. Each peer is dialed at its last known
+// addresses, one attempt at a time backing off from one to the next, and
+// joins its groups once connected and serving them. The stored peers not
+// seen for peerTTL are forgotten meanwhile.
+func (nd *Node) redial(ctx context.Context) {
+	ticker := nd.opts.Clock.NewTicker(redialCheck)
+	defer ticker.Stop()
+
+	type dialed struct {
+		id  peer.ID
+		err error
+	}
+	results := make(chan dialed)
+	dialing := map[peer.ID]bool{}
+	next := map[peer.ID]time.Time{} // of the next attempt
+	backoffs := map[peer.ID]*retry.Backoff{}
+	var pruned time.Time
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case r := <-results:
+			delete(dialing, r.id)
+			if r.err == nil {
+				nd.log.Infow("redialed peer", "peer", r.id)
+				continue
+			}
+			b, ok := backoffs[r.id]
+			if !ok {
+				b = &retry.Backoff{Min: time.Second, Max: time.Minute, Clock: nd.opts.Clock}
+				backoffs[r.id] = b
+			}
+			wait := b.Next()
+			next[r.id] = nd.opts.Clock.Now().Add(wait)
+			nd.log.Debugw("redial", "peer", r.id, "retry", wait, "error", r.err)
+			continue
+		case <-ticker.C():
+		}
+
+		now := nd.opts.Clock.Now()
+		ids := nd.redialable()
+		if now.Sub(pruned) >= pruneInterval {
+			nd.Peers.prune(ctx, now.Add(-peerTTL), ids)
+			pruned = now
+		}
+		for id := range backoffs {
+			if _, ok := ids[id]; !ok {
+				delete(next, id)
+				delete(backoffs, id)
+			}
+		}
+		for id, groups := range ids {
+			if nd.Host.Network().Connectedness(id) == network.Connected {
+				delete(next, id)
+				delete(backoffs, id)
+				for _, g := range groups { // dialed by either side, discovery or not
+					if g.serves(id) {
+						nd.Peers.Join(g.ID, id)
+					}
+				}
+				continue
+			}
+			if dialing[id] || now.Before(next[id]) {
+				continue
+			}
+			dialing[id] = true
+			go func(id peer.ID) {
+				err := nd.dial(ctx, id)
+				select {
+				case results <- dialed{id, err}:
+				case <-ctx.Done():
+				}
+			}(id)
+		}
+	}
+}
+
+// redialable are the trusted peers of the closed groups, with their groups.
+func (nd *Node) redialable() map[peer.ID][]*Group {
+	nd.mu.Lock()
+	groups := nd.groups
+	nd.mu.Unlock()
+
+	ids := map[peer.ID][]*Group{}
+	for _, g := range groups {
+		if g.Trust.Open() {
+			continue
+		}
+		for _, e := range g.Trust.Entries() {
+			if e.Peer != nd.Host.ID() {
+				ids[e.Peer] = append(ids[e.Peer], g)
+			}
+		}
+	}
+	return ids
+}
+
+// dial connects to id at the addresses of the registry, the peerstore and
+// its trust entries.
+func (nd *Node) dial(ctx context.Context, id peer.ID) error {
+	ctx, cancel := context.WithTimeout(ctx, redialTimeout)
+	defer cancel()
+
+	pi := peer.AddrInfo{ID: id}
+	if info, ok := nd.Peers.Get(id); ok {
+		pi.Addrs = append(pi.Addrs, info.Addrs...)
+	}
+	nd.mu.Lock()
+	groups := nd.groups
+	nd.mu.Unlock()
+	for _, g := range groups {
+		for _, e := range g.Trust.Entries() {
+			if e.Peer != id {
+				continue
+			}
+			for _, s := range e.Addrs {
+				if ma, err := multiaddr.NewMultiaddr(s); err == nil {
+					pi.Addrs = append(pi.Addrs, ma)
+				}
+			}
+		}
+	}
+	return nd.Host.Connect(ctx, pi)
+}
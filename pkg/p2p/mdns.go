@@ -0,0 +1,60 @@
+package p2p
+
+import (
+	"context"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/p2p/discovery/mdns"
+)
+
+// mdnsService is the mDNS name of a group, by its ID so that the
+// rendezvous isn't told to the local network.
+func mdnsService(id string) string {
+	return "_peerdrive-" + id + "._udp"
+}
+
+// discoveryMDNS finds the peers of a group on the local network.
+type discoveryMDNS struct {
+	g     *Group
+	ctx   context.Context
+	found chan peer.AddrInfo
+}
+
+func (d *discoveryMDNS) HandlePeerFound(pi peer.AddrInfo) {
+	select {
+	case d.found <- pi:
+	case <-d.ctx.Done():
+	}
+}
+
+// discoverMDNS connects the peers of g found on the local network, joining
+// them, until ctx is done.
+func (g *Group) discoverMDNS(ctx context.Context) error {
+	d := &discoveryMDNS{g: g, ctx: ctx, found: make(chan peer.AddrInfo)}
+	svc := mdns.NewMdnsService(g.Host, mdnsService(g.ID), d)
+	if err := svc.Start(); err != nil {
+		return err
+	}
+
+	go func() {
+		defer svc.Close()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case p := <-d.found:
+				if p.ID == g.Host.ID() {
+					continue
+				}
+				if err := g.Host.Connect(ctx, p); err != nil {
+					g.nd.log.Debugw("MDNS connect", "peer", p.ID, "error", err)
+					continue
+				}
+				if g.nd.Peers.Join(g.ID, p.ID) {
+					g.nd.log.Infow("connected peer by MDNS", "group", g.ID, "peer", p.ID)
+				}
+			}
+		}
+	}()
+	return nil
+}
@@ -2,71 +2,78 @@ package p2p
 
 import (
 	"context"
-	"crypto/rand"
 	"fmt"
-	"io/ioutil"
-	"log"
 	"os"
+	"sync"
 	"time"
 
 	"github.com/libp2p/go-libp2p"
 	"github.com/libp2p/go-libp2p-kad-dht/dual"
 	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/discovery"
 	"github.com/libp2p/go-libp2p/core/host"
 	"github.com/libp2p/go-libp2p/core/peer"
-	"github.com/libp2p/go-libp2p/p2p/discovery/mdns"
-	"github.com/libp2p/go-libp2p/p2p/discovery/routing"
-	"github.com/libp2p/go-libp2p/p2p/discovery/util"
+	"github.com/libp2p/go-libp2p/core/routing"
+	drouting "github.com/libp2p/go-libp2p/p2p/discovery/routing"
+	"github.com/libp2p/go-libp2p/p2p/protocol/ping"
+	"golang.org/x/xerrors"
+
+	"github.com/threecorp/peerdrive/pkg/bandwidth"
+	"github.com/threecorp/peerdrive/pkg/bus"
+	"github.com/threecorp/peerdrive/pkg/clock"
 	"github.com/threecorp/peerdrive/pkg/dev"
+	"github.com/threecorp/peerdrive/pkg/identity"
+	"github.com/threecorp/peerdrive/pkg/logging"
+	"github.com/threecorp/peerdrive/pkg/metrics"
 
 	dht "github.com/libp2p/go-libp2p-kad-dht"
 	pubsub "github.com/libp2p/go-libp2p-pubsub"
+	routinghelpers "github.com/libp2p/go-libp2p-routing-helpers"
 
 	"github.com/ipfs/go-datastore"
+	crdt "github.com/ipfs/go-ds-crdt"
 
 	badger "github.com/ipfs/go-ds-badger"
-	crdt "github.com/ipfs/go-ds-crdt"
 
 	ipfslite "github.com/hsanjuan/ipfs-lite"
 
 	"github.com/multiformats/go-multiaddr"
-	"github.com/samber/lo"
 	"go.uber.org/multierr"
+	"go.uber.org/zap"
 )
 
+var log = logging.Logger("p2p")
+
 // Peers
 
-var (
-	defaultBootstrapPeers     = dht.DefaultBootstrapPeers
-	defaultBootstrapPeersInfo []peer.AddrInfo
-)
+var defaultBootstrapAddrs = []string{
+	"/ip4/104.131.131.82/udp/4001/quic/p2p/QmaCpDMGvV2BGHeYERUEnRQAwe3N8SzbUtfsmvsqQLuvuJ",
+}
 
-func init() {
-	maddr, err := multiaddr.NewMultiaddr(
-		"/ip4/104.131.131.82/udp/4001/quic/p2p/QmaCpDMGvV2BGHeYERUEnRQAwe3N8SzbUtfsmvsqQLuvuJ",
-	)
-	if err != nil {
-		panic(err)
+// bootstrapPeers are the public DHT peers, a bad address is skipped.
+func bootstrapPeers(log *zap.SugaredLogger) []peer.AddrInfo {
+	maddrs := append([]multiaddr.Multiaddr{}, dht.DefaultBootstrapPeers...)
+	for _, s := range defaultBootstrapAddrs {
+		maddr, err := multiaddr.NewMultiaddr(s)
+		if err != nil {
+			log.Warnw("bootstrap peer", "addr", s, "error", err)
+			continue
+		}
+		maddrs = append(maddrs, maddr)
 	}
-	defaultBootstrapPeers = append(defaultBootstrapPeers, maddr)
 
-	infos, err := peer.AddrInfosFromP2pAddrs(defaultBootstrapPeers...)
-	if err != nil {
-		panic(err)
+	infos := []peer.AddrInfo{}
+	for _, maddr := range maddrs {
+		info, err := peer.AddrInfoFromP2pAddr(maddr)
+		if err != nil {
+			log.Warnw("bootstrap peer", "addr", maddr, "error", err)
+			continue
+		}
+		infos = append(infos, *info)
 	}
-	defaultBootstrapPeersInfo = infos
-}
-
-type PeerList []peer.ID
-
-func (pl *PeerList) AppendUnique(ids ...peer.ID) bool {
-	prevs := len(*pl)
-	*pl = lo.Uniq(append(*pl, ids...))
-	return prevs != len(*pl)
+	return infos
 }
 
-var Peers = PeerList{}
-
 // Datastore arranges to other folder
 
 const (
@@ -77,246 +84,246 @@ var (
 	DSKey = datastore.NewKey(DSName)
 )
 
+// Options are the node settings, the intervals apply to every group.
+type Options struct {
+	Port                int
+	Name                string         // of the device, told to peers, empty is the hostname
+	RebroadcastInterval time.Duration  // CRDT heads
+	DiscoveryInterval   time.Duration  // DHT advertise and find peers
+	KeepAliveInterval   time.Duration  // pings of peers, rotation announcements
+	Key                 crypto.PrivKey // nil loads the default identity
+	Rotations           identity.Chain // former identities announced to peers
+	Events              *bus.Bus       // peers connecting and disconnecting
+
+	ListenAddrs   []multiaddr.Multiaddr // nil listens on Port, every interface
+	Bootstrap     []peer.AddrInfo       // of the DHT, nil is the public peers
+	DatastorePath string                // of the badger store, empty is ./.dssnap
+
+	// Host, Datastore and Discovery replace the listening host with its DHT
+	// and bootstrap, the badger store and DHT discovery, as a test network
+	// or an embedding service does. The node closes the ones it is given.
+	Host      host.Host
+	Datastore datastore.Batching
+	Discovery discovery.Discovery
+	MDNS      bool                                    // also finds the peers of every group on the local network
+	PubSub    *pubsub.PubSub                          // nil starts GossipSub on the host
+	Broadcast func(crdt.Broadcaster) crdt.Broadcaster // wraps the CRDT broadcasts of every group
+	Clock     clock.Clock                             // nil is clock.Real
+	Logger    *zap.SugaredLogger                      // nil is the p2p subsystem
+}
+
+func DefaultOptions() Options {
+	return Options{
+		Port:                6868,
+		RebroadcastInterval: 5 * time.Second,
+		DiscoveryInterval:   5 * time.Second,
+		KeepAliveInterval:   20 * time.Second,
+		MDNS:                true,
+	}
+}
+
+// Node is the libp2p host and the local store shared by every group.
 type Node struct {
-	Host       host.Host
-	Lite       *ipfslite.Peer
-	DHT        *dual.DHT       // routing.Routing
-	DS         *crdt.Datastore // datastore.Batching
-	DSPutCh    chan lo.Tuple2[datastore.Key, []byte]
-	DSDelCh    chan datastore.Key
-	Rendezvous string
+	Host      host.Host
+	Lite      *ipfslite.Peer
+	DHT       *dual.DHT          // routing.Routing, nil with Options.Host
+	Store     datastore.Batching // local only, beneath every group's DS
+	PubSub    *pubsub.PubSub
+	Limiter   *bandwidth.Limiter
+	Discovery discovery.Discovery // finds the peers of every group
+	Peers     *Peers
+
+	opts     Options
+	log      *zap.SugaredLogger
+	mu       sync.Mutex
+	groups   []*Group
+	renamed  map[peer.ID]peer.ID // rotated identities of peers
+	onRotate []func(old, new peer.ID)
+	unwatch  func() // of the metrics
+	ctx      context.Context
+	cancel   context.CancelFunc
 }
 
+// Close stops the background loops and closes the stores, badger last.
 func (n *Node) Close() error {
+	n.cancel()
+	n.unwatch()
+
+	n.mu.Lock()
+	groups := n.groups
+	n.mu.Unlock()
+
+	var err error
+	for _, g := range groups {
+		err = multierr.Append(err, g.DS.Close())
+	}
+	if n.DHT != nil {
+		err = multierr.Append(err, n.DHT.Close())
+	}
 	return multierr.Combine(
+		err,
 		n.Host.Close(),
-		n.DHT.Close(),
-		n.DS.Close(),
+		n.Store.Close(),
 	)
 }
 
 // Default Behavior: https://pkg.go.dev/github.com/libp2p/go-libp2p#New
-func NewNode(ctx context.Context, port int, rendezvous string) (*Node, error) {
-	pkey, err := privKey()
-	if err != nil {
-		return nil, err
-	}
-
-	maddrs := []multiaddr.Multiaddr{}
-	for _, s := range []string{
-		fmt.Sprintf("/ip4/0.0.0.0/tcp/%d", port),
-		fmt.Sprintf("/ip4/0.0.0.0/udp/%d/quic", port),
-		fmt.Sprintf("/ip6/::/tcp/%d", port),
-		fmt.Sprintf("/ip6/::/udp/%d/quic", port),
-	} {
-		ma, err := multiaddr.NewMultiaddr(s)
-		if err != nil {
-			return nil, err
+func NewNode(ctx context.Context, opts Options, lim *bandwidth.Limiter) (*Node, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	started := false
+	defer func() {
+		if !started {
+			cancel()
 		}
-		maddrs = append(maddrs, ma)
+	}()
+
+	def := DefaultOptions()
+	if opts.RebroadcastInterval <= 0 {
+		opts.RebroadcastInterval = def.RebroadcastInterval
+	}
+	if opts.DiscoveryInterval <= 0 {
+		opts.DiscoveryInterval = def.DiscoveryInterval
+	}
+	if opts.KeepAliveInterval <= 0 {
+		opts.KeepAliveInterval = def.KeepAliveInterval
+	}
+	opts.Clock = clock.OrReal(opts.Clock)
+	if opts.Logger == nil {
+		opts.Logger = log
 	}
 
-	p2pOpts := append([]libp2p.Option{}, ipfslite.Libp2pOptionsExtra...)
-	p2pOpts = append(p2pOpts, []libp2p.Option{
-		// libp2p.EnableAutoRelay(),
-		libp2p.DefaultSecurity,
-		libp2p.DefaultMuxers,
-		libp2p.FallbackDefaults,
-	}...)
-	h, dht, err := ipfslite.SetupLibp2p(ctx, pkey, nil, maddrs, nil, p2pOpts...)
-	if err != nil {
-		return nil, err
+	if opts.Host != nil && opts.Discovery == nil {
+		return nil, xerrors.New("a given host needs a discovery, it has no DHT")
 	}
 
-	badgerDS, err := badger.NewDatastore(fmt.Sprintf("./%s", DSName), &badger.DefaultOptions)
+	rawHost, dht, err := setupHost(ctx, opts)
 	if err != nil {
 		return nil, err
 	}
-	lite, err := ipfslite.New(ctx, badgerDS, nil, h, dht, nil)
-	if err != nil {
-		return nil, err
+	// snap streams and bitswap are shaped, the DHT and pubsub are not
+	h := bandwidth.WrapHost(rawHost, lim)
+
+	store := opts.Datastore
+	if store == nil {
+		path := opts.DatastorePath
+		if path == "" {
+			path = fmt.Sprintf("./%s", DSName)
+		}
+		if store, err = badger.NewDatastore(path, &badger.DefaultOptions); err != nil {
+			return nil, err
+		}
 	}
-	lite.Bootstrap(defaultBootstrapPeersInfo)
-
-	psub, err := pubsub.NewGossipSub(ctx, h)
-	if err != nil {
-		return nil, err
+	var rt routing.Routing = routinghelpers.Null{}
+	if dht != nil {
+		rt = dht
 	}
-	bcast, err := crdt.NewPubSubBroadcaster(ctx, psub, rendezvous)
+	lite, err := ipfslite.New(ctx, store, nil, h, rt, nil)
 	if err != nil {
 		return nil, err
 	}
-	// more setups
-	// DAGService
-	// dags := ...
+	disc := opts.Discovery
+	if dht != nil {
+		bootstrap := opts.Bootstrap
+		if bootstrap == nil {
+			bootstrap = bootstrapPeers(opts.Logger)
+		}
+		lite.Bootstrap(bootstrap)
+		if disc == nil {
+			disc = drouting.NewRoutingDiscovery(dht)
+		}
+	}
 
-	n := &Node{
-		Host:       h,
-		DHT:        dht,
-		Lite:       lite,
-		DSPutCh:    make(chan lo.Tuple2[datastore.Key, []byte]),
-		DSDelCh:    make(chan datastore.Key),
-		Rendezvous: rendezvous,
+	psub := opts.PubSub
+	if psub == nil {
+		if psub, err = pubsub.NewGossipSub(ctx, rawHost); err != nil {
+			return nil, err
+		}
 	}
 
-	crdtOpts := crdt.DefaultOptions()
-	crdtOpts.RebroadcastInterval = 5 * time.Second
-	crdtOpts.PutHook = func(k datastore.Key, v []byte) { n.dsPutNotify(k, v) }
-	crdtOpts.DeleteHook = func(k datastore.Key) { n.dsDeletedNotify(k) }
-	crdtDS, err := crdt.New(badgerDS, DSKey, lite, bcast, crdtOpts)
+	if opts.Host != nil {
+		ping.NewPingService(rawHost) // libp2p hosts answer pings already
+	}
+	peers, err := newPeers(ctx, rawHost, store, opts.Events, opts.Clock, opts.Logger)
 	if err != nil {
 		return nil, err
 	}
-	n.DS = crdtDS
 
-	go n.run(psub)
+	n := &Node{
+		Host:      h,
+		DHT:       dht,
+		Lite:      lite,
+		Store:     store,
+		PubSub:    psub,
+		Limiter:   lim,
+		Discovery: disc,
+		opts:      opts,
+		log:       opts.Logger,
+		renamed:   map[peer.ID]peer.ID{},
+		Peers:     peers,
+		unwatch:   metrics.WatchNode(func() int { return len(rawHost.Network().Peers()) }),
+		ctx:       ctx,
+		cancel:    cancel,
+	}
+	go n.rotations(ctx)
+	go n.keepAlive(ctx)
+	go n.redial(ctx)
+	started = true
 	return n, nil
 }
 
-func (nd *Node) dsPutNotify(k datastore.Key, v []byte) {
-	// fmt.Printf("Added: [%s] -> %d bytes\n", k, len(v))
-	nd.DSPutCh <- lo.T2(k, v)
-}
-
-func (nd *Node) dsDeletedNotify(k datastore.Key) {
-	// fmt.Printf("Removed: [%s]\n", k)
-	// nd.DSDelCh <- k
-	panic("Not implemented yet")
-}
-
-func (nd *Node) run(psub *pubsub.PubSub) {
-	topic, err := psub.Join(fmt.Sprintf("%s-net", nd.Rendezvous))
-	if err != nil {
-		log.Fatalln(err)
-	}
-	netSubs, err := topic.Subscribe()
-	if err != nil {
-		log.Fatalln(err)
+// setupHost listens on opts.ListenAddrs with a DHT, unless opts.Host is
+// given.
+func setupHost(ctx context.Context, opts Options) (host.Host, *dual.DHT, error) {
+	if opts.Host != nil {
+		return opts.Host, nil, nil
 	}
 
-	// Use a special pubsub topic to avoid disconnecting
-	// from globaldb peers.
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
-	go func() {
-		for {
-			msg, err := netSubs.Next(ctx)
-			if err != nil {
-				log.Printf("subscribe: %+v\n", err)
-				break
-			}
-			nd.Host.ConnManager().TagPeer(msg.ReceivedFrom, "keep", 100)
-		}
-	}()
-	go func() {
-		for {
-			select {
-			case <-ctx.Done():
-				return
-			default:
-				topic.Publish(ctx, []byte("hi!"))
-				time.Sleep(20 * time.Second)
-			}
-		}
-	}()
-
-	ticker := time.NewTicker(5 * time.Second)
-	defer ticker.Stop()
-	for range ticker.C {
-		ctx := context.Background()
-
-		rd := routing.NewRoutingDiscovery(nd.DHT)
-		util.Advertise(ctx, rd, nd.Rendezvous)
-
-		peerCh, err := rd.FindPeers(ctx, nd.Rendezvous)
-		if err != nil {
-			log.Printf("DHT FindPeers failed: %+v\n", err)
-			continue
-		}
-
-		for p := range peerCh {
-			if p.ID == nd.Host.ID() || len(p.Addrs) == 0 {
-				continue
-			}
-			if err := nd.Host.Connect(ctx, p); err != nil {
-				// log.Println("DHT Connection failed:", p.ID, ">>", err)
-				continue
-			}
-			if !Peers.AppendUnique(p.ID) {
-				continue
-			}
-			log.Printf("Connected peer by DHT: %s\n", p.ID)
-
-			if err := nd.DS.Sync(ctx, DSKey); err != nil {
-				log.Fatalf("start sync first: %+v\n", err)
-			}
+	pkey := opts.Key
+	if pkey == nil {
+		var err error
+		if pkey, err = identity.Load(identity.DefaultOptions()); err != nil {
+			return nil, nil, xerrors.Errorf("identity: %w", err)
 		}
 	}
-}
 
-type discoveryMDNS struct {
-	PeerCh chan peer.AddrInfo
-	host   host.Host
-}
-
-func (n *discoveryMDNS) HandlePeerFound(pi peer.AddrInfo) {
-	n.PeerCh <- pi
-}
-
-func (n *discoveryMDNS) Run() {
-	for {
-		p := <-n.PeerCh
-		if p.ID == n.host.ID() {
-			continue
-		}
-		if err := n.host.Connect(context.Background(), p); err != nil {
-			// log.Println("MDNS Connection failed:", p.ID, ">>", err)
-			continue
-		}
-		if Peers.AppendUnique(p.ID) {
-			log.Printf("Connect peer by MDNS: %s\n", p.ID)
+	maddrs := opts.ListenAddrs
+	if maddrs == nil {
+		var err error
+		if maddrs, err = listenAddrs(opts.Port); err != nil {
+			return nil, nil, err
 		}
 	}
-}
 
-func NewMDNS(h host.Host, rendezvous string) (*discoveryMDNS, error) {
-	n := &discoveryMDNS{
-		host:   h,
-		PeerCh: make(chan peer.AddrInfo),
+	name := opts.Name
+	if name == "" {
+		name, _ = os.Hostname()
 	}
 
-	if err := mdns.NewMdnsService(h, rendezvous, n).Start(); err != nil {
-		return nil, err
-	}
-
-	return n, nil
+	p2pOpts := append([]libp2p.Option{}, ipfslite.Libp2pOptionsExtra...)
+	p2pOpts = append(p2pOpts, []libp2p.Option{
+		libp2p.UserAgent(name),
+		// libp2p.EnableAutoRelay(),
+		libp2p.DefaultSecurity,
+		libp2p.DefaultMuxers,
+		libp2p.FallbackDefaults,
+	}...)
+	return ipfslite.SetupLibp2p(ctx, pkey, nil, maddrs, nil, p2pOpts...)
 }
 
-func privKey() (crypto.PrivKey, error) {
-	name := dev.PrivateKeyName
-
-	// Restore pkey
-	if _, err := os.Stat(name); !os.IsNotExist(err) {
-		dat, err := ioutil.ReadFile(name)
+// listenAddrs are TCP and QUIC on port of every interface.
+func listenAddrs(port int) ([]multiaddr.Multiaddr, error) {
+	maddrs := []multiaddr.Multiaddr{}
+	for _, s := range []string{
+		fmt.Sprintf("/ip4/0.0.0.0/tcp/%d", port),
+		fmt.Sprintf("/ip4/0.0.0.0/udp/%d/quic", port),
+		fmt.Sprintf("/ip6/::/tcp/%d", port),
+		fmt.Sprintf("/ip6/::/udp/%d/quic", port),
+	} {
+		ma, err := multiaddr.NewMultiaddr(s)
 		if err != nil {
 			return nil, err
 		}
-
-		return crypto.UnmarshalPrivateKey(dat)
-	}
-
-	pkey, _, err := crypto.GenerateKeyPairWithReader(crypto.RSA, 2048, rand.Reader)
-	if err != nil {
-		return nil, err
-	}
-	// Store Key
-	privBytes, err := crypto.MarshalPrivateKey(pkey)
-	if err != nil {
-		return nil, err
-	}
-	if err := ioutil.WriteFile(name, privBytes, 0644); err != nil {
-		return nil, err
+		maddrs = append(maddrs, ma)
 	}
-
-	return pkey, nil
+	return maddrs, nil
 }
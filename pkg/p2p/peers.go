@@ -0,0 +1,430 @@
+package p2p
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/peerstore"
+	"github.com/multiformats/go-multiaddr"
+	"go.uber.org/zap"
+	"golang.org/x/xerrors"
+
+	"github.com/threecorp/peerdrive/pkg/bus"
+	"github.com/threecorp/peerdrive/pkg/clock"
+)
+
+// PeersKey is where the peers sharing a group are kept across restarts,
+// beneath the node's local store.
+var PeersKey = datastore.NewKey("peers")
+
+// PeerInfo is what a node knows of a peer.
+type PeerInfo struct {
+	ID        peer.ID
+	Name      string // of the device, the agent it identified with
+	Addrs     []multiaddr.Multiaddr
+	Connected bool
+	Latency   time.Duration // of the last ping, 0 before any
+	LastSeen  time.Time     // now while connected
+	Groups    []string      // IDs of the groups it was found sharing
+}
+
+// peerState is a peer of the registry, joined are the groups it takes part
+// in while connected.
+type peerState struct {
+	connected bool
+	lastSeen  time.Time
+	groups    map[string]bool // shared, joined since it connected when true
+	name      string
+	addrs     []multiaddr.Multiaddr // last known, the peerstore forgets them
+	rtt       time.Duration
+	failures  int // pings failed in a row
+}
+
+// peerRecord is a peerState as stored.
+type peerRecord struct {
+	Name     string
+	Addrs    []string
+	LastSeen time.Time
+	Groups   []string
+}
+
+// Peers is the registry of the peers of a node, safe for concurrent use.
+// Connections come from the notifications of the host network, groups from
+// discovery: a peer joins a group once found sharing it while connected,
+// and leaves every group when it disconnects. The peers of groups are kept
+// in the store with their last addresses.
+type Peers struct {
+	host   host.Host
+	store  datastore.Datastore
+	events *bus.Bus
+	clock  clock.Clock
+	log    *zap.SugaredLogger
+
+	mu      sync.Mutex
+	peers   map[peer.ID]*peerState
+	onJoin  []func(group string, id peer.ID)
+	unsaved map[peer.ID]bool // stored by saveLoop
+	saveCh  chan struct{}
+}
+
+func newPeers(ctx context.Context, h host.Host, store datastore.Datastore, events *bus.Bus, clk clock.Clock, log *zap.SugaredLogger) (*Peers, error) {
+	ps := &Peers{host: h, store: store, events: events, clock: clk, log: log, peers: map[peer.ID]*peerState{},
+		unsaved: map[peer.ID]bool{}, saveCh: make(chan struct{}, 1)}
+	if err := ps.load(ctx); err != nil {
+		return nil, err
+	}
+	go ps.saveLoop(ctx)
+	h.Network().Notify(&network.NotifyBundle{
+		ConnectedF:    ps.connected,
+		DisconnectedF: ps.disconnected,
+	})
+	for _, c := range h.Network().Conns() { // made before Notify
+		ps.connected(h.Network(), c)
+	}
+	return ps, nil
+}
+
+// load restores the stored peers, disconnected, and their addresses in the
+// peerstore.
+func (ps *Peers) load(ctx context.Context) error {
+	res, err := ps.store.Query(ctx, query.Query{Prefix: PeersKey.String()})
+	if err != nil {
+		return xerrors.Errorf("peers query: %w", err)
+	}
+	defer res.Close()
+
+	for r := range res.Next() {
+		if r.Error != nil {
+			return xerrors.Errorf("peers query: %w", r.Error)
+		}
+		id, err := peer.Decode(datastore.NewKey(r.Key).BaseNamespace())
+		if err != nil {
+			ps.log.Warnw("stored peer", "key", r.Key, "error", err)
+			continue
+		}
+		rec := &peerRecord{}
+		if err := gob.NewDecoder(bytes.NewReader(r.Value)).Decode(rec); err != nil {
+			return xerrors.Errorf("peer %s: %w", id, err)
+		}
+		st := ps.state(id)
+		st.name, st.lastSeen = rec.Name, rec.LastSeen
+		for _, g := range rec.Groups {
+			st.groups[g] = false
+		}
+		for _, s := range rec.Addrs {
+			ma, err := multiaddr.NewMultiaddr(s)
+			if err != nil {
+				continue
+			}
+			st.addrs = append(st.addrs, ma)
+		}
+		ps.host.Peerstore().AddAddrs(id, st.addrs, peerstore.AddressTTL)
+	}
+	return nil
+}
+
+// save stores id if it shares a group.
+func (ps *Peers) save(ctx context.Context, id peer.ID) {
+	ps.mu.Lock()
+	st, ok := ps.peers[id]
+	if !ok || len(st.groups) == 0 {
+		ps.mu.Unlock()
+		return
+	}
+	ps.remember(id, st)
+	rec := &peerRecord{Name: st.name, LastSeen: st.lastSeen, Groups: []string{}}
+	if st.connected {
+		rec.LastSeen = ps.clock.Now()
+	}
+	for _, ma := range st.addrs {
+		rec.Addrs = append(rec.Addrs, ma.String())
+	}
+	for g := range st.groups {
+		rec.Groups = append(rec.Groups, g)
+	}
+	ps.mu.Unlock()
+
+	sort.Strings(rec.Groups)
+	buf := bytes.NewBuffer(nil)
+	if err := gob.NewEncoder(buf).Encode(rec); err != nil {
+		ps.log.Errorw("peer encode", "peer", id, "error", err)
+		return
+	}
+	if err := ps.store.Put(ctx, PeersKey.ChildString(id.String()), buf.Bytes()); err != nil {
+		ps.log.Warnw("peer put", "peer", id, "error", err)
+	}
+}
+
+// saveLater has saveLoop store id, off the network notifications.
+func (ps *Peers) saveLater(id peer.ID) {
+	ps.mu.Lock()
+	ps.unsaved[id] = true
+	ps.mu.Unlock()
+
+	select {
+	case ps.saveCh <- struct{}{}:
+	default:
+	}
+}
+
+// saveLoop stores the peers of saveLater until ctx is done.
+func (ps *Peers) saveLoop(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ps.saveCh:
+		}
+		ps.mu.Lock()
+		ids := ps.unsaved
+		ps.unsaved = map[peer.ID]bool{}
+		ps.mu.Unlock()
+
+		for id := range ids {
+			ps.save(ctx, id)
+		}
+	}
+}
+
+// remember takes the name and addresses of id from the peerstore, while it
+// still has them.
+func (ps *Peers) remember(id peer.ID, st *peerState) {
+	pstore := ps.host.Peerstore()
+	if addrs := pstore.Addrs(id); len(addrs) > 0 {
+		st.addrs = addrs
+	}
+	if agent, err := pstore.Get(id, "AgentVersion"); err == nil {
+		if name, ok := agent.(string); ok && name != "" {
+			st.name = name
+		}
+	}
+}
+
+func (ps *Peers) state(id peer.ID) *peerState {
+	st, ok := ps.peers[id]
+	if !ok {
+		st = &peerState{groups: map[string]bool{}}
+		ps.peers[id] = st
+	}
+	return st
+}
+
+// connected and disconnected switch the state of the peer under the lock,
+// whatever order the notifications of its connections come in.
+func (ps *Peers) connected(nw network.Network, c network.Conn) {
+	id := c.RemotePeer()
+
+	ps.mu.Lock()
+	st := ps.state(id)
+	if st.connected {
+		ps.mu.Unlock()
+		return // not the first
+	}
+	st.connected, st.lastSeen, st.failures = true, ps.clock.Now(), 0
+	ps.mu.Unlock()
+
+	ps.events.Publish(bus.Event{Type: bus.PeerConnected, Peer: id.String()})
+}
+
+func (ps *Peers) disconnected(nw network.Network, c network.Conn) {
+	id := c.RemotePeer()
+
+	ps.mu.Lock()
+	st := ps.state(id)
+	if !st.connected || len(nw.ConnsToPeer(id)) > 0 {
+		ps.mu.Unlock()
+		return // not the last
+	}
+	st.connected, st.lastSeen = false, ps.clock.Now()
+	left := []string{}
+	for g, joined := range st.groups {
+		if joined {
+			st.groups[g] = false
+			left = append(left, g)
+		}
+	}
+	ps.mu.Unlock()
+
+	ps.saveLater(id)
+	ps.events.Publish(bus.Event{Type: bus.PeerDisconnected, Peer: id.String()})
+	sort.Strings(left)
+	for _, g := range left {
+		ps.events.Publish(bus.Event{Type: bus.PeerLeft, Group: g, Peer: id.String()})
+	}
+}
+
+// Join records id sharing group, it tells whether id joined by it: a
+// connected peer not in group since it connected.
+func (ps *Peers) Join(group string, id peer.ID) bool {
+	if id == ps.host.ID() {
+		return false
+	}
+
+	ps.mu.Lock()
+	st := ps.state(id)
+	if !st.connected { // by the notifications, the host may still be closing it
+		ps.mu.Unlock()
+		return false
+	}
+	joined := st.groups[group]
+	st.groups[group] = true
+	fns := ps.onJoin
+	ps.mu.Unlock()
+
+	if joined {
+		return false
+	}
+	ps.saveLater(id)
+	ps.events.Publish(bus.Event{Type: bus.PeerJoined, Group: group, Peer: id.String()})
+	for _, fn := range fns {
+		fn(group, id)
+	}
+	return true
+}
+
+// OnJoin registers fn, called every time a peer joins a group.
+func (ps *Peers) OnJoin(fn func(group string, id peer.ID)) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	ps.onJoin = append(ps.onJoin, fn)
+}
+
+// pinged records a ping of id, it returns how many failed in a row.
+func (ps *Peers) pinged(id peer.ID, rtt time.Duration, err error) int {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	st := ps.state(id)
+	if err != nil {
+		st.failures++
+		return st.failures
+	}
+	st.rtt, st.lastSeen, st.failures = rtt, ps.clock.Now(), 0
+	return 0
+}
+
+// Members are the connected peers of group.
+func (ps *Peers) Members(group string) []peer.ID {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	ids := []peer.ID{}
+	for id, st := range ps.peers {
+		if st.groups[group] {
+			ids = append(ids, id)
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
+}
+
+// Member tells whether id is a connected peer of group.
+func (ps *Peers) Member(group string, id peer.ID) bool {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	st, ok := ps.peers[id]
+	return ok && st.groups[group]
+}
+
+// Get is what is known of id.
+func (ps *Peers) Get(id peer.ID) (PeerInfo, bool) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	st, ok := ps.peers[id]
+	if !ok {
+		return PeerInfo{}, false
+	}
+	return ps.info(id, st), true
+}
+
+// List is every peer known, in the order of their IDs.
+func (ps *Peers) List() []PeerInfo {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	infos := make([]PeerInfo, 0, len(ps.peers))
+	for id, st := range ps.peers {
+		infos = append(infos, ps.info(id, st))
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].ID < infos[j].ID })
+	return infos
+}
+
+func (ps *Peers) info(id peer.ID, st *peerState) PeerInfo {
+	ps.remember(id, st)
+	info := PeerInfo{
+		ID:        id,
+		Name:      st.name,
+		Addrs:     append([]multiaddr.Multiaddr{}, st.addrs...),
+		Connected: st.connected,
+		Latency:   st.rtt,
+		LastSeen:  st.lastSeen,
+		Groups:    []string{},
+	}
+	if st.connected {
+		info.LastSeen = ps.clock.Now()
+	}
+	for g := range st.groups {
+		info.Groups = append(info.Groups, g)
+	}
+	sort.Strings(info.Groups)
+	return info
+}
+
+// prune forgets the disconnected peers not seen since before, but the ones
+// of keep.
+func (ps *Peers) prune(ctx context.Context, before time.Time, keep map[peer.ID][]*Group) {
+	ps.mu.Lock()
+	stale := []peer.ID{}
+	for id, st := range ps.peers {
+		if _, kept := keep[id]; !kept && !st.connected && st.lastSeen.Before(before) {
+			delete(ps.peers, id)
+			delete(ps.unsaved, id)
+			stale = append(stale, id)
+		}
+	}
+	ps.mu.Unlock()
+
+	for _, id := range stale {
+		if err := ps.store.Delete(ctx, PeersKey.ChildString(id.String())); err != nil {
+			ps.log.Warnw("peer delete", "peer", id, "error", err)
+		}
+	}
+}
+
+// rename moves old, a peer that rotated its identity, to next.
+func (ps *Peers) rename(ctx context.Context, old, next peer.ID) {
+	ps.mu.Lock()
+	st, ok := ps.peers[old]
+	if !ok {
+		ps.mu.Unlock()
+		return
+	}
+	delete(ps.peers, old)
+	nst := ps.state(next)
+	connected := ps.host.Network().Connectedness(next) == network.Connected
+	for g, joined := range st.groups {
+		nst.groups[g] = nst.groups[g] || (joined && connected)
+	}
+	if st.lastSeen.After(nst.lastSeen) {
+		nst.lastSeen = st.lastSeen
+	}
+	ps.mu.Unlock()
+
+	if err := ps.store.Delete(ctx, PeersKey.ChildString(old.String())); err != nil {
+		ps.log.Warnw("peer delete", "peer", old, "error", err)
+	}
+	ps.save(ctx, next)
+}
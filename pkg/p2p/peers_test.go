@@ -0,0 +1,51 @@
+package p2p
+
+import (
+	"context"
+	"testing"
+
+	"github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	mocknet "github.com/libp2p/go-libp2p/p2p/net/mock"
+	"go.uber.org/zap"
+
+	"github.com/threecorp/peerdrive/pkg/bus"
+	"github.com/threecorp/peerdrive/pkg/clock"
+)
+
+// closing is a network whose connections are all closed, while the host
+// still reports them.
+type closing struct{ network.Network }
+
+func (closing) ConnsToPeer(peer.ID) []network.Conn { return nil }
+
+// TestJoinDisconnected disconnects a peer in the middle of a Join, after
+// the host reported it connected: it must not join.
+func TestJoinDisconnected(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	mn, err := mocknet.FullMeshConnected(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mn.Close()
+	a, b := mn.Hosts()[0], mn.Hosts()[1]
+	ps, err := newPeers(ctx, a, dssync.MutexWrap(datastore.NewMapDatastore()), bus.New(), clock.Real, zap.NewNop().Sugar())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !ps.Join("g", b.ID()) || !ps.Member("g", b.ID()) {
+		t.Fatal("connected peer not joined")
+	}
+	ps.disconnected(closing{a.Network()}, a.Network().ConnsToPeer(b.ID())[0])
+	if a.Network().Connectedness(b.ID()) != network.Connected {
+		t.Fatal("host disconnected")
+	}
+	if ps.Join("h", b.ID()) || ps.Member("g", b.ID()) || ps.Member("h", b.ID()) {
+		t.Error("disconnected peer joined")
+	}
+}
@@ -0,0 +1,119 @@
+package p2p
+
+import (
+	"context"
+	"time"
+
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+	"github.com/libp2p/go-libp2p/core/peer"
+
+	"github.com/threecorp/peerdrive/pkg/identity"
+	"github.com/threecorp/peerdrive/pkg/retry"
+)
+
+// rotationTopic carries identity rotations between peerdrive nodes,
+// whatever groups they share.
+const rotationTopic = "peerdrive/identity"
+
+// OnRotate registers fn, called once for every peer found to have rotated
+// its identity, after the groups renamed it in their peers and trust.
+func (nd *Node) OnRotate(fn func(old, new peer.ID)) {
+	nd.mu.Lock()
+	defer nd.mu.Unlock()
+
+	nd.onRotate = append(nd.onRotate, fn)
+}
+
+// rotations announces the former identities of this node, and follows the
+// ones of its peers, until ctx is done.
+func (nd *Node) rotations(ctx context.Context) {
+	var (
+		topic *pubsub.Topic
+		sub   *pubsub.Subscription
+	)
+	b := &retry.Backoff{Min: time.Second, Max: time.Minute, Clock: nd.opts.Clock}
+	err := retry.Do(ctx, b, func(ctx context.Context) error {
+		var err error
+		if topic == nil {
+			if topic, err = nd.PubSub.Join(rotationTopic); err != nil {
+				return err
+			}
+		}
+		sub, err = topic.Subscribe()
+		return err
+	}, func(err error) {
+		nd.log.Warnw("rotation topic", "error", err)
+	})
+	if err != nil {
+		return // ctx is done
+	}
+
+	if len(nd.opts.Rotations) > 0 {
+		go nd.announce(ctx, topic)
+	}
+	for {
+		msg, err := sub.Next(ctx)
+		if err != nil {
+			return // ctx is done
+		}
+		from := msg.GetFrom()
+		if from == nd.Host.ID() {
+			continue
+		}
+		chain := identity.Chain{}
+		if err := chain.Unmarshal(msg.Data); err != nil {
+			nd.log.Warnw("rotation", "peer", from, "error", err)
+			continue
+		}
+		olds, err := chain.Verify(from)
+		if err != nil {
+			nd.log.Warnw("rotation", "peer", from, "error", err)
+			continue
+		}
+		for _, old := range olds {
+			nd.rotated(old, from)
+		}
+	}
+}
+
+// announce publishes the rotations of this node every keep-alive interval,
+// peers that were offline learn them once they are back.
+func (nd *Node) announce(ctx context.Context, topic *pubsub.Topic) {
+	data, err := nd.opts.Rotations.Marshal()
+	if err != nil {
+		nd.log.Errorw("rotation marshal", "error", err)
+		return
+	}
+	for {
+		if err := topic.Publish(ctx, data); err != nil && ctx.Err() == nil {
+			nd.log.Warnw("rotation publish", "error", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-nd.opts.Clock.After(nd.opts.KeepAliveInterval):
+		}
+	}
+}
+
+func (nd *Node) rotated(old, next peer.ID) {
+	nd.mu.Lock()
+	if nd.renamed[old] == next {
+		nd.mu.Unlock()
+		return
+	}
+	nd.renamed[old] = next
+	groups, fns := nd.groups, nd.onRotate
+	nd.mu.Unlock()
+
+	nd.log.Infow("peer rotated its identity", "old", old, "new", next)
+	nd.Peers.rename(nd.ctx, old, next)
+	for _, g := range groups {
+		if err := g.Trust.Rename(nd.ctx, old, next); err != nil {
+			nd.log.Errorw("trust rename", "group", g.ID, "error", err)
+		}
+	}
+	for _, fn := range fns {
+		fn(old, next)
+	}
+}
@@ -0,0 +1,306 @@
+package p2p
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+	"golang.org/x/xerrors"
+)
+
+// TrustKey is where the trusted peers of every group are kept, beneath
+// the node's local store.
+var TrustKey = datastore.NewKey("trust")
+
+// TrustEntry is a peer allowed in a group, and who vouched for it.
+type TrustEntry struct {
+	Peer  peer.ID
+	Addrs []string
+	By    peer.ID
+	Added time.Time
+}
+
+// Trust lists the peers of a group. An empty list is an open group, as
+// before invites: anyone knowing the rendezvous takes part.
+type Trust struct {
+	ds  datastore.Batching
+	key datastore.Key
+
+	mu      sync.Mutex
+	entries map[peer.ID]*TrustEntry
+}
+
+func openTrust(ctx context.Context, ds datastore.Batching, groupID string) (*Trust, error) {
+	t := &Trust{ds: ds, key: TrustKey.ChildString(groupID), entries: map[peer.ID]*TrustEntry{}}
+
+	res, err := ds.Query(ctx, query.Query{Prefix: t.key.String()})
+	if err != nil {
+		return nil, xerrors.Errorf("trust query: %w", err)
+	}
+	defer res.Close()
+	for r := range res.Next() {
+		if r.Error != nil {
+			return nil, xerrors.Errorf("trust query: %w", r.Error)
+		}
+		e := &TrustEntry{}
+		if err := gob.NewDecoder(bytes.NewReader(r.Value)).Decode(e); err != nil {
+			return nil, xerrors.Errorf("trust %s: %w", r.Key, err)
+		}
+		t.entries[e.Peer] = e
+	}
+	return t, nil
+}
+
+// Open tells whether anyone knowing the rendezvous takes part.
+func (t *Trust) Open() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return len(t.entries) == 0
+}
+
+// Contains tells whether id takes part, always true of an open group.
+func (t *Trust) Contains(id peer.ID) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	_, ok := t.entries[id]
+	return ok || len(t.entries) == 0
+}
+
+func (t *Trust) Entries() []*TrustEntry {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	es := make([]*TrustEntry, 0, len(t.entries))
+	for _, e := range t.entries {
+		c := *e
+		es = append(es, &c)
+	}
+	return es
+}
+
+// Add trusts the peers of es, the ones already trusted are kept as they are.
+// It returns the entries that were new.
+func (t *Trust) Add(ctx context.Context, es ...*TrustEntry) ([]*TrustEntry, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	added := []*TrustEntry{}
+	for _, e := range es {
+		if _, ok := t.entries[e.Peer]; ok || e.Peer == "" {
+			continue
+		}
+		if err := t.put(ctx, e); err != nil {
+			return added, err
+		}
+		added = append(added, e)
+	}
+	return added, nil
+}
+
+// Rename moves the entry of old, a peer that rotated its identity, to next.
+func (t *Trust) Rename(ctx context.Context, old, next peer.ID) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	e, ok := t.entries[old]
+	if !ok {
+		return nil
+	}
+	if err := t.ds.Delete(ctx, t.key.ChildString(old.String())); err != nil {
+		return err
+	}
+	delete(t.entries, old)
+	if _, ok := t.entries[next]; ok {
+		return nil
+	}
+	renamed := *e
+	renamed.Peer = next
+	return t.put(ctx, &renamed)
+}
+
+func (t *Trust) put(ctx context.Context, e *TrustEntry) error {
+	buf := bytes.NewBuffer(nil)
+	if err := gob.NewEncoder(buf).Encode(e); err != nil {
+		return err
+	}
+	if err := t.ds.Put(ctx, t.key.ChildString(e.Peer.String()), buf.Bytes()); err != nil {
+		return xerrors.Errorf("trust put: %w", err)
+	}
+	t.entries[e.Peer] = e
+	return nil
+}
+
+// SaveTrust records the trusted peers of a group before it is joined, like
+// the ones handed over by an invite.
+func (nd *Node) SaveTrust(ctx context.Context, groupID string, es []*TrustEntry) error {
+	nd.mu.Lock()
+	for _, g := range nd.groups {
+		if g.ID == groupID {
+			nd.mu.Unlock()
+			_, err := g.Trust.Add(ctx, es...)
+			return err
+		}
+	}
+	nd.mu.Unlock()
+
+	t, err := openTrust(ctx, nd.Store, groupID)
+	if err != nil {
+		return err
+	}
+	_, err = t.Add(ctx, es...)
+	return err
+}
+
+// TrustProtocol is the prefix of the protocols on which the peers of a
+// group tell each other whom they trust, each group has its own by ID.
+const TrustProtocol = "/peerdrive/trust/1.0.0"
+
+const (
+	trustAnnounce = time.Minute // how often the peers of a closed group are told again
+	trustTimeout  = 10 * time.Second
+	trustMax      = 1 << 20 // bytes of the entries told at once
+)
+
+func (g *Group) trustProtocol() protocol.ID {
+	return protocol.ID(TrustProtocol + "/" + g.ID)
+}
+
+// serves tells whether id has the group open, found by identify serving
+// its trust protocol. A connection alone doesn't tell.
+func (g *Group) serves(id peer.ID) bool {
+	protos, err := g.Host.Peerstore().SupportsProtocols(id, g.trustProtocol())
+	return err == nil && len(protos) > 0
+}
+
+// Vouch trusts the peers of es and tells the other peers of the group. It
+// is a local action, the only one that closes an open group: this node and
+// its current peers are trusted too, so they keep taking part.
+func (g *Group) Vouch(ctx context.Context, es ...*TrustEntry) error {
+	if g.Trust.Open() {
+		now := g.nd.opts.Clock.Now()
+		for _, id := range append([]peer.ID{g.Host.ID()}, g.Peers()...) {
+			es = append(es, &TrustEntry{Peer: id, Addrs: g.addrs(id), By: g.Host.ID(), Added: now})
+		}
+	}
+	added, err := g.Trust.Add(ctx, es...)
+	if err != nil {
+		return err
+	}
+	if len(added) == 0 {
+		return nil
+	}
+	for _, id := range g.Peers() {
+		go g.tell(g.nd.ctx, id, added)
+	}
+	return nil
+}
+
+func (g *Group) addrs(id peer.ID) []string {
+	addrs := []string{}
+	for _, ma := range g.Host.Peerstore().Addrs(id) {
+		addrs = append(addrs, ma.String())
+	}
+	if id == g.Host.ID() {
+		for _, ma := range g.Host.Addrs() {
+			addrs = append(addrs, ma.String())
+		}
+	}
+	return addrs
+}
+
+// announceTrust tells every trusted peer of a closed group to all of its
+// peers every trustAnnounce, until ctx is done. Those that were away when a
+// device was vouched for learn it once they join again, see joined.
+func (g *Group) announceTrust(ctx context.Context) {
+	ticker := g.nd.opts.Clock.NewTicker(trustAnnounce)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C():
+		}
+		if g.Trust.Open() {
+			continue
+		}
+		es := g.Trust.Entries()
+		for _, id := range g.Peers() {
+			go g.tell(ctx, id, es)
+		}
+	}
+}
+
+// joined tells id every trusted peer of a closed group.
+func (g *Group) joined(id peer.ID) {
+	if !g.Trust.Open() {
+		go g.tell(g.nd.ctx, id, g.Trust.Entries())
+	}
+}
+
+// tell sends es to id.
+func (g *Group) tell(ctx context.Context, id peer.ID, es []*TrustEntry) {
+	ctx, cancel := context.WithTimeout(ctx, trustTimeout)
+	defer cancel()
+
+	s, err := g.Host.NewStream(ctx, id, g.trustProtocol())
+	if err != nil {
+		g.nd.log.Debugw("trust stream", "group", g.ID, "peer", id, "error", err)
+		return
+	}
+	defer s.Close()
+	s.SetDeadline(time.Now().Add(trustTimeout))
+
+	if err := gob.NewEncoder(s).Encode(es); err != nil {
+		g.nd.log.Debugw("trust send", "group", g.ID, "peer", id, "error", err)
+		s.Reset()
+	}
+}
+
+// Refused counts the trust announces refused, sent to an open group or by
+// an untrusted peer.
+func (g *Group) Refused() int64 {
+	return g.refused.Load()
+}
+
+// handleTrust takes in the peers vouched for by a trusted peer. An open
+// group takes none: anyone knowing the rendezvous could close it to
+// themselves.
+func (g *Group) handleTrust(s network.Stream) {
+	defer s.Close()
+	s.SetDeadline(time.Now().Add(trustTimeout))
+	from := s.Conn().RemotePeer()
+	if g.Trust.Open() || !g.Trust.Contains(from) {
+		g.refused.Add(1)
+		g.nd.log.Debugw("trust refused", "group", g.ID, "peer", from, "open", g.Trust.Open())
+		s.Reset()
+		return
+	}
+
+	es := []*TrustEntry{}
+	if err := gob.NewDecoder(io.LimitReader(s, trustMax)).Decode(&es); err != nil {
+		g.nd.log.Warnw("trust", "group", g.ID, "peer", from, "error", err)
+		s.Reset()
+		return
+	}
+	for _, e := range es {
+		e.By = from
+	}
+	added, err := g.Trust.Add(g.nd.ctx, es...)
+	if err != nil {
+		g.nd.log.Warnw("trust", "group", g.ID, "peer", from, "error", err)
+	}
+	for _, e := range added {
+		g.nd.log.Infow("trusted peer", "group", g.ID, "peer", e.Peer, "by", from)
+	}
+}
@@ -0,0 +1,92 @@
+package retry
+
+import (
+	"context"
+	"os"
+	"syscall"
+	"time"
+
+	"golang.org/x/xerrors"
+
+	"github.com/threecorp/peerdrive/pkg/clock"
+)
+
+type fatalError struct {
+	err error
+}
+
+func (e *fatalError) Error() string { return e.err.Error() }
+func (e *fatalError) Unwrap() error { return e.err }
+
+// Fatal marks err as one that retrying won't fix, the folder it happened in
+// stops until something changes.
+func Fatal(err error) error {
+	if err == nil || IsFatal(err) {
+		return err
+	}
+	return &fatalError{err: err}
+}
+
+func IsFatal(err error) bool {
+	var fe *fatalError
+	return xerrors.As(err, &fe)
+}
+
+// Classify marks the errors of a missing or unreadable folder or a full
+// disk as fatal, anything else is taken as transient.
+func Classify(err error) error {
+	switch {
+	case err == nil:
+		return nil
+	case os.IsNotExist(err), os.IsPermission(err), xerrors.Is(err, syscall.ENOSPC):
+		return Fatal(err)
+	default:
+		return err
+	}
+}
+
+// Backoff doubles the delay from Min up to Max.
+type Backoff struct {
+	Min   time.Duration
+	Max   time.Duration
+	Clock clock.Clock // waited on by Do, nil is clock.Real
+
+	attempt int
+}
+
+func (b *Backoff) Next() time.Duration {
+	d := b.Min
+	for i := 0; i < b.attempt && d < b.Max; i++ {
+		d *= 2
+	}
+	if d > b.Max {
+		d = b.Max
+	}
+	b.attempt++
+	return d
+}
+
+func (b *Backoff) Reset() {
+	b.attempt = 0
+}
+
+// Do runs fn until it succeeds or ctx is done, waiting b between attempts.
+// onErr sees every failure, classified.
+func Do(ctx context.Context, b *Backoff, fn func(ctx context.Context) error, onErr func(err error)) error {
+	for {
+		err := fn(ctx)
+		if err == nil {
+			b.Reset()
+			return nil
+		}
+		if onErr != nil {
+			onErr(Classify(err))
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-clock.OrReal(b.Clock).After(b.Next()):
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package snap
+
+import (
+	"os"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+	"golang.org/x/xerrors"
+
+	"github.com/threecorp/peerdrive/pkg/bus"
+	"github.com/threecorp/peerdrive/pkg/event"
+	"github.com/threecorp/peerdrive/pkg/index"
+)
+
+const conflictTag = ".conflict-"
+
+// conflicts tells whether replacing the local copy of meta.Path with meta
+// would drop content that the version of meta did not see: an edit since the
+// last scan, or a concurrent version. Whoever replaces it keeps it, the
+// node merging two versions may not be the one that made the losing edit.
+func (f *Folder) conflicts(meta *Meta) bool {
+	if f.opts.Mode == ReceiveOnly {
+		return false // local changes are meant to be replaced
+	}
+	if f.Index.Stale(f.Dir, meta.Path) {
+		return true
+	}
+	e, ok := f.Index.Get(meta.Path)
+	return ok && !e.Deleted && meta.Version.Compare(e.Version) == index.Concurrent
+}
+
+// copied tells whether a conflict copy of relPath with the content hash is
+// in the index already, made here or by a peer.
+func (f *Folder) copied(relPath, hash string) bool {
+	ext := path.Ext(relPath)
+	prefix := strings.TrimSuffix(relPath, ext) + conflictTag
+	for _, e := range f.Index.Entries() {
+		if !e.Deleted && e.Hash == hash && strings.HasPrefix(e.Path, prefix) && strings.HasSuffix(e.Path, ext) {
+			return true
+		}
+	}
+	return false
+}
+
+// keepConflict moves the local copy of relPath aside, next to it, so that a
+// concurrent edit of from replaces it without losing it. The copy is a new
+// file of the folder, synced like any other, and made once per content.
+func (f *Folder) keepConflict(relPath string, from peer.ID) (string, error) {
+	src, err := (&event.Event{Path: relPath}).FullPath(f.Dir)
+	if err != nil {
+		return "", err
+	}
+	fi, err := os.Lstat(src)
+	if os.IsNotExist(err) || (err == nil && !fi.Mode().IsRegular()) {
+		return "", nil
+	} else if err != nil {
+		return "", err
+	}
+
+	if e, ok := f.Index.Get(relPath); ok && !f.Index.Stale(f.Dir, relPath) && f.copied(relPath, e.Hash) {
+		return "", nil
+	}
+
+	stamp := f.opts.Clock.Now().Format("20060102-150405")
+	for n := 1; ; n++ {
+		name := conflictName(relPath, stamp, f.Group.Host.ID().String(), n)
+		dst, err := (&event.Event{Path: name}).FullPath(f.Dir)
+		if err != nil {
+			return "", err
+		}
+		if _, err := os.Lstat(dst); !os.IsNotExist(err) {
+			continue // taken
+		}
+		if err := os.Rename(src, dst); err != nil {
+			return "", xerrors.Errorf("conflict copy of %s: %w", relPath, err)
+		}
+		f.publish(bus.Event{Type: bus.ConflictCreated, Path: relPath, Copy: name, Peer: from.String(), Size: fi.Size()})
+		return name, nil
+	}
+}
+
+// conflictName is like "a.conflict-20240102-150405-3xYz9a.txt", stamped
+// with the time and the end of the peer ID that made the edit, n > 1 tells
+// copies of the same second apart.
+func conflictName(relPath, stamp, self string, n int) string {
+	if len(self) > 6 {
+		self = self[len(self)-6:]
+	}
+	tag := conflictTag + stamp + "-" + self
+	if n > 1 {
+		tag += "-" + strconv.Itoa(n)
+	}
+	ext := path.Ext(relPath)
+	return strings.TrimSuffix(relPath, ext) + tag + ext
+}
@@ -0,0 +1,360 @@
+package snap
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/crypto/hkdf"
+	"golang.org/x/crypto/scrypt"
+	"golang.org/x/xerrors"
+
+	"github.com/threecorp/peerdrive/pkg/dev"
+	"github.com/threecorp/peerdrive/pkg/event"
+	"github.com/threecorp/peerdrive/pkg/index"
+)
+
+// A folder with a password only ever hands out sealed names and content,
+// so that peers without it, relays in particular, store and serve what
+// they can't read. Sealing is deterministic: the same file sealed by two
+// peers at the same path is the same blob, and swarms and relays keep
+// working by hash.
+//
+// Names are sealed element by element, content block by block with
+// AES-GCM. Each sealed block is the nonce followed by the ciphertext,
+// the nonce is derived from the plain block and its index, so a nonce is
+// never reused for different plaintext. Blocks authenticate the sealed
+// name, their index and the block count of the file: a relay can't move
+// content to another name, reorder or drop blocks.
+
+const sealOverhead = 12 + 16 // nonce and GCM tag
+
+// sealedBlock is the block size of sealed content.
+const sealedBlock = dev.BlockSize + sealOverhead
+
+type sealer struct {
+	names, data cipher.AEAD
+	nameKey     []byte // nonces of names
+	nonceKey    []byte // nonces of blocks
+}
+
+// newSealer derives the folder key from password, salted with the
+// rendezvous so that folders sharing a password don't share keys.
+func newSealer(password, rendezvous string) (*sealer, error) {
+	salt := sha256.Sum256([]byte("peerdrive folder key " + rendezvous))
+	key, err := scrypt.Key([]byte(password), salt[:], 1<<15, 8, 1, 32)
+	if err != nil {
+		return nil, xerrors.Errorf("folder key: %w", err)
+	}
+
+	kdf := hkdf.New(sha256.New, key, nil, []byte("peerdrive"))
+	keys := make([][]byte, 4)
+	for i := range keys {
+		keys[i] = make([]byte, 32)
+		if _, err := io.ReadFull(kdf, keys[i]); err != nil {
+			return nil, err
+		}
+	}
+	s := &sealer{nameKey: keys[2], nonceKey: keys[3]}
+	if s.names, err = newGCM(keys[0]); err != nil {
+		return nil, err
+	}
+	if s.data, err = newGCM(keys[1]); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func (s *sealer) nonce(key []byte, parts ...[]byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	for _, p := range parts {
+		mac.Write(p)
+	}
+	return mac.Sum(nil)[:12]
+}
+
+// sealName seals every element of the slash separated relPath.
+func (s *sealer) sealName(relPath string) string {
+	elems := strings.Split(relPath, "/")
+	for i, e := range elems {
+		nonce := s.nonce(s.nameKey, []byte(e))
+		elems[i] = base64.RawURLEncoding.EncodeToString(s.names.Seal(nonce, nonce, []byte(e), nil))
+	}
+	return strings.Join(elems, "/")
+}
+
+func (s *sealer) openName(sealed string) (string, error) {
+	elems := strings.Split(sealed, "/")
+	for i, e := range elems {
+		data, err := base64.RawURLEncoding.DecodeString(e)
+		if err != nil || len(data) < sealOverhead {
+			return "", xerrors.Errorf("sealed name %q: malformed", sealed)
+		}
+		plain, err := s.names.Open(nil, data[:12], data[12:], nil)
+		if err != nil {
+			return "", xerrors.Errorf("sealed name %q: %w", sealed, err)
+		}
+		elems[i] = string(plain)
+	}
+	relPath := strings.Join(elems, "/")
+	if relPath != path.Clean(relPath) || strings.HasPrefix(relPath, "../") || path.IsAbs(relPath) {
+		return "", xerrors.Errorf("sealed name %q: unsafe path", sealed)
+	}
+	return relPath, nil
+}
+
+// blockAD is what block i of n of the file sealed as name authenticates.
+func blockAD(name string, i, n int) []byte {
+	ad := binary.BigEndian.AppendUint64(nil, uint64(i))
+	ad = binary.BigEndian.AppendUint64(ad, uint64(n))
+	return append(ad, name...)
+}
+
+// blocks is the block count of size bytes of plain content.
+func blocks(size int64) int {
+	return int((size + dev.BlockSize - 1) / dev.BlockSize)
+}
+
+// sealBlock seals block i of n of the content sealed as name.
+func (s *sealer) sealBlock(name string, i, n int, plain []byte) []byte {
+	ad := blockAD(name, i, n)
+	nonce := s.nonce(s.nonceKey, ad, plain)
+	return s.data.Seal(nonce, nonce, plain, ad)
+}
+
+func (s *sealer) openBlock(name string, i, n int, sealed []byte) ([]byte, error) {
+	if len(sealed) < sealOverhead {
+		return nil, xerrors.Errorf("sealed block %d: short", i)
+	}
+	return s.data.Open(nil, sealed[:12], sealed[12:], blockAD(name, i, n))
+}
+
+// sealedSize is the size of size bytes of content once sealed.
+func sealedSize(size int64) int64 {
+	blocks := (size + dev.BlockSize - 1) / dev.BlockSize
+	return size + blocks*sealOverhead
+}
+
+// readSealed seals block i of the file name, sealed as wire.
+func (s *sealer) readSealed(name, wire string, i int) ([]byte, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, dev.BlockSize)
+	n, err := f.ReadAt(buf, int64(i)*dev.BlockSize)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	return s.sealBlock(wire, i, blocks(fi.Size()), buf[:n]), nil
+}
+
+// sealedSums are the block sums of the file name once sealed as wire, and
+// the plain content hash they were sealed from.
+func (s *sealer) sealedSums(name, wire string) ([][]byte, string, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, "", err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, "", err
+	}
+	count := blocks(fi.Size())
+
+	sums, plain := [][]byte{}, [][]byte{}
+	buf := make([]byte, dev.BlockSize)
+	for i := 0; ; i++ {
+		n, err := io.ReadFull(f, buf)
+		if n > 0 {
+			sealed, sum := sha256.Sum256(s.sealBlock(wire, i, count, buf[:n])), sha256.Sum256(buf[:n])
+			sums, plain = append(sums, sealed[:]), append(plain, sum[:])
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return sums, dev.SumsHash(plain), nil
+		}
+		if err != nil {
+			return nil, "", err
+		}
+	}
+}
+
+// openFile decrypts src, the content sealed as wire, into dst.
+func (s *sealer) openFile(src, dst, wire string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	fi, err := in.Stat()
+	if err != nil {
+		return err
+	}
+	count := int((fi.Size() + sealedBlock - 1) / sealedBlock)
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	buf := make([]byte, sealedBlock)
+	for i := 0; ; i++ {
+		n, err := io.ReadFull(in, buf)
+		if n > 0 {
+			plain, err := s.openBlock(wire, i, count, buf[:n])
+			if err != nil {
+				return xerrors.Errorf("open block %d: %w", i, err)
+			}
+			if _, err := out.Write(plain); err != nil {
+				return err
+			}
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return out.Close()
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// readEvent answers a Read of a sealed block of the file name.
+func (s *sealer) readEvent(ev *event.Event, name string) error {
+	fi, err := os.Stat(name)
+	if err != nil {
+		return xerrors.Errorf("%s error info %s: %w", ev.String(), ev.Path, err)
+	}
+	if ev.Offset%sealedBlock != 0 {
+		return xerrors.Errorf("%s offset %d is not a sealed block", ev.String(), ev.Offset)
+	}
+	data, err := s.readSealed(name, ev.Path, int(ev.Offset/sealedBlock))
+	if err != nil {
+		return xerrors.Errorf("%s error read %s at %d: %w", ev.String(), ev.Path, ev.Offset, err)
+	}
+	ev.Time = fi.ModTime()
+	ev.Size = sealedSize(fi.Size())
+	ev.Data = data
+	return nil
+}
+
+// sumsEvent answers a Sums of the file name once sealed.
+func (s *sealer) sumsEvent(ev *event.Event, name string) error {
+	fi, err := os.Stat(name)
+	if err != nil {
+		return xerrors.Errorf("%s error info %s: %w", ev.String(), ev.Path, err)
+	}
+	sums, _, err := s.sealedSums(name, ev.Path)
+	if err != nil {
+		return xerrors.Errorf("%s error sums %s: %w", ev.String(), ev.Path, err)
+	}
+	ev.Time = fi.ModTime()
+	ev.Size = sealedSize(fi.Size())
+	ev.Sums = sums
+	return nil
+}
+
+// sealSnap is the snapshot of entries as peers see it. Content sealed for
+// the first time is recorded in the index, so it is sealed only once.
+func (f *Folder) sealSnap(ctx context.Context, entries []*index.Entry) (*Snap, error) {
+	snap := Snapshot(f.Group.Host.ID(), entries)
+	for i, e := range entries {
+		sealed := e.Sealed
+		if !e.Deleted && sealed == "" {
+			sums, hash, err := f.crypt.sealedSums(filepath.Join(f.Dir, e.Path), f.crypt.sealName(e.Path))
+			if err != nil {
+				return nil, xerrors.Errorf("seal %s: %w", e.Path, err)
+			}
+			if hash != e.Hash {
+				return nil, xerrors.Errorf("seal %s: changed meanwhile", e.Path)
+			}
+			sealed = dev.SumsHash(sums)
+			if err := f.Index.Seal(ctx, e.Path, e.Hash, sealed); err != nil {
+				return nil, xerrors.Errorf("index seal: %w", err)
+			}
+		}
+
+		m := snap.Metas[i]
+		m.Path, m.Name, m.Hash = f.crypt.sealName(e.Path), "", sealed
+		m.Size, m.Block = sealedSize(e.Size), sealedBlock
+	}
+	return snap, nil
+}
+
+// openSnap opens the names of a sealed snapshot, the ones that don't open
+// with the folder key are dropped. Hashes and sizes stay sealed.
+func (f *Folder) openSnap(s *Snap) *Snap {
+	metas := make([]*Meta, 0, len(s.Metas))
+	for _, m := range s.Metas {
+		relPath, err := f.crypt.openName(m.Path)
+		if err != nil {
+			continue
+		}
+		opened := *m
+		opened.Path, opened.Name = relPath, path.Base(relPath)
+		metas = append(metas, &opened)
+	}
+	if dropped := len(s.Metas) - len(metas); dropped > 0 {
+		f.log.Warnw("paths don't open with the folder password", "folder", f.Dir, "peer", s.PeerID, "paths", dropped)
+	}
+	return &Snap{PeerID: s.PeerID, Seq: s.Seq, Metas: metas}
+}
+
+// entries is the index as peers see it, by sealed hash when the folder
+// has a password.
+func (f *Folder) entries() []*index.Entry {
+	es := f.Index.Entries()
+	if f.crypt != nil {
+		for _, e := range es {
+			e.Hash = e.Sealed
+		}
+	}
+	return es
+}
+
+// unseal decrypts a completed sealed download of wire into a partial of the
+// plain content, ready to commit.
+func (f *Folder) unseal(pt *partial, wire string) (*partial, error) {
+	if err := pt.verify(); err != nil {
+		return nil, err
+	}
+	defer pt.remove()
+
+	plain := &partial{Block: dev.BlockSize, path: pt.path + ".plain", clock: pt.clock}
+	if err := f.crypt.openFile(pt.path, plain.path, wire); err != nil {
+		os.Remove(plain.path)
+		return nil, xerrors.Errorf("unseal %s: %w", pt.Hash, err)
+	}
+	fi, err := os.Stat(plain.path)
+	if err != nil {
+		return nil, err
+	}
+	if plain.Hash, err = dev.FileHash(plain.path); err != nil {
+		return nil, err
+	}
+	plain.Size = fi.Size()
+	return plain, nil
+}
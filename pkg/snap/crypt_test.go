@@ -0,0 +1,149 @@
+package snap
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/threecorp/peerdrive/pkg/dev"
+)
+
+func newTestSealer(t *testing.T, password string) *sealer {
+	t.Helper()
+	s, err := newSealer(password, "rendezvous")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestSealName(t *testing.T) {
+	s, other := newTestSealer(t, "secret"), newTestSealer(t, "guess")
+	for _, relPath := range []string{"a.txt", "dir/sub/b.txt", "ünïcode/名前"} {
+		sealed := s.sealName(relPath)
+		if sealed == relPath || sealed != s.sealName(relPath) {
+			t.Errorf("%s sealed as %s", relPath, sealed)
+		}
+		if got, err := s.openName(sealed); err != nil || got != relPath {
+			t.Errorf("%s opened as %q, error %v", relPath, got, err)
+		}
+		if _, err := other.openName(sealed); err == nil {
+			t.Errorf("%s opened with another password", relPath)
+		}
+	}
+	for _, sealed := range []string{"", "not base64!", "c2hvcnQ", s.sealName("..") + "/" + s.sealName("a.txt")} {
+		if got, err := s.openName(sealed); err == nil {
+			t.Errorf("%q opened as %q", sealed, got)
+		}
+	}
+}
+
+// seal is the content of the file name sealed as wire, block by block like
+// peers serve it.
+func seal(t *testing.T, s *sealer, name, wire string) [][]byte {
+	t.Helper()
+	fi, err := os.Stat(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealed := [][]byte{}
+	for i := 0; i < blocks(fi.Size()); i++ {
+		block, err := s.readSealed(name, wire, i)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sealed = append(sealed, block)
+	}
+	return sealed
+}
+
+func TestSealFile(t *testing.T) {
+	s := newTestSealer(t, "secret")
+	for _, size := range []int{0, 1, dev.BlockSize, dev.BlockSize + 1, 2*dev.BlockSize + 5} {
+		dir := t.TempDir()
+		plain := bytes.Repeat([]byte("plain "), size/6+1)[:size]
+		name := filepath.Join(dir, "plain")
+		if err := os.WriteFile(name, plain, 0644); err != nil {
+			t.Fatal(err)
+		}
+		wire := s.sealName("a.txt")
+
+		blocks := seal(t, s, name, wire)
+		sealed := bytes.Join(blocks, nil)
+		if int64(len(sealed)) != sealedSize(int64(size)) {
+			t.Errorf("%d bytes sealed in %d, want %d", size, len(sealed), sealedSize(int64(size)))
+		}
+		sums, hash, err := s.sealedSums(name, wire)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want, _ := dev.FileHash(name); hash != want {
+			t.Errorf("%d bytes: plain hash %s, want %s", size, hash, want)
+		}
+		if len(sums) != len(blocks) {
+			t.Fatalf("%d bytes: %d sums of %d blocks", size, len(sums), len(blocks))
+		}
+		for i, b := range blocks {
+			if sum := sha256.Sum256(b); !bytes.Equal(sum[:], sums[i]) {
+				t.Errorf("%d bytes: sum %d does not match", size, i)
+			}
+		}
+
+		src, dst := filepath.Join(dir, "sealed"), filepath.Join(dir, "opened")
+		if err := os.WriteFile(src, sealed, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.openFile(src, dst, wire); err != nil {
+			t.Fatalf("%d bytes: %v", size, err)
+		}
+		if got, err := os.ReadFile(dst); err != nil || !bytes.Equal(got, plain) {
+			t.Errorf("%d bytes opened as %d, error %v", size, len(got), err)
+		}
+	}
+}
+
+// TestSealTamper has a relay hand out content it changed, which doesn't open.
+func TestSealTamper(t *testing.T) {
+	s := newTestSealer(t, "secret")
+	dir := t.TempDir()
+	name := filepath.Join(dir, "plain")
+	if err := os.WriteFile(name, bytes.Repeat([]byte("plain "), dev.BlockSize/2), 0644); err != nil {
+		t.Fatal(err)
+	}
+	wire := s.sealName("a.txt")
+	blocks := seal(t, s, name, wire)
+	if len(blocks) != 3 {
+		t.Fatalf("%d blocks, want 3", len(blocks))
+	}
+
+	for _, tt := range []struct {
+		name   string
+		blocks [][]byte
+		wire   string // opened as
+		opener *sealer
+	}{
+		{"other name", blocks, s.sealName("b.txt"), s},
+		{"dropped block", blocks[:2], wire, s},
+		{"swapped blocks", [][]byte{blocks[1], blocks[0], blocks[2]}, wire, s},
+		{"flipped bit", [][]byte{blocks[0], flip(blocks[1]), blocks[2]}, wire, s},
+		{"other password", blocks, wire, newTestSealer(t, "guess")},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			src := filepath.Join(t.TempDir(), "sealed")
+			if err := os.WriteFile(src, bytes.Join(tt.blocks, nil), 0644); err != nil {
+				t.Fatal(err)
+			}
+			if err := tt.opener.openFile(src, src+".opened", tt.wire); err == nil {
+				t.Error("tampered content opened")
+			}
+		})
+	}
+}
+
+func flip(b []byte) []byte {
+	c := append([]byte{}, b...)
+	c[len(c)/2] ^= 1
+	return c
+}
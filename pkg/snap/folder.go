@@ -0,0 +1,246 @@
+package snap
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+	"go.uber.org/zap"
+	"golang.org/x/sync/semaphore"
+	"golang.org/x/xerrors"
+
+	"github.com/threecorp/peerdrive/pkg/bandwidth"
+	"github.com/threecorp/peerdrive/pkg/bus"
+	"github.com/threecorp/peerdrive/pkg/clock"
+	"github.com/threecorp/peerdrive/pkg/dev"
+	"github.com/threecorp/peerdrive/pkg/event"
+	"github.com/threecorp/peerdrive/pkg/hook"
+	"github.com/threecorp/peerdrive/pkg/index"
+	"github.com/threecorp/peerdrive/pkg/logging"
+	"github.com/threecorp/peerdrive/pkg/metrics"
+	"github.com/threecorp/peerdrive/pkg/p2p"
+	"github.com/threecorp/peerdrive/pkg/transfer"
+	"github.com/threecorp/peerdrive/pkg/watch"
+)
+
+var log = logging.Logger("snap")
+
+type Mode string
+
+const (
+	SendReceive Mode = "send-receive"
+	SendOnly    Mode = "send-only"       // publishes local changes, never applies remote ones
+	ReceiveOnly Mode = "receive-only"    // applies remote changes, local ones stay local until reverted
+	Relay       Mode = "encrypted-relay" // stores and serves content by hash, never writes the tree
+)
+
+func ParseMode(s string) (Mode, error) {
+	switch m := Mode(s); m {
+	case SendReceive, SendOnly, ReceiveOnly, Relay:
+		return m, nil
+	case "":
+		return SendReceive, nil
+	default:
+		return "", xerrors.Errorf("unknown folder mode %q, want %s, %s, %s or %s", s, SendReceive, SendOnly, ReceiveOnly, Relay)
+	}
+}
+
+// Options are the settings of one sync folder.
+type Options struct {
+	Mode       Mode
+	Watcher    watch.Backend
+	Interval   time.Duration // polling watcher
+	Settle     time.Duration // quiet time after local changes before a snapshot
+	WriteCheck dev.WriteCheck
+	Transfer   transfer.Options
+	PartialAge time.Duration
+	Ignore     dev.Ignore
+	Versions   int // old copies kept of every file a peer replaced or removed
+	Limits     bandwidth.Limits
+	Password   string // seals names and content for peers without it, see crypt.go
+	Events     *bus.Bus
+	Hooks      hook.Config        // run on the events of the folder
+	Clock      clock.Clock        // nil is clock.Real
+	Logger     *zap.SugaredLogger // nil is the snap subsystem
+	Sinks      []event.Sink       // show the sync activity, nil is those of event.SetSinks
+}
+
+func DefaultOptions() Options {
+	return Options{
+		Mode:       SendReceive,
+		Watcher:    watch.Auto,
+		Interval:   watch.DefaultInterval,
+		Settle:     settle,
+		WriteCheck: dev.DefaultWriteCheck(),
+		Transfer:   transfer.DefaultOptions(),
+		PartialAge: DefaultPartialAge,
+	}
+}
+
+// Folder syncs one directory with the peers of its group.
+type Folder struct {
+	Dir       string
+	Group     *p2p.Group
+	Index     *index.Index
+	Health    *Health
+	Transfers *Transfers
+
+	opts     Options
+	protocol protocol.ID
+	shaper   *bandwidth.Shaper
+	origins  *originTracker
+	holders  *holderSet
+	partials *partialLocks
+	locker   *semaphore.Weighted
+	stored   chan struct{} // a relay stored or dropped content
+	merged   chan struct{} // a remote change merged a concurrent one, to publish
+	rescans  chan struct{} // see Rescan
+	paused   atomic.Bool
+	crypt    *sealer       // nil without a password
+	dropped  atomic.Int64  // unsigned, forged or replayed snapshots
+	seq      atomic.Uint64 // of the last snapshot published
+	replaced atomic.Bool   // an older snapshot of this peer was put since
+	log      *zap.SugaredLogger
+	disp     event.Display
+}
+
+func NewFolder(g *p2p.Group, idx *index.Index, dir string, opts Options) (*Folder, error) {
+	if opts.Settle <= 0 {
+		opts.Settle = settle
+	}
+	opts.Clock = clock.OrReal(opts.Clock)
+	opts.WriteCheck.Clock = opts.Clock
+	if opts.Logger == nil {
+		opts.Logger = log
+	}
+	var crypt *sealer
+	if opts.Password != "" {
+		if opts.Mode == Relay {
+			return nil, xerrors.Errorf("%s holds sealed content as is, it takes no password", Relay)
+		}
+		var err error
+		if crypt, err = newSealer(opts.Password, g.Rendezvous); err != nil {
+			return nil, err
+		}
+	}
+
+	f := &Folder{
+		Dir:      dir,
+		Group:    g,
+		Index:    idx,
+		Health:   &Health{Path: dir, Events: opts.Events, Clock: opts.Clock, log: opts.Logger},
+		opts:     opts,
+		protocol: protocol.ID(Protocol + "/" + g.ID),
+		shaper:   bandwidth.NewShaper(opts.Limits),
+		origins:  newOriginTracker(),
+		holders:  newHolderSet(),
+		partials: newPartialLocks(),
+		locker:   semaphore.NewWeighted(1),
+		stored:   make(chan struct{}, 1),
+		merged:   make(chan struct{}, 1),
+		rescans:  make(chan struct{}, 1),
+		crypt:    crypt,
+		log:      opts.Logger,
+		disp:     opts.Sinks,
+	}
+	opts.Transfer.Clock = opts.Clock
+	f.Transfers = transfer.New(opts.Transfer, f.fetch)
+	return f, nil
+}
+
+// Run syncs the folder until ctx is done, a value on rescan publishes
+// whatever changed without waiting for the watcher, see Rescan. Running transfers are
+// left to Transfers.Drain.
+func (f *Folder) Run(ctx context.Context, rescan <-chan struct{}) {
+	f.Group.Host.SetStreamHandler(f.protocol, func(s network.Stream) {
+		if !f.Group.Trust.Contains(s.Conn().RemotePeer()) {
+			s.Reset() // not invited
+			return
+		}
+		f.RWHandler()(f.shaper.WrapStream(s))
+	})
+	defer f.Group.Host.RemoveStreamHandler(f.protocol)
+	defer metrics.WatchFolder(f.Dir, f.stats)()
+
+	f.Transfers.Start(ctx)
+	go hook.Run(ctx, f.opts.Events, f.Dir, f.Group.ID, f.opts.Hooks)
+	go f.collectPartials(ctx)
+	go f.SnapWatcher(ctx)
+	if f.opts.Mode == Relay {
+		f.relayLoop(ctx, rescan)
+		return
+	}
+	f.SyncWatcher(ctx, rescan)
+}
+
+func (f *Folder) Mode() Mode {
+	return f.opts.Mode
+}
+
+// Pause stops publishing local changes and applying and downloading remote
+// ones until Resume, the files are still served to peers.
+func (f *Folder) Pause() {
+	f.paused.Store(true)
+	f.Transfers.Pause(true)
+}
+
+// Resume publishes what changed while paused and applies the last
+// snapshots of peers.
+func (f *Folder) Resume() {
+	f.paused.Store(false)
+	f.Transfers.Pause(false)
+	f.Rescan()
+}
+
+func (f *Folder) Paused() bool {
+	return f.paused.Load()
+}
+
+// Rescan publishes whatever changed without waiting for the watcher, like a
+// value on the rescan channel of Run.
+func (f *Folder) Rescan() {
+	select {
+	case f.rescans <- struct{}{}:
+	default:
+	}
+}
+
+// Dropped counts the snapshots dropped as unsigned, forged or replayed.
+func (f *Folder) Dropped() int64 {
+	return f.dropped.Load()
+}
+
+// stats are the gauges of the folder, read when metrics are scraped.
+func (f *Folder) stats() metrics.FolderStats {
+	st := metrics.FolderStats{Queue: f.Transfers.Len()}
+	for _, e := range f.Index.Entries() {
+		if !e.Synced || e.Local {
+			st.OutOfSync++
+		}
+	}
+	st.OutOfSync += st.Queue
+	st.Heads = len(f.Group.DS.InternalStats().Heads)
+	return st
+}
+
+// publish stamps ev with the folder and hands it to the event bus.
+func (f *Folder) publish(ev bus.Event) {
+	ev.Folder, ev.Group = f.Dir, f.Group.ID
+	f.opts.Events.Publish(ev)
+}
+
+// SetLimits replaces the bandwidth limits of the folder's own streams.
+func (f *Folder) SetLimits(l bandwidth.Limits) {
+	f.shaper.Set(l)
+}
+
+func (f *Folder) newStream(ctx context.Context, id peer.ID) (network.Stream, error) {
+	s, err := f.Group.Host.NewStream(ctx, id, f.protocol)
+	if err != nil {
+		return nil, err
+	}
+	return f.shaper.WrapStream(s), nil
+}
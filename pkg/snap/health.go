@@ -0,0 +1,71 @@
+package snap
+
+import (
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/threecorp/peerdrive/pkg/bus"
+	"github.com/threecorp/peerdrive/pkg/clock"
+	"github.com/threecorp/peerdrive/pkg/metrics"
+	"github.com/threecorp/peerdrive/pkg/retry"
+)
+
+// Health is the error state of a sync folder. Errors are logged and kept
+// here for the status output instead of stopping the daemon.
+type Health struct {
+	Path   string
+	Events *bus.Bus
+	Clock  clock.Clock // of since, nil is clock.Real
+
+	log   *zap.SugaredLogger
+	mu    sync.Mutex
+	err   error
+	since time.Time
+}
+
+type HealthState struct {
+	State string // ok, error (transient, retrying) or stopped (fatal)
+	Error string
+	Since time.Time
+}
+
+func (h *Health) Fail(op string, err error) {
+	err = retry.Classify(err)
+	h.log.Errorw(op, "folder", h.Path, "error", err)
+	metrics.Errors.WithLabelValues(h.Path, op).Inc()
+	h.Events.Publish(bus.Event{Type: bus.FolderError, Folder: h.Path, Op: op, Error: err.Error()})
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.err == nil {
+		h.since = clock.OrReal(h.Clock).Now()
+	}
+	h.err = err
+}
+
+func (h *Health) OK() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.err != nil {
+		h.err = nil
+		h.since = clock.OrReal(h.Clock).Now()
+	}
+}
+
+func (h *Health) State() HealthState {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	switch {
+	case h.err == nil:
+		return HealthState{State: "ok", Since: h.since}
+	case retry.IsFatal(h.err):
+		return HealthState{State: "stopped", Error: h.err.Error(), Since: h.since}
+	default:
+		return HealthState{State: "error", Error: h.err.Error(), Since: h.since}
+	}
+}
@@ -0,0 +1,122 @@
+package snap
+
+import (
+	"sync"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+
+	"github.com/threecorp/peerdrive/pkg/index"
+)
+
+// holderSet remembers the latest snapshot of every peer, so a file can be
+// fetched from any peer that holds the same content, under any path.
+type holderSet struct {
+	mu     sync.Mutex
+	snaps  map[peer.ID]map[string]*Meta           // by path
+	hashes map[string]map[peer.ID]map[string]bool // paths by hash and peer
+}
+
+// holder is a peer holding a content at Path.
+type holder struct {
+	ID   peer.ID
+	Path string
+}
+
+func newHolderSet() *holderSet {
+	return &holderSet{snaps: map[peer.ID]map[string]*Meta{}, hashes: map[string]map[peer.ID]map[string]bool{}}
+}
+
+func (hs *holderSet) Update(s *Snap) {
+	metas := make(map[string]*Meta, len(s.Metas))
+	for _, m := range s.Metas {
+		if !m.IsDir {
+			metas[m.Path] = m
+		}
+	}
+
+	hs.mu.Lock()
+	defer hs.mu.Unlock()
+
+	for _, m := range hs.snaps[s.PeerID] {
+		if paths := hs.hashes[m.Hash][s.PeerID]; paths != nil {
+			delete(paths, m.Path)
+			if len(paths) == 0 {
+				delete(hs.hashes[m.Hash], s.PeerID)
+			}
+			if len(hs.hashes[m.Hash]) == 0 {
+				delete(hs.hashes, m.Hash)
+			}
+		}
+	}
+	for _, m := range metas {
+		if m.Deleted {
+			continue
+		}
+		if hs.hashes[m.Hash] == nil {
+			hs.hashes[m.Hash] = map[peer.ID]map[string]bool{}
+		}
+		if hs.hashes[m.Hash][s.PeerID] == nil {
+			hs.hashes[m.Hash][s.PeerID] = map[string]bool{}
+		}
+		hs.hashes[m.Hash][s.PeerID][m.Path] = true
+	}
+	hs.snaps[s.PeerID] = metas
+}
+
+// Peers lists the candidates holding the content of meta with the path they
+// hold it at, its own path preferably. first is listed first, at the path of
+// meta.
+func (hs *holderSet) Peers(meta *Meta, first peer.ID, candidates []peer.ID) []holder {
+	hs.mu.Lock()
+	defer hs.mu.Unlock()
+
+	holders := []holder{{first, meta.Path}}
+	for _, id := range candidates {
+		paths := hs.hashes[meta.Hash][id]
+		if id == first || len(paths) == 0 {
+			continue
+		}
+		path := meta.Path
+		if !paths[path] {
+			path = ""
+			for p := range paths { // the same one every time
+				if path == "" || p < path {
+					path = p
+				}
+			}
+		}
+		holders = append(holders, holder{id, path})
+	}
+	return holders
+}
+
+// Latest is the newest state of path among the candidates, by version and
+// then mtime like calcDiff, nil when none of them knows the path.
+func (hs *holderSet) Latest(path string, candidates []peer.ID) (*Meta, peer.ID) {
+	hs.mu.Lock()
+	defer hs.mu.Unlock()
+
+	var (
+		latest *Meta
+		from   peer.ID
+	)
+	for _, id := range candidates {
+		m, ok := hs.snaps[id][path]
+		if !ok {
+			continue
+		}
+		if latest == nil {
+			latest, from = m, id
+			continue
+		}
+		switch m.Version.Compare(latest.Version) {
+		case index.After:
+			latest, from = m, id
+		case index.Concurrent:
+			if m.Time.After(latest.Time) {
+				latest, from = m, id
+			}
+		}
+	}
+	return latest, from
+}
@@ -0,0 +1,28 @@
+package snap
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+func TestHolders(t *testing.T) {
+	a, b, c, d := peer.ID("a"), peer.ID("b"), peer.ID("c"), peer.ID("d")
+	hs := newHolderSet()
+	hs.Update(&Snap{PeerID: b, Metas: []*Meta{{Path: "x.txt", Hash: "h"}, {Path: "y.txt", Hash: "h"}}})
+	hs.Update(&Snap{PeerID: c, Metas: []*Meta{{Path: "moved/z.txt", Hash: "h"}, {Path: "x.txt", Hash: "other"}}})
+	hs.Update(&Snap{PeerID: d, Metas: []*Meta{{Path: "x.txt", Hash: "h", Deleted: true}}})
+
+	meta := &Meta{Path: "x.txt", Hash: "h"}
+	want := []holder{{a, "x.txt"}, {b, "x.txt"}, {c, "moved/z.txt"}}
+	if got := hs.Peers(meta, a, []peer.ID{a, b, c, d}); !reflect.DeepEqual(got, want) {
+		t.Errorf("holders %v, want %v", got, want)
+	}
+
+	hs.Update(&Snap{PeerID: c, Metas: []*Meta{{Path: "moved/z.txt", Hash: "edited"}}})
+	want = []holder{{a, "x.txt"}, {b, "x.txt"}}
+	if got := hs.Peers(meta, a, []peer.ID{b, c, d}); !reflect.DeepEqual(got, want) {
+		t.Errorf("holders after an edit %v, want %v", got, want)
+	}
+}
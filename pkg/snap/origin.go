@@ -0,0 +1,118 @@
+package snap
+
+import (
+	"os"
+	"sync"
+	"time"
+
+	"github.com/threecorp/peerdrive/pkg/dev"
+)
+
+type origin struct {
+	Hash    string
+	Size    int64
+	MTime   time.Time
+	Deleted bool
+	Inode   uint64 // set once the hash was verified on disk
+}
+
+// originTracker remembers the files the engine itself wrote or removed, so
+// that watcher events caused by them are not taken for local changes. Only
+// an exact match of the file on disk is ignored, any other edit wins.
+type originTracker struct {
+	mu      sync.Mutex
+	origins map[string]*origin
+}
+
+func newOriginTracker() *originTracker {
+	return &originTracker{origins: map[string]*origin{}}
+}
+
+func (t *originTracker) ExpectWrite(relPath, hash string, size int64, mtime time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.origins[relPath] = &origin{Hash: hash, Size: size, MTime: mtime}
+}
+
+func (t *originTracker) ExpectRemove(relPath string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.origins[relPath] = &origin{Deleted: true}
+}
+
+func (t *originTracker) Forget(relPath string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	delete(t.origins, relPath)
+}
+
+// Written records the mtime the file of relPath got on disk, once written
+// as expected. Filesystems keep mtimes at their own granularity, a second or
+// two on some, so the one asked for may never match.
+func (t *originTracker) Written(path, relPath string) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if o, ok := t.origins[relPath]; ok && !o.Deleted && fi.Size() == o.Size {
+		o.MTime, o.Inode = fi.ModTime(), dev.FileInode(fi)
+	}
+}
+
+// Match tells whether path on disk is exactly what the engine left there.
+// A mismatch forgets the origin, the file has been changed locally since.
+// The file is hashed without holding the lock.
+func (t *originTracker) Match(path, relPath string) bool {
+	t.mu.Lock()
+	o, ok := t.origins[relPath]
+	var want origin
+	if ok {
+		want = *o
+	}
+	t.mu.Unlock()
+	if !ok {
+		return false
+	}
+
+	inode, matched := match(&want, path)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.origins[relPath] != o {
+		return matched // expected anew meanwhile, the new origin stays
+	}
+	if !matched {
+		delete(t.origins, relPath)
+		return false
+	}
+	o.Inode = inode
+	return true
+}
+
+// match tells whether path is o, and its inode once its hash is verified.
+func match(o *origin, path string) (uint64, bool) {
+	fi, err := os.Stat(path)
+	if o.Deleted {
+		return 0, os.IsNotExist(err)
+	}
+	if err != nil || fi.Size() != o.Size || !fi.ModTime().Equal(o.MTime) {
+		return 0, false
+	}
+	if o.Inode != 0 && o.Inode == dev.FileInode(fi) {
+		return o.Inode, true
+	}
+
+	hash, err := dev.FileHash(path)
+	if err != nil || hash != o.Hash {
+		return 0, false
+	}
+	return dev.FileInode(fi), true
+}
@@ -0,0 +1,63 @@
+package snap
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/threecorp/peerdrive/pkg/dev"
+)
+
+func TestOriginMatch(t *testing.T) {
+	asked := time.Date(2024, 5, 1, 10, 0, 0, 123456789, time.UTC)
+	for _, tt := range []struct {
+		name  string
+		mtime time.Time // the filesystem keeps
+		edit  string    // written after, empty for none
+		want  bool
+	}{
+		{"nanoseconds", asked, "", true},
+		{"coarse mtime", asked.Truncate(2 * time.Second), "", true},
+		{"edited", asked, "edited", false},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "a.txt")
+			data := []byte("content")
+			if err := os.WriteFile(path, data, 0644); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.Chtimes(path, tt.mtime, tt.mtime); err != nil {
+				t.Fatal(err)
+			}
+
+			ot := newOriginTracker()
+			ot.ExpectWrite("a.txt", dev.BytesHash(data), int64(len(data)), asked)
+			ot.Written(path, "a.txt")
+			if tt.edit != "" {
+				if err := os.WriteFile(path, []byte(tt.edit), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if got := ot.Match(path, "a.txt"); got != tt.want {
+				t.Errorf("match %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestOriginRemove(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "a.txt")
+	ot := newOriginTracker()
+	ot.ExpectRemove("a.txt")
+	if !ot.Match(path, "a.txt") {
+		t.Error("removed file not matched")
+	}
+	if err := os.WriteFile(path, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	ot.ExpectRemove("a.txt")
+	if ot.Match(path, "a.txt") || ot.Match(path, "a.txt") {
+		t.Error("file created again matched")
+	}
+}
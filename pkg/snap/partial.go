@@ -0,0 +1,296 @@
+package snap
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/gob"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/xerrors"
+
+	"github.com/threecorp/peerdrive/pkg/clock"
+	"github.com/threecorp/peerdrive/pkg/dev"
+	"github.com/threecorp/peerdrive/pkg/event"
+)
+
+// DefaultPartialAge is how long an untouched partial download is kept.
+const DefaultPartialAge = 24 * time.Hour
+
+const stateExt = ".state"
+
+// partial is a download in progress, kept in the sync folder's work area by
+// content hash so that any peer holding the same content can resume it.
+type partial struct {
+	Hash    string
+	Size    int64
+	Block   int64    // block size, sealed content has larger ones
+	Sums    [][]byte // verified against Hash
+	Listed  bool     // Sums are known, empty for an empty file
+	Have    []bool   // blocks written and verified against Sums
+	Updated time.Time
+
+	mu    sync.Mutex // blocks are written by several peers at once
+	path  string
+	clock clock.Clock
+}
+
+// partialLocks are the downloads in progress by content hash. Paths with
+// the same content share the partial of the hash, one at a time: the first
+// to commit moves the assembled file away from the others.
+type partialLocks struct {
+	mu   sync.Mutex
+	held map[string]chan struct{} // closed when released
+}
+
+func newPartialLocks() *partialLocks {
+	return &partialLocks{held: map[string]chan struct{}{}}
+}
+
+// lock waits until no other download works on hash or ctx is done, it
+// returns the release of the lock.
+func (pl *partialLocks) lock(ctx context.Context, hash string) (func(), error) {
+	for {
+		pl.mu.Lock()
+		released, busy := pl.held[hash]
+		if !busy {
+			released = make(chan struct{})
+			pl.held[hash] = released
+			pl.mu.Unlock()
+			return func() {
+				pl.mu.Lock()
+				delete(pl.held, hash)
+				pl.mu.Unlock()
+				close(released)
+			}, nil
+		}
+		pl.mu.Unlock()
+
+		select {
+		case <-released:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+func partialDir(syncDir string) string {
+	return filepath.Join(syncDir, dev.TempName, "partial")
+}
+
+// openPartial resumes or starts the download of hash in blocks of block,
+// zero is dev.BlockSize.
+func openPartial(syncDir, hash string, size, block int64, clk clock.Clock) (*partial, error) {
+	if block <= 0 {
+		block = dev.BlockSize
+	}
+	dir := partialDir(syncDir)
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		return nil, xerrors.Errorf("partial mkdirAll %s: %w", dir, err)
+	}
+	p := &partial{Hash: hash, Size: size, Block: block, path: filepath.Join(dir, hash), clock: clock.OrReal(clk)}
+
+	data, err := os.ReadFile(p.path + stateExt)
+	if os.IsNotExist(err) {
+		return p, nil
+	}
+	if err != nil {
+		return nil, xerrors.Errorf("partial state %s: %w", hash, err)
+	}
+	saved := &partial{}
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(saved); err != nil || saved.Size != size || saved.Block != block {
+		p.remove() // unreadable, start over
+		return p, nil
+	}
+	saved.path, saved.clock = p.path, p.clock
+	return saved, nil
+}
+
+func (p *partial) save() error {
+	p.Updated = p.clock.Now()
+
+	buf := bytes.NewBuffer(nil)
+	if err := gob.NewEncoder(buf).Encode(p); err != nil {
+		return xerrors.Errorf("partial encode: %w", err)
+	}
+	tmp := p.path + stateExt + ".tmp"
+	if err := os.WriteFile(tmp, buf.Bytes(), 0600); err != nil {
+		return xerrors.Errorf("partial save: %w", err)
+	}
+	return os.Rename(tmp, p.path+stateExt)
+}
+
+func (p *partial) remove() {
+	os.Remove(p.path)
+	os.Remove(p.path + stateExt)
+}
+
+func (p *partial) blockLen(i int) int64 {
+	if rest := p.Size - int64(i)*p.Block; rest < p.Block {
+		return rest
+	}
+	return p.Block
+}
+
+func (p *partial) missing() []int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	miss := []int{}
+	for i, ok := range p.Have {
+		if !ok {
+			miss = append(miss, i)
+		}
+	}
+	return miss
+}
+
+func (p *partial) done() int64 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	n := int64(0)
+	for i, ok := range p.Have {
+		if ok {
+			n += p.blockLen(i)
+		}
+	}
+	return n
+}
+
+func (p *partial) complete() bool {
+	return p.Listed && len(p.missing()) == 0
+}
+
+func (p *partial) setSums(sums [][]byte) error {
+	if dev.SumsHash(sums) != p.Hash {
+		return xerrors.Errorf("block list does not match %s", p.Hash)
+	}
+	if want := (p.Size + p.Block - 1) / p.Block; int64(len(sums)) != want {
+		return xerrors.Errorf("block list has %d blocks, want %d", len(sums), want)
+	}
+	p.Sums = sums
+	p.Listed = true
+	p.Have = make([]bool, len(sums))
+	return p.save()
+}
+
+func (p *partial) writeBlock(i int, data []byte) error {
+	if int64(len(data)) != p.blockLen(i) {
+		return xerrors.Errorf("block %d has %d bytes, want %d", i, len(data), p.blockLen(i))
+	}
+	if sum := sha256.Sum256(data); !bytes.Equal(sum[:], p.Sums[i]) {
+		return xerrors.Errorf("block %d does not match", i)
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	f, err := os.OpenFile(p.path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return xerrors.Errorf("partial open: %w", err)
+	}
+	defer f.Close()
+
+	if _, err := f.WriteAt(data, int64(i)*p.Block); err != nil {
+		return xerrors.Errorf("partial write block %d: %w", i, err)
+	}
+	p.Have[i] = true
+	return p.save()
+}
+
+// verify checks the assembled file against the content hash.
+func (p *partial) verify() error {
+	if p.Size == 0 {
+		if err := os.WriteFile(p.path, nil, 0600); err != nil {
+			return err
+		}
+	}
+	if hash, err := dev.FileHashOf(p.path, p.Block); err != nil || hash != p.Hash {
+		p.remove()
+		return xerrors.Errorf("assembled file does not match %s: %v", p.Hash, err)
+	}
+	return nil
+}
+
+// commit verifies the assembled file and moves it to dst.
+func (p *partial) commit(dst string, mtime time.Time) error {
+	if err := p.verify(); err != nil {
+		return err
+	}
+	if err := os.Chmod(p.path, 0644); err != nil {
+		return err
+	}
+	if err := os.Chtimes(p.path, p.clock.Now(), mtime); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(dst), 0750); err != nil {
+		return err
+	}
+	if err := os.Rename(p.path, dst); err != nil {
+		return err
+	}
+	os.Remove(p.path + stateExt)
+	return nil
+}
+
+// collectPartials runs GCPartials every hour until ctx is done.
+func (f *Folder) collectPartials(ctx context.Context) {
+	ticker := f.opts.Clock.NewTicker(time.Hour)
+	defer ticker.Stop()
+
+	for {
+		if err := GCPartials(f.Dir, f.opts.PartialAge, f.opts.Clock); err != nil {
+			f.log.Errorw("gc partials", "folder", f.Dir, "error", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C():
+		}
+	}
+}
+
+// GCPartials removes partial downloads untouched for longer than maxAge on
+// clk, nil is clock.Real.
+func GCPartials(syncDir string, maxAge time.Duration, clk clock.Clock) error {
+	before := clock.OrReal(clk).Now().Add(-maxAge)
+	dir := partialDir(syncDir)
+	ents, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return xerrors.Errorf("GCPartials(%s): %w", dir, err)
+	}
+
+	for _, ent := range ents {
+		base := filepath.Join(dir, strings.TrimSuffix(ent.Name(), stateExt))
+		if stale(base, before) && stale(base+stateExt, before) {
+			os.Remove(base)
+			os.Remove(base + stateExt)
+		}
+	}
+	return nil
+}
+
+// stale tells whether name is gone or untouched since before.
+func stale(name string, before time.Time) bool {
+	fi, err := os.Stat(name)
+	return err != nil || !fi.ModTime().After(before)
+}
+
+func roundTrip(stream io.ReadWriter, ev *event.Event) error {
+	if err := event.WriteStream(stream, ev); err != nil {
+		return xerrors.Errorf("error sending message: %w", err)
+	}
+	if err := event.ReadStream(stream, ev); err != nil {
+		return xerrors.Errorf("error reading message: %w", err)
+	}
+	return nil
+}
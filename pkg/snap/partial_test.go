@@ -0,0 +1,76 @@
+package snap
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/threecorp/peerdrive/pkg/clock"
+)
+
+func TestPartialLocks(t *testing.T) {
+	pl := newPartialLocks()
+	ctx := context.Background()
+
+	release, err := pl.lock(ctx, "x")
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := pl.lock(ctx, "y")
+	if err != nil {
+		t.Fatal(err)
+	}
+	other()
+
+	canceled, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	if _, err := pl.lock(canceled, "x"); err == nil {
+		t.Fatal("locked x twice")
+	}
+
+	locked := make(chan struct{})
+	go func() {
+		release, err := pl.lock(ctx, "x")
+		if err == nil {
+			release()
+		}
+		close(locked)
+	}()
+	select {
+	case <-locked:
+		t.Fatal("locked x before its release")
+	case <-time.After(10 * time.Millisecond):
+	}
+	release()
+	<-locked
+}
+
+// TestGCPartials removes the partials untouched for longer than the age on
+// the clock of the folder.
+func TestGCPartials(t *testing.T) {
+	dir := t.TempDir()
+	p, err := openPartial(dir, "hash", 1, 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.save(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		skew time.Duration
+		kept bool
+	}{
+		{0, true},
+		{DefaultPartialAge / 2, true},
+		{DefaultPartialAge + time.Hour, false},
+	} {
+		if err := GCPartials(dir, DefaultPartialAge, clock.Skewed(clock.Real, tt.skew)); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := os.Stat(p.path + stateExt); (err == nil) != tt.kept {
+			t.Errorf("%s later: state kept %v, want %v", tt.skew, err == nil, tt.kept)
+		}
+	}
+}
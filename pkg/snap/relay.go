@@ -0,0 +1,179 @@
+package snap
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"time"
+
+	"golang.org/x/xerrors"
+
+	"github.com/threecorp/peerdrive/pkg/dev"
+	"github.com/threecorp/peerdrive/pkg/event"
+)
+
+// A relay folder keeps what its peers publish as blobs named by content
+// hash in the work area, never as a readable tree, and publishes the state
+// it stored as its own snapshot so that peers can fetch from it while the
+// origin is offline. It only takes sealed content: the peers of a group
+// without a password would hand it plaintext.
+
+const blobsDir = "blobs"
+
+func blobPath(syncDir, hash string) string {
+	return filepath.Join(syncDir, dev.TempName, blobsDir, hash)
+}
+
+// source is the file on disk that serves relPath to peers.
+func (f *Folder) source(relPath string) (string, error) {
+	if f.crypt != nil {
+		name, err := f.crypt.openName(relPath)
+		if err != nil {
+			return "", err
+		}
+		relPath = name
+	}
+	if f.opts.Mode != Relay {
+		return (&event.Event{Path: relPath}).FullPath(f.Dir)
+	}
+	e, ok := f.Index.Get(relPath)
+	if !ok || e.Deleted {
+		return "", xerrors.Errorf("%s is not stored: %w", relPath, os.ErrNotExist)
+	}
+	return blobPath(f.Dir, e.Hash), nil
+}
+
+func (f *Folder) relayApply(ctx context.Context, snap *Snap) {
+	metas := make([]*Meta, 0, len(snap.Metas))
+	for _, m := range snap.Metas {
+		if m.Block == sealedBlock { // set on every sealed meta
+			metas = append(metas, m)
+		}
+	}
+	if dropped := len(snap.Metas) - len(metas); dropped > 0 {
+		f.log.Warnw("relay refuses unsealed paths, the folder needs a password", "folder", f.Dir, "peer", snap.PeerID, "paths", dropped)
+	}
+
+	diff := calcDiff(f.Index.Entries(), metas)
+	for _, meta := range append(diff.Adds, diff.Modifies...) {
+		if meta.IsDir || f.opts.Ignore.Match(meta.Path) {
+			continue
+		}
+		f.Transfers.Push(meta.Path, snap.PeerID, meta.Size, meta)
+	}
+	if len(diff.Deletes)+len(diff.Tombs) == 0 {
+		return
+	}
+
+	if err := f.locker.Acquire(ctx, 1); err != nil {
+		f.log.Errorw("locker acquire", "error", err)
+		return
+	}
+	defer f.locker.Release(1)
+
+	for _, meta := range append(diff.Deletes, diff.Tombs...) {
+		if err := f.Index.Stored(ctx, meta.Entry()); err != nil {
+			f.log.Errorw("index stored", "folder", f.Dir, "path", meta.Path, "error", err)
+		}
+	}
+	if err := f.gcBlobs(); err != nil {
+		f.log.Errorw("relay blobs", "folder", f.Dir, "error", err)
+	}
+	f.notifyStored()
+}
+
+// store moves a completed download into the blobs, content already held
+// for another path is only recorded.
+func (f *Folder) store(ctx context.Context, pt *partial, meta *Meta) error {
+	if err := f.locker.Acquire(ctx, 1); err != nil {
+		return xerrors.Errorf("locker.Acquire: %w", err)
+	}
+	defer f.locker.Release(1)
+
+	if pt != nil {
+		dst := blobPath(f.Dir, meta.Hash)
+		if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+			return xerrors.Errorf("blobs dir: %w", err)
+		}
+		if err := pt.commit(dst, meta.Time); err != nil {
+			return xerrors.Errorf("commit %s: %w", meta.Path, err)
+		}
+	}
+	if err := f.Index.Stored(ctx, meta.Entry()); err != nil {
+		return xerrors.Errorf("index stored: %w", err)
+	}
+	if err := f.gcBlobs(); err != nil {
+		f.log.Errorw("relay blobs", "folder", f.Dir, "error", err)
+	}
+	f.notifyStored()
+	return nil
+}
+
+func (f *Folder) notifyStored() {
+	select {
+	case f.stored <- struct{}{}:
+	default:
+	}
+}
+
+// gcBlobs removes the blobs no stored path refers to anymore.
+func (f *Folder) gcBlobs() error {
+	keep := map[string]bool{}
+	for _, e := range f.Index.Entries() {
+		if !e.Deleted {
+			keep[e.Hash] = true
+		}
+	}
+
+	dir := filepath.Join(f.Dir, dev.TempName, blobsDir)
+	des, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, de := range des {
+		if keep[de.Name()] {
+			continue
+		}
+		if err := os.Remove(filepath.Join(dir, de.Name())); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// relayLoop publishes what the relay stored, once it calmed down.
+func (f *Folder) relayLoop(ctx context.Context, rescan <-chan struct{}) {
+	timer := f.opts.Clock.NewTimer(f.opts.Settle)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-rescan:
+			timer.Reset(0)
+		case <-f.rescans:
+			timer.Reset(0)
+		case <-f.stored:
+			timer.Reset(f.opts.Settle)
+		case <-timer.C():
+			if f.Paused() {
+				continue // published by the Rescan of Resume
+			}
+			err := f.snapsnap(ctx)
+			if xerrors.Is(err, errBusy) {
+				timer.Reset(f.opts.Settle)
+				continue
+			}
+			if err != nil {
+				f.Health.Fail("send snapshot", err)
+				timer.Reset(time.Second)
+				continue
+			}
+			f.Health.OK()
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package snap
+
+import (
+	"context"
+	"os"
+
+	"golang.org/x/xerrors"
+
+	"github.com/threecorp/peerdrive/pkg/event"
+	"github.com/threecorp/peerdrive/pkg/index"
+)
+
+// LocalChanges counts the files changed locally in a receive-only folder.
+func (f *Folder) LocalChanges() int {
+	n := 0
+	for _, e := range f.Index.Entries() {
+		if e.Local {
+			n++
+		}
+	}
+	return n
+}
+
+// Revert drops the local changes of a receive-only folder. Changed and
+// removed files are fetched again from peers, added ones are removed. It
+// returns how many files it reverted.
+func (f *Folder) Revert(ctx context.Context) (int, error) {
+	if f.opts.Mode != ReceiveOnly {
+		return 0, xerrors.Errorf("%s is %s, not %s", f.Dir, f.opts.Mode, ReceiveOnly)
+	}
+
+	if err := f.locker.Acquire(ctx, 1); err != nil {
+		return 0, xerrors.Errorf("locker.Acquire: %w", err)
+	}
+	defer f.locker.Release(1)
+
+	if err := f.reconcile(ctx); err != nil {
+		return 0, xerrors.Errorf("reconcile: %w", err)
+	}
+
+	n := 0
+	for _, e := range f.Index.Entries() {
+		if !e.Local {
+			continue
+		}
+		meta, from := f.holders.Latest(e.Path, f.Group.Peers())
+		if meta != nil && !meta.Deleted {
+			f.Transfers.Push(meta.Path, from, meta.Size, meta)
+			n++
+			continue
+		}
+
+		// Added locally, or removed by peers meanwhile
+		ev := &event.Event{Op: event.Remove, Path: e.Path}
+		if !e.Deleted {
+			f.origins.ExpectRemove(ev.Path)
+			if err := f.remove(ev); err != nil && !xerrors.Is(err, os.ErrNotExist) {
+				f.origins.Forget(ev.Path)
+				return n, xerrors.Errorf("revert %s: %w", e.Path, err)
+			}
+		}
+		tomb := &index.Entry{Path: e.Path, Hash: e.Hash, Version: e.Version, Deleted: true}
+		if meta != nil {
+			tomb.Version = meta.Version
+		}
+		if err := f.Index.Applied(ctx, f.Dir, tomb); err != nil {
+			return n, xerrors.Errorf("index applied: %w", err)
+		}
+		f.disp.Recver(ev)
+		n++
+	}
+	return n, nil
+}
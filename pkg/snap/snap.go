@@ -3,15 +3,15 @@ package snap
 import (
 	"bytes"
 	"encoding/gob"
-	"os"
 	"path/filepath"
 	"time"
 
 	"golang.org/x/xerrors"
 
 	"github.com/ipfs/go-datastore"
+	"github.com/libp2p/go-libp2p/core/crypto"
 	"github.com/libp2p/go-libp2p/core/peer"
-	"github.com/threecorp/peerdrive/pkg/dev"
+	"github.com/threecorp/peerdrive/pkg/index"
 )
 
 const (
@@ -20,33 +20,78 @@ const (
 
 var (
 	SnapKey = datastore.NewKey(SnapName)
+	SeqKey  = datastore.NewKey("seq") // of the group store, local only
 )
 
+// PeerSnapKey is where id publishes its snapshot. Peers sharing one key
+// would only ever see the snapshot winning the CRDT merge.
+func PeerSnapKey(id peer.ID) datastore.Key {
+	return SnapKey.ChildString(id.String())
+}
+
+// PeerSeqKey is where the highest Seq held of id is kept, beneath the local
+// store of group, so that a restart still drops a replay.
+func PeerSeqKey(group string, id peer.ID) datastore.Key {
+	return SeqKey.ChildString(group).ChildString(id.String())
+}
+
 type (
 	Meta struct {
-		Path  string
-		Name  string
-		Size  int64
-		Time  time.Time
-		IsDir bool
+		Path    string
+		Name    string
+		Size    int64
+		Time    time.Time
+		IsDir   bool
+		Hash    string
+		Block   int64 // zero is dev.BlockSize
+		Version index.Vector
+		Deleted bool
 	}
 	Diff struct {
-		Adds     []*Meta
-		Deletes  []*Meta
-		Modifies []*Meta
+		Adds      []*Meta
+		Deletes   []*Meta
+		Modifies  []*Meta
+		Conflicts []*Meta // concurrent edits that replace the local ones
+		Tombs     []*Meta // deletions of files never seen here, only recorded
 	}
 	Snap struct {
 		PeerID peer.ID
+		Seq    uint64 // grows with every snapshot of the peer, signed with it
 		Metas  []*Meta
 	}
+	// Signed is a snapshot as stored in the CRDT, signed by its author so
+	// that nobody else can publish in its name, nor put an older one again:
+	// peers drop those whose Seq isn't above the one they hold.
+	Signed struct {
+		Data   []byte // Snap
+		PubKey []byte // peer IDs don't always embed it
+		Sig    []byte
+	}
 )
 
-func Snapshot(peerID peer.ID, dir string) (*Snap, error) {
-	metas, err := makeMetas(dir)
-	if err != nil {
-		return nil, xerrors.Errorf("Snapshot(%s): %w", dir, err)
+var (
+	ErrUnsigned = xerrors.New("snapshot is not signed")
+	ErrForged   = xerrors.New("snapshot signature does not match its peer")
+	ErrReplayed = xerrors.New("snapshot is not newer than the one held")
+)
+
+// Snapshot publishes the index entries, tombstones included, so that peers
+// can tell a deleted file from one they have not received yet.
+func Snapshot(peerID peer.ID, entries []*index.Entry) *Snap {
+	metas := make([]*Meta, 0, len(entries))
+	for _, e := range entries {
+		metas = append(metas, &Meta{
+			Path:    e.Path,
+			Name:    filepath.Base(e.Path),
+			Size:    e.Size,
+			Time:    e.MTime,
+			Hash:    e.Hash,
+			Block:   e.Block,
+			Version: e.Version,
+			Deleted: e.Deleted,
+		})
 	}
-	return &Snap{PeerID: peerID, Metas: metas}, nil
+	return &Snap{PeerID: peerID, Metas: metas}
 }
 
 func Restore(data []byte) (*Snap, error) {
@@ -57,12 +102,60 @@ func Restore(data []byte) (*Snap, error) {
 	return snap, nil
 }
 
-func (s *Snap) Difference(dir string) (*Diff, error) {
-	locals, err := makeMetas(dir)
+func (s *Snap) Difference(idx *index.Index) *Diff {
+	return calcDiff(idx.Entries(), s.Metas)
+}
+
+func signedPayload(group string, data []byte) []byte {
+	return append([]byte("peerdrive snap "+group+"\n"), data...)
+}
+
+// Sign encodes the snapshot signed for the group with key, the private key
+// of s.PeerID.
+func (s *Snap) Sign(group string, key crypto.PrivKey) ([]byte, error) {
+	data, err := s.Marshal()
+	if err != nil {
+		return nil, err
+	}
+	pub, err := crypto.MarshalPublicKey(key.GetPublic())
+	if err != nil {
+		return nil, err
+	}
+	sig, err := key.Sign(signedPayload(group, data))
+	if err != nil {
+		return nil, xerrors.Errorf("snapshot sign: %w", err)
+	}
+
+	buf := bytes.NewBuffer(nil)
+	if err := gob.NewEncoder(buf).Encode(&Signed{Data: data, PubKey: pub, Sig: sig}); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Verify decodes a snapshot signed for the group, and checks it against the
+// peer it claims to be from.
+func Verify(group string, data []byte) (*Snap, error) {
+	signed := &Signed{}
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(signed); err != nil || len(signed.Sig) == 0 {
+		return nil, ErrUnsigned
+	}
+	snap, err := Restore(signed.Data)
+	if err != nil {
+		return nil, err
+	}
+
+	pub, err := crypto.UnmarshalPublicKey(signed.PubKey)
 	if err != nil {
-		return nil, xerrors.Errorf("Difference(%s): %w", dir, err)
+		return nil, ErrForged
+	}
+	if id, err := peer.IDFromPublicKey(pub); err != nil || id != snap.PeerID {
+		return nil, ErrForged
 	}
-	return calcDiff(locals, s.Metas), nil
+	if ok, err := pub.Verify(signedPayload(group, signed.Data), signed.Sig); err != nil || !ok {
+		return nil, ErrForged
+	}
+	return snap, nil
 }
 
 // Marshal encodes the Meta object into a byte slice using gob
@@ -79,75 +172,70 @@ func (s *Snap) Unmarshal(data []byte) error {
 	return gob.NewDecoder(bytes.NewBuffer(data)).Decode(&s)
 }
 
-func makeMetas(dir string) ([]*Meta, error) {
-	metas := []*Meta{}
-
-	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
-		if err != nil {
-			return err
-		}
-		for _, ig := range dev.IgnoreNames {
-			if info.IsDir() && info.Name() == ig {
-				return filepath.SkipDir
-			}
-		}
-		if !info.IsDir() && info.Name() == dev.PrivateKeyName {
-			return nil
-		}
-
-		metas = append(metas, &Meta{
-			Path:  dev.RelativePath(dir, path),
-			Name:  info.Name(),
-			Size:  info.Size(),
-			Time:  info.ModTime(),
-			IsDir: info.IsDir(),
-		})
-
-		return nil
-	})
-	if err != nil {
-		return nil, err
-	}
-
-	return metas, nil
+func (m *Meta) Entry() *index.Entry {
+	return &index.Entry{Path: m.Path, Size: m.Size, MTime: m.Time, Hash: m.Hash, Block: m.Block, Version: m.Version, Deleted: m.Deleted}
 }
 
-func calcDiff(local, remote []*Meta) *Diff {
-	lmap := make(map[string]*Meta)
-	rmap := make(map[string]*Meta)
-
-	for _, snap := range local {
-		if !snap.IsDir {
-			lmap[snap.Path] = snap
-		}
-	}
-	for _, snap := range remote {
-		if !snap.IsDir {
-			rmap[snap.Path] = snap
-		}
+// calcDiff decides by version vectors which remote metas win over the local
+// index. Of concurrent edits, the one every peer picks by wins is applied, the
+// losing side keeps its own as a conflict copy.
+func calcDiff(local []*index.Entry, remote []*Meta) *Diff {
+	lmap := make(map[string]*index.Entry)
+	for _, e := range local {
+		lmap[e.Path] = e
 	}
 
 	diff := &Diff{}
-	for path, lsnap := range lmap {
-		rsnap, ok := rmap[path]
+	for _, rsnap := range remote {
+		if rsnap.IsDir {
+			continue
+		}
+		lsnap, ok := lmap[rsnap.Path]
 
 		if !ok {
-			// fmt.Printf("Delete: L:%+v\nDelete: R:%+v\n", lsnap, rsnap)
-			diff.Deletes = append(diff.Deletes, lsnap)
-		} else if lsnap.Size != rsnap.Size {
-			// fmt.Printf("ModSize: L:%+v\nModSize: R:%+v\n", lsnap, rsnap)
-			diff.Modifies = append(diff.Modifies, lsnap)
-		} else if lsnap.Time.UnixNano() < rsnap.Time.UnixNano() {
-			// fmt.Printf("ModTime: L:%+v\nModTime: R:%+v\n", lsnap, rsnap)
-			diff.Modifies = append(diff.Modifies, lsnap)
+			if rsnap.Deleted {
+				diff.Tombs = append(diff.Tombs, rsnap) // outdates older snapshots of the file
+			} else {
+				diff.Adds = append(diff.Adds, rsnap)
+			}
+			continue
+		}
+		if lsnap.Deleted == rsnap.Deleted && (lsnap.Deleted || lsnap.Hash == rsnap.Hash) {
+			continue
+		}
+
+		switch rsnap.Version.Compare(lsnap.Version) {
+		case index.After:
+		case index.Concurrent:
+			if !wins(rsnap, lsnap) {
+				continue
+			}
+			diff.Conflicts = append(diff.Conflicts, rsnap)
+		default:
+			continue
 		}
-	}
 
-	for path, rsnap := range rmap {
-		if _, ok := lmap[path]; !ok {
+		switch {
+		case rsnap.Deleted:
+			diff.Deletes = append(diff.Deletes, rsnap)
+		case lsnap.Deleted:
 			diff.Adds = append(diff.Adds, rsnap)
+		default:
+			diff.Modifies = append(diff.Modifies, rsnap)
 		}
 	}
 
 	return diff
 }
+
+// wins orders concurrent edits the same way on every peer: an edit beats a
+// deletion, then the newer mtime, then the greater hash.
+func wins(r *Meta, l *index.Entry) bool {
+	if r.Deleted != l.Deleted {
+		return l.Deleted
+	}
+	if !r.Time.Equal(l.MTime) {
+		return r.Time.After(l.MTime)
+	}
+	return r.Hash > l.Hash
+}
@@ -0,0 +1,184 @@
+package snap
+
+import (
+	"bytes"
+	"encoding/gob"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"golang.org/x/xerrors"
+
+	"github.com/threecorp/peerdrive/pkg/index"
+)
+
+func TestCalcDiff(t *testing.T) {
+	early := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+	late := early.Add(time.Minute)
+	local := func(hash string, v index.Vector, mtime time.Time, deleted bool) *index.Entry {
+		return &index.Entry{Path: "a.txt", Hash: hash, Version: v, MTime: mtime, Deleted: deleted}
+	}
+	remote := func(hash string, v index.Vector, mtime time.Time, deleted bool) *Meta {
+		return &Meta{Path: "a.txt", Hash: hash, Version: v, Time: mtime, Deleted: deleted}
+	}
+	a1, a2 := index.Vector{"a": 1}, index.Vector{"a": 2}
+	ab, ba := index.Vector{"a": 2, "b": 1}, index.Vector{"a": 1, "b": 2}
+
+	for _, tt := range []struct {
+		name   string
+		local  *index.Entry // nil when unknown here
+		remote *Meta
+		want   string // of the Diff, empty for none
+	}{
+		{"new file", nil, remote("x", a1, early, false), "Adds"},
+		{"new tombstone", nil, remote("x", a1, early, true), "Tombs"},
+		{"directory", nil, &Meta{Path: "a", IsDir: true, Version: a1}, ""},
+		{"same content", local("x", a1, early, false), remote("x", a2, late, false), ""},
+		{"both deleted", local("x", a1, early, true), remote("y", a2, late, true), ""},
+		{"newer", local("x", a1, early, false), remote("y", a2, early, false), "Modifies"},
+		{"older", local("y", a2, early, false), remote("x", a1, late, false), ""},
+		{"equal version", local("x", a1, early, false), remote("y", a1, late, false), ""},
+		{"newer deletion", local("x", a1, early, false), remote("x", a2, late, true), "Deletes"},
+		{"newer than deletion", local("x", a1, early, true), remote("y", a2, early, false), "Adds"},
+		{"concurrent newer mtime", local("x", ab, early, false), remote("y", ba, late, false), "Conflicts Modifies"},
+		{"concurrent older mtime", local("x", ab, late, false), remote("y", ba, early, false), ""},
+		{"concurrent greater hash", local("x", ab, early, false), remote("y", ba, early, false), "Conflicts Modifies"},
+		{"concurrent lesser hash", local("y", ab, early, false), remote("x", ba, early, false), ""},
+		{"concurrent edit over deletion", local("x", ab, late, true), remote("y", ba, early, false), "Conflicts Adds"},
+		{"concurrent deletion over edit", local("x", ab, early, false), remote("x", ba, late, true), ""},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			ls := []*index.Entry{}
+			if tt.local != nil {
+				ls = append(ls, tt.local)
+			}
+			diff := calcDiff(ls, []*Meta{tt.remote})
+
+			got := ""
+			for _, part := range []struct {
+				name  string
+				metas []*Meta
+			}{
+				{"Conflicts", diff.Conflicts},
+				{"Adds", diff.Adds},
+				{"Deletes", diff.Deletes},
+				{"Modifies", diff.Modifies},
+				{"Tombs", diff.Tombs},
+			} {
+				if len(part.metas) == 0 {
+					continue
+				}
+				if !reflect.DeepEqual(part.metas, []*Meta{tt.remote}) {
+					t.Errorf("%s %v", part.name, part.metas)
+				}
+				if got != "" {
+					got += " "
+				}
+				got += part.name
+			}
+			if got != tt.want {
+				t.Errorf("diff %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// TestWins checks every peer picks the same of two concurrent edits,
+// whichever side it holds.
+func TestWins(t *testing.T) {
+	early := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+	metas := []*Meta{
+		{Hash: "x", Time: early},
+		{Hash: "y", Time: early},
+		{Hash: "x", Time: early.Add(time.Second)},
+		{Hash: "x", Time: early.Add(time.Second), Deleted: true},
+	}
+	for i, r := range metas {
+		for j, l := range metas {
+			if i == j {
+				continue
+			}
+			if wins(r, l.Entry()) == wins(l, r.Entry()) {
+				t.Errorf("%d and %d both win or lose", i, j)
+			}
+		}
+	}
+}
+
+// TestSign has snapshots changed after they were signed, which don't verify.
+func TestSign(t *testing.T) {
+	key, _, err := crypto.GenerateEd25519Key(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, _, err := crypto.GenerateEd25519Key(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := peer.IDFromPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Snap{PeerID: id, Seq: 7, Metas: []*Meta{{Path: "a.txt", Hash: "h"}}}
+
+	// resigned is s signed with key after edit
+	resigned := func(edit func(s *Snap, signed *Signed)) []byte {
+		data, err := s.Sign("group", key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		signed := &Signed{}
+		if err := gob.NewDecoder(bytes.NewReader(data)).Decode(signed); err != nil {
+			t.Fatal(err)
+		}
+		c, err := Restore(signed.Data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		edit(c, signed)
+		if signed.Data, err = c.Marshal(); err != nil {
+			t.Fatal(err)
+		}
+		buf := bytes.NewBuffer(nil)
+		if err := gob.NewEncoder(buf).Encode(signed); err != nil {
+			t.Fatal(err)
+		}
+		return buf.Bytes()
+	}
+	otherPub, err := crypto.MarshalPublicKey(other.GetPublic())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		name  string
+		group string
+		data  []byte
+		want  error // nil when verified
+	}{
+		{"signed", "group", resigned(func(*Snap, *Signed) {}), nil},
+		{"other group", "other", resigned(func(*Snap, *Signed) {}), ErrForged},
+		{"seq", "group", resigned(func(s *Snap, _ *Signed) { s.Seq++ }), ErrForged},
+		{"metas", "group", resigned(func(s *Snap, _ *Signed) { s.Metas[0].Hash = "x" }), ErrForged},
+		{"other key", "group", resigned(func(_ *Snap, signed *Signed) { signed.PubKey = otherPub }), ErrForged},
+		{"unsigned", "group", resigned(func(_ *Snap, signed *Signed) { signed.Sig = nil }), ErrUnsigned},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Verify(tt.group, tt.data)
+			if tt.want != nil {
+				if !xerrors.Is(err, tt.want) {
+					t.Errorf("error %v, want %v", err, tt.want)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.PeerID != id || got.Seq != s.Seq || len(got.Metas) != 1 {
+				t.Errorf("verified %+v", got)
+			}
+		})
+	}
+}
@@ -0,0 +1,174 @@
+package snap
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"go.uber.org/multierr"
+	"golang.org/x/xerrors"
+
+	"github.com/threecorp/peerdrive/pkg/clock"
+	"github.com/threecorp/peerdrive/pkg/event"
+)
+
+const (
+	blockTimeout = 30 * time.Second
+	// A peer is dropped once it measured slower than the fastest one by
+	// slowFactor, after slowBlocks blocks.
+	slowFactor = 4
+	slowBlocks = 3
+)
+
+// swarm spreads the missing blocks of a partial download over every peer
+// holding the content. Each block is verified before it is written, a block
+// that failed goes back to the others.
+type swarm struct {
+	mu    sync.Mutex
+	p     *partial
+	todo  []int
+	rates map[peer.ID]float64 // bytes per second
+	count map[peer.ID]int
+	errs  error
+}
+
+// openStream opens a snap stream to a peer.
+type openStream func(ctx context.Context, id peer.ID) (network.Stream, error)
+
+// swarm downloads the missing blocks from the holders, each at its path.
+func (p *partial) swarm(ctx context.Context, open openStream, holders []holder, progress func(int64)) error {
+	streams := map[holder]network.Stream{}
+	defer func() {
+		for _, s := range streams {
+			s.Close()
+		}
+	}()
+
+	sw := &swarm{p: p, rates: map[peer.ID]float64{}, count: map[peer.ID]int{}}
+	for _, hd := range holders {
+		id := hd.ID
+		s, err := open(ctx, id)
+		if err != nil {
+			sw.errs = multierr.Append(sw.errs, xerrors.Errorf("%s stream open failed: %w", id, err))
+			continue
+		}
+		if !p.Listed {
+			ev := &event.Event{Op: event.Sums, Path: hd.Path}
+			if err := roundTrip(s, ev); err != nil {
+				s.Close()
+				sw.errs = multierr.Append(sw.errs, xerrors.Errorf("%s sums: %w", id, err))
+				continue
+			}
+			if err := p.setSums(ev.Sums); err != nil {
+				s.Close()
+				sw.errs = multierr.Append(sw.errs, xerrors.Errorf("%s sums: %w", id, err))
+				continue
+			}
+		}
+		streams[hd] = s
+	}
+	if !p.Listed {
+		return xerrors.Errorf("no block list: %w", sw.errs)
+	}
+
+	sw.todo = p.missing()
+	wg := sync.WaitGroup{}
+	for hd, s := range streams {
+		wg.Add(1)
+		go func(hd holder, s network.Stream) {
+			defer wg.Done()
+			sw.work(ctx, hd.ID, s, hd.Path, progress)
+		}(hd, s)
+	}
+	wg.Wait()
+
+	if !p.complete() {
+		return xerrors.Errorf("%d blocks missing: %w", len(p.missing()), sw.errs)
+	}
+	return nil
+}
+
+func (sw *swarm) work(ctx context.Context, id peer.ID, s network.Stream, relPath string, progress func(int64)) {
+	for {
+		i, ok := sw.take()
+		if !ok || ctx.Err() != nil {
+			if ok {
+				sw.putBack(i)
+			}
+			return
+		}
+
+		start := sw.p.clock.Now()
+		s.SetDeadline(time.Now().Add(blockTimeout)) // of the network, never skewed
+		ev := &event.Event{Op: event.Read, Path: relPath, Offset: int64(i) * sw.p.Block, Length: sw.p.blockLen(i)}
+		err := roundTrip(s, ev)
+		if err == nil {
+			err = sw.p.writeBlock(i, ev.Data)
+		}
+		if err != nil {
+			sw.putBack(i)
+			sw.fail(id, xerrors.Errorf("%s block %d: %w", id, i, err))
+			return
+		}
+		progress(sw.p.done())
+
+		if sw.measure(id, len(ev.Data), clock.Since(sw.p.clock, start)) {
+			sw.fail(id, xerrors.Errorf("%s dropped, too slow", id))
+			return
+		}
+	}
+}
+
+func (sw *swarm) take() (int, bool) {
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+
+	if len(sw.todo) == 0 {
+		return 0, false
+	}
+	i := sw.todo[0]
+	sw.todo = sw.todo[1:]
+	return i, true
+}
+
+func (sw *swarm) putBack(i int) {
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+
+	sw.todo = append(sw.todo, i)
+}
+
+func (sw *swarm) fail(id peer.ID, err error) {
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+
+	delete(sw.rates, id)
+	sw.errs = multierr.Append(sw.errs, err)
+}
+
+// measure records the rate of id and tells whether it fell so far behind
+// the fastest peer that it should stop. The last peer left is never dropped.
+func (sw *swarm) measure(id peer.ID, n int, d time.Duration) bool {
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+
+	rate := float64(n) / d.Seconds()
+	if prev, ok := sw.rates[id]; ok {
+		rate = 0.7*prev + 0.3*rate
+	}
+	sw.rates[id] = rate
+	sw.count[id]++
+
+	if sw.count[id] < slowBlocks {
+		return false
+	}
+	fastest := 0.0
+	for other, r := range sw.rates {
+		if other != id && r > fastest {
+			fastest = r
+		}
+	}
+	return rate*slowFactor < fastest
+}
@@ -2,34 +2,46 @@ package snap
 
 import (
 	"context"
-	"fmt"
+	"encoding/binary"
 	"io"
-	"log"
-	"strings"
+	"os"
+	"path/filepath"
 	"time"
 
+	"github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
 	"github.com/libp2p/go-libp2p/core/network"
-	"github.com/rjeczalik/notify"
+	"github.com/libp2p/go-libp2p/core/peer"
 	"github.com/samber/lo"
 
-	"golang.org/x/sync/semaphore"
 	"golang.org/x/xerrors"
 
+	"github.com/threecorp/peerdrive/pkg/bus"
 	"github.com/threecorp/peerdrive/pkg/dev"
 	"github.com/threecorp/peerdrive/pkg/event"
-	"github.com/threecorp/peerdrive/pkg/p2p"
+	"github.com/threecorp/peerdrive/pkg/index"
+	"github.com/threecorp/peerdrive/pkg/metrics"
+	"github.com/threecorp/peerdrive/pkg/retry"
+	"github.com/threecorp/peerdrive/pkg/watch"
 )
 
-const Protocol = "/peerdrive/snap/1.0.0"
+// Protocol is the prefix of the protocols of the folders, each speaks its
+// own beneath it by group ID. Nodes of 1.0.0 shared a single folder on the
+// bare prefix and published unsigned snapshots, they do not sync with this
+// version.
+const Protocol = "/peerdrive/snap/2.0.0"
 
-var (
-	syncs   = &dev.SafeSlice[string]{} // TODO: remove someday
-	recvs   = &dev.SafeSlice[string]{} // TODO: remove someday
-	locker  = semaphore.NewWeighted(1)
-	errBusy = xerrors.New("busy locker")
-)
+// settle is how long the watcher waits for a burst of events to calm down
+// before a snapshot is taken.
+const settle = 300 * time.Millisecond
+
+// onlineInterval is how often the peers are checked for one connected since,
+// whose last snapshot is applied then.
+const onlineInterval = time.Second
+
+var errBusy = xerrors.New("busy locker")
 
-func RWHandler(nd *p2p.Node) func(stream network.Stream) {
+func (f *Folder) RWHandler() func(stream network.Stream) {
 	return func(stream network.Stream) {
 		defer stream.Close()
 		peerID := stream.Conn().RemotePeer()
@@ -42,230 +54,540 @@ func RWHandler(nd *p2p.Node) func(stream network.Stream) {
 				return
 			}
 			if err != nil {
-				log.Printf("%s error read message from stream: %+v", peerID, err)
+				f.log.Warnw("read message from stream", "peer", peerID, "error", err)
+				return
+			}
+
+			name, err := f.source(ev.Path)
+			if err != nil {
+				f.log.Warnw("source from stream", "peer", peerID, "error", err)
 				return
 			}
 
 			switch ev.Op {
 			case event.Read:
-				if err := ev.Read(); err != nil {
-					log.Printf("%s error read event from stream: %+v", peerID, err)
+				if err := f.read(ev, name); err != nil {
+					f.log.Warnw("read event from stream", "peer", peerID, "error", err)
 					return
 				}
-				event.DispRecver(ev)
+				if ev.Offset == 0 {
+					f.disp.Recver(ev)
+					metrics.SentFiles.WithLabelValues(peerID.String()).Inc()
+				}
 				if err := event.WriteStream(stream, ev); err != nil {
-					log.Printf("%s error write event to stream: %+v", peerID, err)
+					f.log.Warnw("write event to stream", "peer", peerID, "error", err)
+					return
+				}
+			case event.Sums:
+				if err := f.readSums(ev, name); err != nil {
+					f.log.Warnw("sums event from stream", "peer", peerID, "error", err)
+					return
+				}
+				if err := event.WriteStream(stream, ev); err != nil {
+					f.log.Warnw("write event to stream", "peer", peerID, "error", err)
 					return
 				}
 			default:
-				log.Printf("%s operator is not supported: %s ", peerID, ev.Op)
+				f.log.Warnw("operator is not supported", "peer", peerID, "op", ev.Op)
 				return
 			}
 		}
 	}
 }
 
-func WriteHandler(nd *p2p.Node) func(stream network.Stream) {
-	return func(stream network.Stream) {
-		defer stream.Close()
-		peerID := stream.Conn().RemotePeer()
+// read answers a Read of ev.Path from name.
+func (f *Folder) read(ev *event.Event, name string) error {
+	if f.crypt != nil {
+		return f.crypt.readEvent(ev, name)
+	}
+	return ev.ReadFile(name)
+}
 
-		for {
-			ev := &event.Event{}
+// readSums answers a Sums of ev.Path from name, a relay's blob is in the
+// blocks of whoever sealed it.
+func (f *Folder) readSums(ev *event.Event, name string) error {
+	switch {
+	case f.crypt != nil:
+		return f.crypt.sumsEvent(ev, name)
+	case f.opts.Mode == Relay:
+		e, ok := f.Index.Get(ev.Path)
+		if !ok || e.Block <= 0 {
+			return ev.ReadSumsFile(name, dev.BlockSize)
+		}
+		return ev.ReadSumsFile(name, e.Block)
+	default:
+		return ev.ReadSumsFile(name, dev.BlockSize)
+	}
+}
 
-			err := event.ReadStream(stream, ev)
-			if err != nil && xerrors.Is(err, io.EOF) {
-				return
-			}
-			if ev == nil {
-				log.Printf("%s error read message from stream: %+v", peerID, err)
-				return
-			}
+// SnapWatcher applies the snapshots of peers until ctx is done, first the
+// last one stored of each, then each one put. The last one of a peer is
+// applied again whenever it connects, and after a transfer failed for good,
+// so that what was cut off is fetched again. A paused folder applies them
+// once resumed.
+func (f *Folder) SnapWatcher(ctx context.Context) {
+	g := f.Group
+	ticker := f.opts.Clock.NewTicker(onlineInterval)
+	defer ticker.Stop()
+
+	// put while stopped, or applied by a run stopped midway
+	ps := &peerSnaps{last: map[peer.ID]*Snap{}, online: map[peer.ID]bool{}}
+	seqs, err := f.storedSeqs(ctx)
+	if err != nil {
+		f.log.Errorw("stored seqs", "folder", f.Dir, "error", err)
+	}
+	ps.seqs = seqs
+	f.published(seqs[g.Host.ID()])
+	stored, err := f.storedSnaps(ctx)
+	if err != nil {
+		f.log.Errorw("stored snapshots", "folder", f.Dir, "error", err)
+	}
+	for _, data := range stored {
+		f.receiveSnap(ctx, data, ps)
+	}
 
-			recvs.Append(ev.Path)
-			switch ev.Op {
-			case event.Write:
-				err = ev.Write()
-				event.DispRecver(ev)
-			case event.Remove:
-				err = ev.Remove()
-				event.DispRecver(ev)
-			default:
-				log.Printf("%s operator is not supported: %s ", peerID, ev.Op)
-				return
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C():
+			if f.Paused() {
+				ps.paused = true
+				continue
 			}
-			time.AfterFunc(time.Second, func() { recvs.Remove(ev.Path) })
-			if err != nil {
-				log.Printf("%s error operate message from stream: %+v", peerID, err)
-				return
+			resumed := ps.paused
+			ps.paused = false
+			gaveUp := f.Transfers.GaveUp()
+			for id, snap := range ps.last {
+				online := g.Member(id)
+				if online && (!ps.online[id] || gaveUp > ps.gaveUp || resumed) {
+					f.applySnap(ctx, snap)
+				}
+				ps.online[id] = online
 			}
+			ps.gaveUp = gaveUp
+		case kv := <-g.DSPutCh:
+			f.receiveSnap(ctx, kv.B, ps)
 		}
 	}
 }
 
-func SnapWatcher(nd *p2p.Node, syncDir string) {
-	for {
-		kv := <-nd.DSPutCh
-		snap, err := Restore(kv.B)
-		if err != nil {
-			log.Printf("restore(snap) failed: %+v\n", err)
+// peerSnaps are the last snapshots of peers, the highest Seq held of each
+// across restarts, whether each peer was connected, how many transfers had
+// failed and whether the folder was paused at the last check.
+type peerSnaps struct {
+	last   map[peer.ID]*Snap
+	seqs   map[peer.ID]uint64
+	online map[peer.ID]bool
+	gaveUp int
+	paused bool
+}
+
+// storedSeqs are the highest Seq held of every peer, this one included.
+func (f *Folder) storedSeqs(ctx context.Context) (map[peer.ID]uint64, error) {
+	seqs := map[peer.ID]uint64{}
+	prefix := SeqKey.ChildString(f.Group.ID)
+	rs, err := f.Group.Store.Query(ctx, query.Query{Prefix: prefix.String()})
+	if err != nil {
+		return seqs, xerrors.Errorf("seq query: %w", err)
+	}
+	defer rs.Close()
+
+	for r := range rs.Next() {
+		if r.Error != nil {
+			return seqs, xerrors.Errorf("seq query: %w", r.Error)
+		}
+		id, err := peer.Decode(datastore.NewKey(r.Key).BaseNamespace())
+		if err != nil || len(r.Value) != 8 {
+			f.log.Warnw("stored seq", "folder", f.Dir, "key", r.Key, "error", err)
 			continue
 		}
-		if nd.Host.ID() == snap.PeerID {
-			continue // myself
+		seqs[id] = binary.BigEndian.Uint64(r.Value)
+	}
+	return seqs, nil
+}
+
+// storeSeq keeps seq as the highest held of id.
+func (f *Folder) storeSeq(ctx context.Context, id peer.ID, seq uint64) {
+	if err := f.Group.Store.Put(ctx, PeerSeqKey(f.Group.ID, id), binary.BigEndian.AppendUint64(nil, seq)); err != nil {
+		f.log.Errorw("store seq", "folder", f.Dir, "peer", id, "error", err)
+	}
+}
+
+// storedSnaps are the snapshots in the CRDT store, one per peer.
+func (f *Folder) storedSnaps(ctx context.Context) ([][]byte, error) {
+	rs, err := f.Group.DS.Query(ctx, query.Query{Prefix: SnapKey.String()})
+	if err != nil {
+		return nil, xerrors.Errorf("snapshot query: %w", err)
+	}
+	defer rs.Close()
+
+	snaps := [][]byte{}
+	for r := range rs.Next() {
+		if r.Error != nil {
+			return nil, xerrors.Errorf("snapshot query: %w", r.Error)
 		}
-		if !lo.Contains(p2p.Peers, snap.PeerID) {
-			continue
+		snaps = append(snaps, r.Value)
+	}
+	return snaps, nil
+}
+
+// receiveSnap verifies a snapshot and applies it, or keeps it in ps until
+// its peer is connected.
+func (f *Folder) receiveSnap(ctx context.Context, data []byte, ps *peerSnaps) {
+	g := f.Group
+	snap, err := Verify(g.ID, data)
+	if err == nil && g.Host.ID() == snap.PeerID {
+		if snap.Seq < f.seq.Load() {
+			f.republish() // put again by another
+			return
 		}
+		f.published(snap.Seq) // by a former run, its store may be older
+		return
+	}
+	if err == nil {
+		if last, ok := ps.last[snap.PeerID]; ok && snap.Seq == last.Seq {
+			return // put again
+		}
+		if held := ps.seqs[snap.PeerID]; snap.Seq < held {
+			err = xerrors.Errorf("seq %d, held %d: %w", snap.Seq, held, ErrReplayed)
+		}
+	}
+	if xerrors.Is(err, ErrUnsigned) || xerrors.Is(err, ErrForged) || xerrors.Is(err, ErrReplayed) {
+		f.dropped.Add(1)
+		reason := "forged"
+		switch {
+		case xerrors.Is(err, ErrUnsigned):
+			reason = "unsigned"
+		case xerrors.Is(err, ErrReplayed):
+			reason = "replayed"
+		}
+		metrics.DroppedSnapshots.WithLabelValues(f.Dir, reason).Inc()
+		f.log.Warnw("dropped snapshot", "folder", f.Dir, "reason", reason, "error", err.Error())
+		return
+	}
+	if err != nil {
+		f.log.Errorw("restore snapshot", "folder", f.Dir, "error", err)
+		return
+	}
+	if !g.Trust.Contains(snap.PeerID) {
+		return // not invited
+	}
+	if f.crypt != nil {
+		snap = f.openSnap(snap)
+	}
+	f.holders.Update(snap)
+	ps.last[snap.PeerID] = snap
+	if snap.Seq > ps.seqs[snap.PeerID] {
+		ps.seqs[snap.PeerID] = snap.Seq
+		f.storeSeq(ctx, snap.PeerID, snap.Seq)
+	}
+	if !g.Member(snap.PeerID) {
+		return
+	}
+	if f.Paused() {
+		ps.paused = true
+		return
+	}
+	ps.online[snap.PeerID] = true
+	f.applySnap(ctx, snap)
+}
 
-		diff, err := snap.Difference(syncDir)
-		if err != nil {
-			log.Printf("diff(snap) failed: %+v\n", err)
+// applySnap brings the folder up to date with the snapshot of a connected
+// peer.
+func (f *Folder) applySnap(ctx context.Context, snap *Snap) {
+	switch f.opts.Mode {
+	case SendOnly:
+		return // remote changes are never applied
+	case Relay:
+		f.relayApply(ctx, snap)
+		return
+	}
+
+	if err := f.reconcile(ctx); err != nil {
+		f.Health.Fail("reconcile(index)", err)
+		return
+	}
+	diff := calcDiff(f.entries(), snap.Metas)
+	f.log.Debugw("diff", "folder", f.Dir, "peer", snap.PeerID, "adds", len(diff.Adds), "modifies", len(diff.Modifies), "deletes", len(diff.Deletes), "conflicts", len(diff.Conflicts))
+	for _, meta := range append(diff.Adds, diff.Modifies...) {
+		if meta.IsDir || f.opts.Ignore.Match(meta.Path) {
 			continue
 		}
+		f.Transfers.Push(meta.Path, snap.PeerID, meta.Size, meta)
+	}
+	func() {
+		if err := f.locker.Acquire(ctx, 1); err != nil {
+			f.log.Errorw("locker acquire", "error", err)
+			return
+		}
+		defer f.locker.Release(1)
 
-		// fmt.Printf("diff: A:%d, M:%d, D:%d\n", len(diff.Adds), len(diff.Modifies), len(diff.Deletes))
-		func() {
-			if err := locker.Acquire(context.Background(), 1); err != nil {
-				log.Printf("locker.Acquire: %+v\n", err)
-				return
+		for _, meta := range diff.Tombs {
+			if meta.IsDir || f.opts.Ignore.Match(meta.Path) {
+				continue
+			}
+			if _, ok := f.Index.Get(meta.Path); ok {
+				continue // seen meanwhile
+			}
+			if err := f.applied(ctx, meta.Entry()); err != nil {
+				f.log.Errorw("index applied", "folder", f.Dir, "path", meta.Path, "error", err)
+			}
+		}
+		for _, meta := range diff.Deletes {
+			if meta.IsDir || f.opts.Ignore.Match(meta.Path) {
+				continue
+			}
+			if f.opts.Mode != ReceiveOnly && f.Index.Stale(f.Dir, meta.Path) {
+				continue // edited since the last scan, the edit wins once published
+			}
+			ev := &event.Event{Op: event.Remove, Path: meta.Path}
+
+			f.origins.ExpectRemove(ev.Path)
+			if err := f.remove(ev); err != nil && !xerrors.Is(err, os.ErrNotExist) {
+				f.origins.Forget(ev.Path)
+				f.log.Errorw("delete file", "folder", f.Dir, "path", ev.Path, "error", err)
+			} else if err := f.applied(ctx, meta.Entry()); err != nil {
+				f.log.Errorw("index applied", "folder", f.Dir, "path", ev.Path, "error", err)
+			} else {
+				f.publish(bus.Event{Type: bus.RemoteChangeApplied, Path: ev.Path, Peer: snap.PeerID.String(), Op: ev.Op.String()})
 			}
-			defer locker.Release(1)
 
-			for _, meta := range diff.Adds {
-				if meta.IsDir {
-					continue
-				}
-				ev, err := notifyRead(nd.Host, snap.PeerID, meta.Path)
-				if err != nil {
-					log.Printf("notifyRead(Add) failed: %+v\n", err)
-					continue
-				}
-				ev.Op = event.Write
+			f.disp.Recver(ev)
+		}
+	}()
+}
 
-				recvs.Append(ev.Path)
-				if err := ev.Write(); err != nil {
-					log.Printf("write read stream(Add) failed: %+v\n", err)
-				}
-				time.AfterFunc(time.Second, func() { recvs.Remove(ev.Path) })
+// SyncWatcher publishes local changes until ctx is done, a value on rescan
+// publishes whatever changed without waiting for the watcher. A watcher that
+// can't start or stops is retried with backoff, the error is kept in health.
+func (f *Folder) SyncWatcher(ctx context.Context, rescan <-chan struct{}) {
+	b := &retry.Backoff{Min: time.Second, Max: time.Minute, Clock: f.opts.Clock}
 
-				event.DispRecver(ev)
-			}
-			for _, meta := range diff.Modifies {
-				if meta.IsDir {
-					continue
-				}
-				ev, err := notifyRead(nd.Host, snap.PeerID, meta.Path)
-				if err != nil {
-					log.Printf("notifyRead(Modify) failed: %+v\n", err)
-					continue
-				}
-				ev.Op = event.Write
+	for {
+		var w watch.Watcher
+		err := retry.Do(ctx, b, func(ctx context.Context) error {
+			var err error
+			w, err = watch.New(f.Dir, f.opts.Watcher, f.opts.Interval)
+			return err
+		}, func(err error) {
+			f.Health.Fail("start watcher", err)
+		})
+		if err != nil {
+			return // ctx is done
+		}
 
-				recvs.Append(ev.Path)
-				if err := ev.Write(); err != nil {
-					log.Printf("write read stream(Modify) failed: %+v\n", err)
-				}
-				time.AfterFunc(time.Second, func() { recvs.Remove(ev.Path) })
+		f.syncLoop(ctx, w, rescan)
+		w.Close()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-f.opts.Clock.After(b.Next()):
+			f.Health.Fail("watcher", xerrors.New("watcher stopped, restarting"))
+		}
+	}
+}
+
+func (f *Folder) syncLoop(ctx context.Context, w watch.Watcher, rescan <-chan struct{}) {
+	syncDir, settle := f.Dir, f.opts.Settle
+
+	var (
+		pending = map[string]watch.Op{}
+		dirty   = f.Paused() // published once resumed
+		timer   = f.opts.Clock.NewTimer(settle)
+	)
+	defer timer.Stop()
+
+	// Publish what changed while we were offline
+	if !dirty {
+		if err := f.snapsnap(ctx); err != nil && !xerrors.Is(err, errBusy) {
+			f.Health.Fail("send snapshot", err)
+		} else {
+			f.Health.OK()
+		}
+	}
 
-				event.DispRecver(ev)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-rescan:
+			dirty = true
+			timer.Reset(0)
+		case <-f.rescans:
+			dirty = true
+			timer.Reset(0)
+		case <-f.merged:
+			dirty = true
+			timer.Reset(settle)
+		case ev, ok := <-w.Events():
+			if !ok {
+				return
+			}
+			relPath := dev.RelativePath(syncDir, ev.Path) // basename := filepath.Base(ev.Path)
+			if f.opts.Ignore.Match(relPath) {
+				f.log.Debugw("ignored", "folder", syncDir, "path", relPath)
+				continue
 			}
-			for _, meta := range diff.Deletes {
-				if meta.IsDir {
+
+			pending[relPath] = ev.Op
+			metrics.WatcherEvents.WithLabelValues(f.Dir, ev.Op.String()).Inc()
+			timer.Reset(settle)
+		case <-timer.C():
+			for relPath, op := range pending {
+				path := filepath.Join(syncDir, relPath)
+				if f.origins.Match(path, relPath) {
+					f.log.Debugw("applied from a peer", "folder", syncDir, "path", relPath)
 					continue
 				}
-				ev := &event.Event{Op: event.Remove, Path: meta.Path}
 
-				recvs.Append(ev.Path)
-				if err := ev.Remove(); err != nil {
-					log.Printf("delete file(Remove) failed: %+v\n", err)
+				switch op {
+				case watch.Create:
+					f.disp.SendCreated(relPath)
+				case watch.Remove:
+					f.disp.SendRemoved(relPath)
+				case watch.Write:
+					f.disp.SendWritten(relPath)
+				case watch.Rename:
+					f.disp.SendRenamed(relPath)
 				}
-				time.AfterFunc(time.Second, func() { recvs.Remove(ev.Path) })
+				f.publish(bus.Event{Type: bus.LocalChangeDetected, Path: relPath, Op: op.String()})
+				f.opts.WriteCheck.UntilWritten(path)
+				dirty = true
+			}
+			pending = map[string]watch.Op{}
+			if !dirty || f.Paused() {
+				continue // a paused one is published by the Rescan of Resume
+			}
 
-				event.DispRecver(ev)
+			err := f.snapsnap(ctx)
+			if xerrors.Is(err, errBusy) {
+				timer.Reset(settle) // SnapWatcher is applying, retry later
+				continue
 			}
-		}()
+			if err != nil {
+				f.Health.Fail("send snapshot", err)
+				if !retry.IsFatal(retry.Classify(err)) {
+					timer.Reset(time.Second) // a fatal one waits for the next event
+				}
+				continue
+			}
+			f.Health.OK()
+			dirty = false
+		}
 	}
 }
 
-func SyncWatcher(nd *p2p.Node, syncDir string) {
-	nCh := make(chan notify.EventInfo)
-
-	if err := notify.Watch(fmt.Sprintf("%s/...", syncDir), nCh, notify.All); err != nil {
-		log.Fatalf("start watcher: %+v\n", err)
+// applied records a change made on behalf of a peer. One that merged a
+// concurrent version is published, the peers know neither side of it.
+func (f *Folder) applied(ctx context.Context, e *index.Entry) error {
+	if err := f.Index.Applied(ctx, f.Dir, e); err != nil {
+		return err
 	}
-	defer notify.Stop(nCh)
-
-	for ev := range nCh {
-		relPath := dev.RelativePath(syncDir, ev.Path()) // basename := filepath.Base(ev.Path())
-
-		if syncs.Contains(relPath) {
-			// fmt.Printf("syncs: %s\n", relPath)
-			continue
-		}
-		if recvs.Contains(relPath) {
-			// fmt.Printf("recvs: %s\n", relPath)
-			continue
-		}
-		ignores := lo.Filter(dev.IgnoreNames, func(ig string, _ int) bool {
-			return strings.HasPrefix(relPath, ig)
-		})
-		if len(ignores) != 0 {
-			// fmt.Printf("ignores: %s\n", relPath)
-			continue
-		}
-
-		syncs.Append(relPath)
-		switch ev.Event() {
-		case notify.Create:
-			event.DispSendCreated(relPath)
-		case notify.Remove:
-			event.DispSendRemoved(relPath)
-		case notify.Write:
-			event.DispSendWritten(relPath)
-		case notify.Rename:
-			event.DispSendRenamed(relPath)
+	if cur, ok := f.Index.Get(e.Path); ok && !cur.Synced {
+		select {
+		case f.merged <- struct{}{}:
+		default:
 		}
-		time.AfterFunc(time.Second, func() { syncs.Remove(relPath) })
+	}
+	return nil
+}
 
-		var (
-			lastTime time.Time
-			interval = 60 * time.Second
-		)
+// reconcile scans the folder into its index.
+func (f *Folder) reconcile(ctx context.Context) error {
+	defer metrics.Since(metrics.ScanSeconds.WithLabelValues(f.Dir), f.opts.Clock, f.opts.Clock.Now())
+	_, err := f.Index.Reconcile(ctx, f.Dir)
+	return err
+}
 
-		elapsed := time.Since(lastTime)
-		if elapsed < interval {
-			continue
-		}
-		dev.UntilWritten(ev.Path())
+func (f *Folder) snapsnap(ctx context.Context) error {
+	if !f.locker.TryAcquire(1) {
+		return errBusy
+	}
+	defer f.locker.Release(1)
 
-		err := snapsnap(nd, syncDir)
-		if err != nil && !xerrors.Is(err, errBusy) {
-			log.Printf("send snapshot: %+v\n", err)
+	idx := f.Index
+	if f.opts.Mode != Relay {
+		if err := f.reconcile(ctx); err != nil {
+			return xerrors.Errorf("reconcile: %w", err)
 		}
-
-		lastTime = time.Now()
 	}
-}
-
-func snapsnap(nd *p2p.Node, syncDir string) error {
-	if !locker.TryAcquire(1) {
-		return errBusy
+	if f.opts.Mode == ReceiveOnly {
+		return nil // local changes stay local, see Revert
+	}
+	entries := idx.Entries()
+	replaced := f.replaced.Load()
+	if !replaced && lo.EveryBy(entries, func(e *index.Entry) bool { return e.Synced }) {
+		return nil // nothing new to publish
 	}
-	defer locker.Release(1)
 
-	sshot, err := Snapshot(nd.Host.ID(), syncDir)
-	if err != nil {
-		return xerrors.Errorf("snapshot: %w", err)
+	snap := Snapshot(f.Group.Host.ID(), entries)
+	if f.crypt != nil {
+		var err error
+		if snap, err = f.sealSnap(ctx, entries); err != nil {
+			return xerrors.Errorf("seal snapshot: %w", err)
+		}
 	}
-	data, err := sshot.Marshal()
+	key := f.Group.Host.Peerstore().PrivKey(f.Group.Host.ID())
+	if key == nil {
+		return retry.Fatal(xerrors.New("snapshot: no private key"))
+	}
+	snap.Seq = f.nextSeq()
+	data, err := snap.Sign(f.Group.ID, key)
 	if err != nil {
-		return xerrors.Errorf("snapshot Marshal: %w", err)
+		return xerrors.Errorf("snapshot sign: %w", err)
 	}
-	if err := nd.DS.Put(context.Background(), SnapKey, data); err != nil {
+	start := f.opts.Clock.Now()
+	if err := f.Group.DS.Put(ctx, PeerSnapKey(f.Group.Host.ID()), data); err != nil {
 		return xerrors.Errorf("snapshot ds.Put: %w", err)
 	}
+	metrics.Since(metrics.CRDTPutSeconds.WithLabelValues(f.Group.ID), f.opts.Clock, start)
+	f.storeSeq(ctx, f.Group.Host.ID(), snap.Seq)
+	if replaced {
+		f.replaced.Store(false)
+	}
+	if err := idx.Published(ctx, entries); err != nil {
+		return xerrors.Errorf("index published: %w", err)
+	}
 
-	// log.Printf("put snapshot: %d bytes\n", len(data))
+	f.log.Debugw("put snapshot", "folder", f.Dir, "bytes", len(data))
 	return nil
 }
+
+// nextSeq is the sequence number of the next snapshot published. It starts
+// from the clock, so that a device whose store was lost still publishes
+// newer snapshots than the ones its peers hold.
+func (f *Folder) nextSeq() uint64 {
+	seq := f.seq.Add(1)
+	if now := uint64(f.opts.Clock.Now().UnixNano()); now > seq {
+		seq = now
+	}
+	f.published(seq)
+	return seq
+}
+
+// republish puts the snapshot of this peer again, an older one replaced it
+// in the CRDT.
+func (f *Folder) republish() {
+	f.log.Warnw("older snapshot put again, republishing", "folder", f.Dir)
+	f.replaced.Store(true)
+	ch := f.merged
+	if f.opts.Mode == Relay {
+		ch = f.stored
+	}
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+// published records seq published by this peer.
+func (f *Folder) published(seq uint64) {
+	for {
+		last := f.seq.Load()
+		if seq <= last || f.seq.CompareAndSwap(last, seq) {
+			return
+		}
+	}
+}
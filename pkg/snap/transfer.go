@@ -0,0 +1,146 @@
+package snap
+
+import (
+	"context"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/xerrors"
+
+	"github.com/threecorp/peerdrive/pkg/bus"
+	"github.com/threecorp/peerdrive/pkg/event"
+	"github.com/threecorp/peerdrive/pkg/index"
+	"github.com/threecorp/peerdrive/pkg/metrics"
+	"github.com/threecorp/peerdrive/pkg/transfer"
+)
+
+// Transfers is the download queue of the sync folder.
+type Transfers = transfer.Queue[*Meta]
+
+// progressInterval spaces the TransferProgress events of a transfer.
+const progressInterval = time.Second
+
+// fetch runs download, telling the event bus when the transfer starts, how
+// far it got and how it finished.
+func (f *Folder) fetch(ctx context.Context, it *transfer.Item[*Meta]) error {
+	ev := bus.Event{Path: it.Path, Peer: it.Peer.String(), Size: it.Size}
+	started := ev
+	started.Type = bus.TransferStarted
+	f.publish(started)
+
+	var last atomic.Int64
+	last.Store(f.opts.Clock.Now().UnixNano())
+	progress := func(n int64) {
+		it.Progress(n)
+		prev, now := last.Load(), f.opts.Clock.Now().UnixNano()
+		if now-prev < int64(progressInterval) || !last.CompareAndSwap(prev, now) {
+			return
+		}
+		p := ev
+		p.Type, p.Done = bus.TransferProgress, n
+		f.publish(p)
+	}
+
+	err := f.download(ctx, it, progress)
+	finished := ev
+	finished.Type, finished.Done = bus.TransferFinished, it.Done()
+	if err != nil {
+		finished.Error = err.Error()
+	}
+	f.publish(finished)
+	return err
+}
+
+// download fetches a file block by block into the work area, in parallel from
+// every peer holding the same content, and moves it into the sync folder once
+// complete. An interrupted download resumes from the blocks already verified,
+// the ones of another path with the same content wait for it.
+// Only the final move holds the locker, so local changes keep being
+// published meanwhile.
+func (f *Folder) download(ctx context.Context, it *transfer.Item[*Meta], progress func(int64)) error {
+	meta := it.Value
+	if f.opts.Mode == Relay {
+		if _, err := os.Stat(blobPath(f.Dir, meta.Hash)); err == nil {
+			return f.store(ctx, nil, meta) // same content as another path
+		}
+	}
+
+	release, err := f.partials.lock(ctx, meta.Hash)
+	if err != nil {
+		return err
+	}
+	defer release()
+	pt, err := openPartial(f.Dir, meta.Hash, meta.Size, meta.Block, f.opts.Clock)
+	if err != nil {
+		return err
+	}
+	progress(pt.done())
+
+	wire := func(path string) string {
+		if f.crypt != nil {
+			return f.crypt.sealName(path)
+		}
+		return path
+	}
+	holders := f.holders.Peers(meta, it.Peer, f.Group.Peers())
+	for i := range holders {
+		holders[i].Path = wire(holders[i].Path)
+	}
+	if err := pt.swarm(ctx, f.newStream, holders, progress); err != nil {
+		return xerrors.Errorf("%s incomplete: %w", meta.Path, err)
+	}
+	if f.opts.Mode == Relay {
+		return f.store(ctx, pt, meta)
+	}
+
+	if err := f.locker.Acquire(ctx, 1); err != nil {
+		return xerrors.Errorf("locker.Acquire: %w", err)
+	}
+	defer f.locker.Release(1)
+
+	if e, ok := f.Index.Get(meta.Path); ok {
+		if o := meta.Version.Compare(e.Version); o == index.Before || o == index.Equal {
+			return nil // outdated by a later change meanwhile
+		}
+	}
+	entry := meta.Entry()
+	if f.crypt != nil {
+		if pt, err = f.unseal(pt, wire(meta.Path)); err != nil {
+			return err
+		}
+		entry.Hash, entry.Sealed = pt.Hash, meta.Hash
+	}
+	ev := &event.Event{Op: event.Write, Path: meta.Path, Time: meta.Time, Size: pt.Size}
+	dst, err := ev.FullPath(f.Dir)
+	if err != nil {
+		return err
+	}
+	if f.conflicts(meta) {
+		name, err := f.keepConflict(meta.Path, it.Peer)
+		if err != nil {
+			return err
+		}
+		if name != "" {
+			f.log.Infow("conflict copy", "folder", f.Dir, "path", meta.Path, "copy", name, "peer", it.Peer)
+		}
+	}
+	f.origins.ExpectWrite(meta.Path, pt.Hash, pt.Size, meta.Time)
+	if err := f.archive(meta.Path); err != nil {
+		f.origins.Forget(meta.Path)
+		return xerrors.Errorf("archive %s: %w", meta.Path, err)
+	}
+	if err := pt.commit(dst, meta.Time); err != nil {
+		f.origins.Forget(meta.Path)
+		return xerrors.Errorf("commit %s: %w", meta.Path, err)
+	}
+	f.origins.Written(dst, meta.Path)
+	if err := f.applied(ctx, entry); err != nil {
+		return xerrors.Errorf("index applied: %w", err)
+	}
+
+	f.disp.Recver(ev)
+	metrics.ReceivedFiles.WithLabelValues(it.Peer.String()).Inc()
+	f.publish(bus.Event{Type: bus.RemoteChangeApplied, Path: meta.Path, Peer: it.Peer.String(), Op: ev.Op.String(), Size: pt.Size})
+	return nil
+}
@@ -0,0 +1,105 @@
+package snap
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"golang.org/x/xerrors"
+
+	"github.com/threecorp/peerdrive/pkg/dev"
+	"github.com/threecorp/peerdrive/pkg/event"
+)
+
+const versionsDir = "versions"
+
+// archive keeps the local copy of relPath in the work area before a peer
+// replaces or removes it, keeping the newest Versions copies. Nothing is
+// kept when versioning is off. The file is copied, it stays in place so
+// that a replacement failing later loses nothing.
+func (f *Folder) archive(relPath string) error {
+	if f.opts.Versions <= 0 {
+		return nil
+	}
+	src, err := (&event.Event{Path: relPath}).FullPath(f.Dir)
+	if err != nil {
+		return err
+	}
+	if fi, err := os.Lstat(src); os.IsNotExist(err) || (err == nil && !fi.Mode().IsRegular()) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	dst := filepath.Join(f.Dir, dev.TempName, versionsDir, relPath) + "~" + f.opts.Clock.Now().Format("20060102-150405.000")
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return xerrors.Errorf("versions dir: %w", err)
+	}
+	if err := copyFile(src, dst); err != nil {
+		return xerrors.Errorf("archive %s: %w", relPath, err)
+	}
+	return f.pruneVersions(dst)
+}
+
+// copyFile copies src to dst with its mtime. A hard link would follow the
+// edits made in place.
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	fi, err := in.Stat()
+	if err != nil {
+		return err
+	}
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, fi.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		os.Remove(dst)
+		return err
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(dst)
+		return err
+	}
+	return os.Chtimes(dst, fi.ModTime(), fi.ModTime())
+}
+
+func (f *Folder) pruneVersions(latest string) error {
+	dir, base := filepath.Split(latest)
+	base = base[:strings.LastIndex(base, "~")+1]
+
+	des, err := os.ReadDir(dir)
+	if err != nil {
+		return xerrors.Errorf("versions dir: %w", err)
+	}
+	names := []string{}
+	for _, de := range des {
+		if !de.IsDir() && strings.HasPrefix(de.Name(), base) {
+			names = append(names, de.Name())
+		}
+	}
+	sort.Strings(names) // timestamps sort oldest first
+	for len(names) > f.opts.Versions {
+		if err := os.Remove(filepath.Join(dir, names[0])); err != nil && !os.IsNotExist(err) {
+			return xerrors.Errorf("prune version: %w", err)
+		}
+		names = names[1:]
+	}
+	return nil
+}
+
+// remove applies a deletion by a peer, archived when versioning is on.
+func (f *Folder) remove(ev *event.Event) error {
+	if err := f.archive(ev.Path); err != nil {
+		return err
+	}
+	return ev.Remove(f.Dir)
+}
@@ -0,0 +1,56 @@
+package snap
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/threecorp/peerdrive/pkg/clock"
+	"github.com/threecorp/peerdrive/pkg/dev"
+	"github.com/threecorp/peerdrive/pkg/event"
+)
+
+// TestArchive keeps the newest copies of a file while it stays in place
+// until replaced.
+func TestArchive(t *testing.T) {
+	dir := t.TempDir()
+	f := &Folder{Dir: dir, opts: Options{Versions: 2}}
+	path := filepath.Join(dir, "a.txt")
+
+	for i, data := range []string{"one", "two", "three"} {
+		if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+		f.opts.Clock = clock.Skewed(clock.OrReal(nil), time.Duration(i)*time.Second)
+		if err := f.archive("a.txt"); err != nil {
+			t.Fatal(err)
+		}
+		if got, err := os.ReadFile(path); err != nil || string(got) != data {
+			t.Fatalf("archived a.txt left %q, error %v", got, err)
+		}
+	}
+
+	versions, err := filepath.Glob(filepath.Join(dir, dev.TempName, versionsDir, "a.txt~*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := []string{}
+	for _, v := range versions {
+		data, err := os.ReadFile(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, string(data))
+	}
+	if len(got) != 2 || got[0] != "two" || got[1] != "three" {
+		t.Errorf("versions %q, want two and three", got)
+	}
+
+	if err := f.remove(&event.Event{Op: event.Remove, Path: "a.txt"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Lstat(path); !os.IsNotExist(err) {
+		t.Errorf("removed a.txt still there: %v", err)
+	}
+}
@@ -0,0 +1,362 @@
+package transfer
+
+import (
+	"container/heap"
+	"context"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+
+	"github.com/threecorp/peerdrive/pkg/clock"
+)
+
+type State uint
+
+const (
+	Queued State = iota
+	Active
+	Retrying
+	Failed
+)
+
+var states = map[State]string{
+	Queued:   "QUEUED",
+	Active:   "ACTIVE",
+	Retrying: "RETRYING",
+	Failed:   "FAILED",
+}
+
+func (s State) String() string {
+	if st, ok := states[s]; ok {
+		return st
+	}
+	return "???"
+}
+
+type Options struct {
+	Workers    int           // transfers running at once
+	PerPeer    int           // transfers running at once against one peer
+	Retries    int           // attempts after the first one
+	Backoff    time.Duration // first retry delay, doubled per attempt
+	MaxBackoff time.Duration
+	Clock      clock.Clock // nil is clock.Real
+}
+
+func DefaultOptions() Options {
+	return Options{
+		Workers:    8,
+		PerPeer:    4,
+		Retries:    5,
+		Backoff:    time.Second,
+		MaxBackoff: time.Minute,
+	}
+}
+
+// Item is a single file transfer. Value carries what the transfer func needs.
+type Item[T any] struct {
+	Path    string
+	Peer    peer.ID
+	Size    int64
+	Value   T
+	State   State
+	Attempt int
+	Err     error
+	Started time.Time
+
+	done  int64
+	again *Item[T] // pushed while active, runs once this one finished
+}
+
+// Progress reports bytes transferred so far.
+func (it *Item[T]) Progress(n int64) {
+	atomic.StoreInt64(&it.done, n)
+}
+
+func (it *Item[T]) Done() int64 {
+	return atomic.LoadInt64(&it.done)
+}
+
+// Func performs the transfer, a returned error retries it with backoff.
+type Func[T any] func(ctx context.Context, it *Item[T]) error
+
+// Queue runs transfers with a bounded number of workers, at most PerPeer
+// against the same peer, smallest files first.
+type Queue[T any] struct {
+	mu      sync.Mutex
+	cond    *sync.Cond
+	opts    Options
+	fn      Func[T]
+	pending itemHeap[T]
+	items   map[string]*Item[T] // by path, queued, active or retrying
+	failed  []*Item[T]
+	gaveUp  int
+	actives map[peer.ID]int
+	closed  bool
+	paused  bool
+	wg      sync.WaitGroup
+
+	workCtx    context.Context
+	cancelWork context.CancelFunc
+}
+
+const maxFailed = 100
+
+func New[T any](opts Options, fn Func[T]) *Queue[T] {
+	def := DefaultOptions()
+	if opts.Workers <= 0 {
+		opts.Workers = def.Workers
+	}
+	if opts.PerPeer <= 0 {
+		opts.PerPeer = opts.Workers
+	}
+	if opts.Backoff <= 0 {
+		opts.Backoff = def.Backoff
+	}
+	if opts.MaxBackoff < opts.Backoff {
+		opts.MaxBackoff = opts.Backoff
+	}
+	opts.Clock = clock.OrReal(opts.Clock)
+
+	q := &Queue[T]{
+		opts:    opts,
+		fn:      fn,
+		items:   map[string]*Item[T]{},
+		actives: map[peer.ID]int{},
+	}
+	q.cond = sync.NewCond(&q.mu)
+	q.workCtx, q.cancelWork = context.WithCancel(context.Background())
+	return q
+}
+
+// Start runs the workers. Once ctx is done no new transfer starts, the
+// running ones are left to Drain.
+func (q *Queue[T]) Start(ctx context.Context) {
+	go func() {
+		<-ctx.Done()
+		q.mu.Lock()
+		q.closed = true
+		q.cond.Broadcast()
+		q.mu.Unlock()
+	}()
+
+	for i := 0; i < q.opts.Workers; i++ {
+		q.wg.Add(1)
+		go q.work()
+	}
+}
+
+// Drain stops starting transfers and waits for the running ones until ctx
+// is done, then cancels what is left.
+func (q *Queue[T]) Drain(ctx context.Context) {
+	q.mu.Lock()
+	q.closed = true
+	q.cond.Broadcast()
+	q.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		q.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+		q.cancelWork()
+		<-done
+	}
+	q.cancelWork()
+}
+
+// Push queues a transfer of path. A path that is still queued is replaced,
+// one that is running is queued again once it finished.
+func (q *Queue[T]) Push(path string, peerID peer.ID, size int64, value T) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if it, ok := q.items[path]; ok {
+		if it.State == Active {
+			it.again = &Item[T]{Path: path, Peer: peerID, Size: size, Value: value}
+			return
+		}
+		it.Peer, it.Size, it.Value = peerID, size, value
+		if it.State == Queued {
+			heap.Init(&q.pending)
+		}
+		return
+	}
+
+	it := &Item[T]{Path: path, Peer: peerID, Size: size, Value: value}
+	q.items[path] = it
+	heap.Push(&q.pending, it)
+	q.cond.Signal()
+}
+
+// Pause holds the queued transfers until it is called with false, the
+// running ones go on.
+func (q *Queue[T]) Pause(paused bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.paused = paused
+	q.cond.Broadcast()
+}
+
+// Status lists queued, running, retrying and recently failed transfers.
+func (q *Queue[T]) Status() []Item[T] {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	its := []Item[T]{}
+	for _, it := range q.items {
+		its = append(its, q.snapshot(it))
+	}
+	for _, it := range q.failed {
+		its = append(its, q.snapshot(it))
+	}
+	sort.Slice(its, func(i, j int) bool {
+		if its[i].State != its[j].State {
+			return its[i].State < its[j].State
+		}
+		return its[i].Size < its[j].Size
+	})
+	return its
+}
+
+// GaveUp counts the transfers that failed for good since New.
+func (q *Queue[T]) GaveUp() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return q.gaveUp
+}
+
+func (q *Queue[T]) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return len(q.items)
+}
+
+func (q *Queue[T]) snapshot(it *Item[T]) Item[T] {
+	c := *it
+	c.done = it.Done()
+	return c
+}
+
+func (q *Queue[T]) work() {
+	defer q.wg.Done()
+	ctx := q.workCtx
+
+	for {
+		it := q.next()
+		if it == nil {
+			return
+		}
+
+		err := q.fn(ctx, it)
+
+		q.mu.Lock()
+		q.actives[it.Peer]--
+		it.Err = err
+		switch {
+		case it.again != nil:
+			q.items[it.Path] = it.again
+			heap.Push(&q.pending, it.again)
+		case err == nil:
+			delete(q.items, it.Path)
+		case ctx.Err() != nil || it.Attempt >= q.opts.Retries:
+			it.State = Failed
+			q.gaveUp++
+			delete(q.items, it.Path)
+			q.failed = append(q.failed, it)
+			if len(q.failed) > maxFailed {
+				q.failed = q.failed[1:]
+			}
+		default:
+			it.State = Retrying
+			q.opts.Clock.AfterFunc(q.backoff(it.Attempt), func() { q.retry(it) })
+			it.Attempt++
+		}
+		q.cond.Broadcast()
+		q.mu.Unlock()
+	}
+}
+
+// next waits for the smallest queued item whose peer has a free slot.
+func (q *Queue[T]) next() *Item[T] {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for {
+		if q.closed {
+			return nil
+		}
+		if q.paused {
+			q.cond.Wait()
+			continue
+		}
+
+		skipped := []*Item[T]{}
+		var it *Item[T]
+		for q.pending.Len() > 0 {
+			cand := heap.Pop(&q.pending).(*Item[T])
+			if q.actives[cand.Peer] < q.opts.PerPeer {
+				it = cand
+				break
+			}
+			skipped = append(skipped, cand)
+		}
+		for _, s := range skipped {
+			heap.Push(&q.pending, s)
+		}
+
+		if it != nil {
+			it.State = Active
+			it.Started = q.opts.Clock.Now()
+			it.Progress(0)
+			q.actives[it.Peer]++
+			return it
+		}
+		q.cond.Wait()
+	}
+}
+
+func (q *Queue[T]) retry(it *Item[T]) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.items[it.Path] != it || it.State != Retrying {
+		return
+	}
+	it.State = Queued
+	heap.Push(&q.pending, it)
+	q.cond.Signal()
+}
+
+func (q *Queue[T]) backoff(attempt int) time.Duration {
+	d := q.opts.Backoff
+	for i := 0; i < attempt && d < q.opts.MaxBackoff; i++ {
+		d *= 2
+	}
+	if d > q.opts.MaxBackoff {
+		d = q.opts.MaxBackoff
+	}
+	return d
+}
+
+type itemHeap[T any] []*Item[T]
+
+func (h itemHeap[T]) Len() int           { return len(h) }
+func (h itemHeap[T]) Less(i, j int) bool { return h[i].Size < h[j].Size }
+func (h itemHeap[T]) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+func (h *itemHeap[T]) Push(x any)        { *h = append(*h, x.(*Item[T])) }
+func (h *itemHeap[T]) Pop() any {
+	old := *h
+	it := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return it
+}
@@ -0,0 +1,209 @@
+package transfer
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+	"golang.org/x/xerrors"
+)
+
+var errTransfer = xerrors.New("transfer failed")
+
+// wait polls cond until it holds or a few seconds passed.
+func wait(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); !cond(); {
+		if time.Now().After(deadline) {
+			t.Fatalf("no %s", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	q := New(Options{Backoff: time.Second, MaxBackoff: 10 * time.Second}, Func[int](nil))
+	for _, tt := range []struct {
+		attempt int
+		want    time.Duration
+	}{
+		{0, time.Second},
+		{1, 2 * time.Second},
+		{3, 8 * time.Second},
+		{4, 10 * time.Second},
+		{100, 10 * time.Second},
+	} {
+		if got := q.backoff(tt.attempt); got != tt.want {
+			t.Errorf("backoff(%d) %v, want %v", tt.attempt, got, tt.want)
+		}
+	}
+}
+
+func TestQueueOrder(t *testing.T) {
+	var mu sync.Mutex
+	order := []string{}
+	q := New(Options{Workers: 1}, func(ctx context.Context, it *Item[int]) error {
+		mu.Lock()
+		defer mu.Unlock()
+		order = append(order, it.Path)
+		return nil
+	})
+	q.Pause(true)
+	q.Start(context.Background())
+	defer q.Drain(context.Background())
+
+	q.Push("large", "a", 300, 0)
+	q.Push("small", "a", 100, 0)
+	q.Push("medium", "a", 200, 0)
+	q.Push("large", "a", 50, 0) // replaced while queued, now the smallest
+	q.Pause(false)
+	wait(t, "transfers", func() bool { return q.Len() == 0 })
+
+	mu.Lock()
+	defer mu.Unlock()
+	want := []string{"large", "small", "medium"}
+	if len(order) != len(want) {
+		t.Fatalf("order %v, want %v", order, want)
+	}
+	for i := range want {
+		if order[i] != want[i] {
+			t.Fatalf("order %v, want %v", order, want)
+		}
+	}
+}
+
+func TestQueuePerPeer(t *testing.T) {
+	var mu sync.Mutex
+	running, most := map[peer.ID]int{}, map[peer.ID]int{}
+	release := make(chan struct{})
+	q := New(Options{Workers: 4, PerPeer: 2}, func(ctx context.Context, it *Item[int]) error {
+		mu.Lock()
+		running[it.Peer]++
+		if running[it.Peer] > most[it.Peer] {
+			most[it.Peer] = running[it.Peer]
+		}
+		mu.Unlock()
+		<-release
+		mu.Lock()
+		running[it.Peer]--
+		mu.Unlock()
+		return nil
+	})
+	q.Start(context.Background())
+	defer q.Drain(context.Background())
+
+	for _, path := range []string{"a1", "a2", "a3", "a4"} {
+		q.Push(path, "a", 1, 0)
+	}
+	q.Push("b1", "b", 1, 0)
+	wait(t, "transfers of both peers", func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return running["a"] == 2 && running["b"] == 1
+	})
+	close(release)
+	wait(t, "transfers", func() bool { return q.Len() == 0 })
+
+	mu.Lock()
+	defer mu.Unlock()
+	if most["a"] != 2 {
+		t.Errorf("%d transfers at once against a, want 2", most["a"])
+	}
+}
+
+func TestQueueRetry(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		failures int // before the transfer succeeds
+		retries  int
+		attempts int
+		gaveUp   int
+	}{
+		{"first attempt", 0, 2, 1, 0},
+		{"retried", 2, 2, 3, 0},
+		{"gave up", 5, 2, 3, 1},
+		{"no retries", 1, 0, 1, 1},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var mu sync.Mutex
+			attempts := 0
+			q := New(Options{Workers: 1, Retries: tt.retries, Backoff: time.Millisecond}, func(ctx context.Context, it *Item[int]) error {
+				mu.Lock()
+				defer mu.Unlock()
+				attempts++
+				if attempts <= tt.failures {
+					return errTransfer
+				}
+				return nil
+			})
+			q.Start(context.Background())
+			defer q.Drain(context.Background())
+
+			q.Push("a.txt", "a", 1, 0)
+			wait(t, "transfer", func() bool { return q.Len() == 0 })
+
+			mu.Lock()
+			defer mu.Unlock()
+			if attempts != tt.attempts {
+				t.Errorf("%d attempts, want %d", attempts, tt.attempts)
+			}
+			if q.GaveUp() != tt.gaveUp {
+				t.Errorf("gave up %d, want %d", q.GaveUp(), tt.gaveUp)
+			}
+			st := q.Status()
+			if tt.gaveUp > 0 && (len(st) != 1 || st[0].State != Failed || !xerrors.Is(st[0].Err, errTransfer)) {
+				t.Errorf("status %v, want the failed transfer", st)
+			}
+		})
+	}
+}
+
+// TestQueuePushActive pushes a path while it transfers, which runs again
+// with the latest value.
+func TestQueuePushActive(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	values := make(chan int, 2)
+	q := New(Options{Workers: 2}, func(ctx context.Context, it *Item[int]) error {
+		values <- it.Value
+		if it.Value == 1 {
+			close(started)
+			<-release
+		}
+		return nil
+	})
+	q.Start(context.Background())
+	defer q.Drain(context.Background())
+
+	q.Push("a.txt", "a", 1, 1)
+	<-started
+	q.Push("a.txt", "a", 1, 2)
+	close(release)
+	wait(t, "transfers", func() bool { return q.Len() == 0 && len(values) == 2 })
+	if first, second := <-values, <-values; first != 1 || second != 2 {
+		t.Errorf("values %d then %d, want 1 then 2", first, second)
+	}
+}
+
+// TestQueueDrain cancels the transfer still running once the context of
+// Drain is done.
+func TestQueueDrain(t *testing.T) {
+	started := make(chan struct{})
+	q := New(Options{Workers: 1}, func(ctx context.Context, it *Item[int]) error {
+		close(started)
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	q.Start(context.Background())
+	q.Push("a.txt", "a", 1, 0)
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	q.Drain(ctx)
+	if q.GaveUp() != 1 {
+		t.Errorf("gave up %d, want the canceled transfer", q.GaveUp())
+	}
+}
@@ -0,0 +1,30 @@
+//go:build linux
+
+package watch
+
+import "syscall"
+
+// remoteTypes are the filesystems whose changes made by other machines, or
+// beneath the kernel, never reach inotify.
+var remoteTypes = map[uint32]string{
+	0x6969:     "nfs",
+	0x517b:     "smb",
+	0xff534d42: "cifs",
+	0xfe534d42: "smb2",
+	0x65735546: "fuse",
+	0x01021997: "9p",
+	0x5346414f: "afs",
+	0x47504653: "gpfs",
+	0x0bd00bd0: "lustre",
+	0x73757245: "coda",
+}
+
+// remoteFS names the filesystem of dir if notify can't be trusted on it.
+func remoteFS(dir string) (string, bool) {
+	st := syscall.Statfs_t{}
+	if err := syscall.Statfs(dir, &st); err != nil {
+		return "", false
+	}
+	name, ok := remoteTypes[uint32(st.Type)]
+	return name, ok
+}
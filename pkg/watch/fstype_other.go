@@ -0,0 +1,8 @@
+//go:build !linux
+
+package watch
+
+// remoteFS is not detected, notify is used wherever it starts.
+func remoteFS(dir string) (string, bool) {
+	return "", false
+}
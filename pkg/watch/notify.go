@@ -0,0 +1,63 @@
+package watch
+
+import (
+	"fmt"
+
+	"github.com/rjeczalik/notify"
+	"golang.org/x/xerrors"
+)
+
+type notifyWatcher struct {
+	nCh  chan notify.EventInfo
+	evCh chan Event
+	done chan struct{} // closed by Close, events are dropped from then on
+}
+
+func NewNotify(dir string) (Watcher, error) {
+	w := &notifyWatcher{
+		nCh:  make(chan notify.EventInfo, 128),
+		evCh: make(chan Event),
+		done: make(chan struct{}),
+	}
+	if err := notify.Watch(fmt.Sprintf("%s/...", dir), w.nCh, notify.All); err != nil {
+		return nil, xerrors.Errorf("notify watch %s: %w", dir, err)
+	}
+
+	go w.run()
+	return w, nil
+}
+
+func (w *notifyWatcher) run() {
+	defer close(w.evCh)
+
+	for ei := range w.nCh {
+		ev := Event{Path: ei.Path()}
+		switch ei.Event() {
+		case notify.Create:
+			ev.Op = Create
+		case notify.Write:
+			ev.Op = Write
+		case notify.Remove:
+			ev.Op = Remove
+		case notify.Rename:
+			ev.Op = Rename
+		default:
+			continue
+		}
+		select {
+		case w.evCh <- ev:
+		case <-w.done:
+		}
+	}
+}
+
+func (w *notifyWatcher) Events() <-chan Event {
+	return w.evCh
+}
+
+func (w *notifyWatcher) Close() error {
+	close(w.done)
+	notify.Stop(w.nCh)
+	close(w.nCh)
+	return nil
+}
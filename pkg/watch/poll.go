@@ -0,0 +1,84 @@
+package watch
+
+import (
+	"path/filepath"
+	"time"
+
+	"github.com/radovskyb/watcher"
+	"golang.org/x/xerrors"
+
+	"github.com/threecorp/peerdrive/pkg/dev"
+)
+
+type pollWatcher struct {
+	w    *watcher.Watcher
+	evCh chan Event
+	done chan struct{} // closed by Close, events are dropped from then on
+}
+
+func NewPoll(dir string, interval time.Duration) (Watcher, error) {
+	w := watcher.New()
+	w.FilterOps(watcher.Create, watcher.Write, watcher.Remove, watcher.Rename, watcher.Move)
+
+	for _, ig := range dev.IgnoreNames {
+		if err := w.Ignore(filepath.Join(dir, ig)); err != nil {
+			return nil, xerrors.Errorf("poll ignore %s: %w", ig, err)
+		}
+	}
+	if err := w.AddRecursive(dir); err != nil {
+		return nil, xerrors.Errorf("poll watch %s: %w", dir, err)
+	}
+
+	pw := &pollWatcher{w: w, evCh: make(chan Event), done: make(chan struct{})}
+	go pw.run()
+	go func() {
+		if err := w.Start(interval); err != nil {
+			log.Errorw("poll watcher", "error", err)
+		}
+	}()
+
+	return pw, nil
+}
+
+func (pw *pollWatcher) run() {
+	defer close(pw.evCh)
+
+	for {
+		select {
+		case we := <-pw.w.Event:
+			ev := Event{Path: we.Path}
+			switch we.Op {
+			case watcher.Create:
+				ev.Op = Create
+			case watcher.Write:
+				ev.Op = Write
+			case watcher.Remove:
+				ev.Op = Remove
+			case watcher.Rename, watcher.Move:
+				ev.Op, ev.OldPath = Rename, we.OldPath
+			default:
+				continue
+			}
+			select {
+			case pw.evCh <- ev:
+			case <-pw.done: // drained until the watcher takes the close
+			}
+		case err := <-pw.w.Error:
+			log.Errorw("poll watcher", "error", err)
+		case <-pw.w.Closed:
+			return
+		}
+	}
+}
+
+func (pw *pollWatcher) Events() <-chan Event {
+	return pw.evCh
+}
+
+// Close returns at once, the watcher takes the close once done sleeping
+// its interval.
+func (pw *pollWatcher) Close() error {
+	close(pw.done)
+	go pw.w.Close()
+	return nil
+}
@@ -0,0 +1,94 @@
+package watch
+
+import (
+	"time"
+
+	"golang.org/x/xerrors"
+
+	"github.com/threecorp/peerdrive/pkg/logging"
+)
+
+var log = logging.Logger("watch")
+
+type Op uint
+
+const (
+	Create Op = iota
+	Write
+	Remove
+	Rename
+)
+
+var ops = map[Op]string{
+	Create: "CREATE",
+	Write:  "WRITE",
+	Remove: "REMOVE",
+	Rename: "RENAME",
+}
+
+func (o Op) String() string {
+	if op, ok := ops[o]; ok {
+		return op
+	}
+	return "???"
+}
+
+type Event struct {
+	Op
+	Path    string // absolute
+	OldPath string // Rename only, when the backend knows it
+}
+
+// Watcher reports changes beneath a sync folder.
+type Watcher interface {
+	Events() <-chan Event
+	Close() error
+}
+
+type Backend string
+
+const (
+	Auto   Backend = "auto"   // notify, or poll on remote filesystems and when notify can't start
+	Notify Backend = "notify" // inotify, FSEvents, kqueue, ReadDirectoryChangesW
+	Poll   Backend = "poll"   // rescans the tree every interval
+)
+
+const DefaultInterval = 2 * time.Second
+
+func ParseBackend(s string) (Backend, error) {
+	switch b := Backend(s); b {
+	case Auto, Notify, Poll:
+		return b, nil
+	default:
+		return "", xerrors.Errorf("unknown watcher %q, want auto, notify or poll", s)
+	}
+}
+
+// New watches dir with the backend. Auto polls when notify can't start, as
+// when the inotify watch limit is exhausted, and on Linux network and FUSE
+// mounts, where notify starts but misses the changes made elsewhere.
+func New(dir string, backend Backend, interval time.Duration) (Watcher, error) {
+	if interval <= 0 {
+		interval = DefaultInterval
+	}
+
+	switch backend {
+	case Notify:
+		return NewNotify(dir)
+	case Poll:
+		return NewPoll(dir, interval)
+	case Auto, "":
+		if fs, ok := remoteFS(dir); ok {
+			log.Infow("remote filesystem, polling", "folder", dir, "fs", fs, "interval", interval)
+			return NewPoll(dir, interval)
+		}
+		w, err := NewNotify(dir)
+		if err == nil {
+			return w, nil
+		}
+		log.Warnw("notify watcher failed, polling", "interval", interval, "error", err)
+		return NewPoll(dir, interval)
+	default:
+		return nil, xerrors.Errorf("unknown watcher %q", backend)
+	}
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"path/filepath"
+	"time"
+
+	"golang.org/x/xerrors"
+
+	"github.com/threecorp/peerdrive/pkg/client"
+	"github.com/threecorp/peerdrive/pkg/ctrl"
+)
+
+// runRevert drops the local changes of a receive-only folder.
+func runRevert(argv []string) error {
+	fs := flag.NewFlagSet("revert", flag.ExitOnError)
+	addr := fs.String("ctrl", ctrl.DefaultAddr, "Control interface address")
+	if err := fs.Parse(argv); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return xerrors.New("usage: peerdrive revert [-ctrl addr] <folder>")
+	}
+	folder, err := filepath.Abs(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	n, err := client.New(client.Options{Addr: *addr}).Revert(ctx, folder)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Reverted %d files in %s\n", n, folder)
+	return nil
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/threecorp/peerdrive/pkg/client"
+	"github.com/threecorp/peerdrive/pkg/ctrl"
+)
+
+func runStatus(argv []string) error {
+	fs := flag.NewFlagSet("status", flag.ExitOnError)
+	addr := fs.String("ctrl", ctrl.DefaultAddr, "Control interface address")
+	if err := fs.Parse(argv); err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	st, err := client.New(client.Options{Addr: *addr}).Status(ctx)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Peer: %s\n", st.Peer)
+	fmt.Printf("Peers: %d\n", len(st.Peers))
+	for _, p := range st.Peers {
+		fmt.Printf("  %s", p.ID)
+		if p.Name != "" {
+			fmt.Printf(" %s", p.Name)
+		}
+		if p.Connected {
+			fmt.Printf(", connected")
+			if p.Latency > 0 {
+				fmt.Printf(", %s", p.Latency.Round(time.Millisecond))
+			}
+		} else if !p.LastSeen.IsZero() {
+			fmt.Printf(", last seen %s", p.LastSeen.Format(time.RFC3339))
+		}
+		fmt.Printf(": %s\n", strings.Join(p.Folders, ", "))
+	}
+	for _, f := range st.Folders {
+		fmt.Printf("Folder: %s (%s) %s", f.Path, f.Mode, f.State)
+		if f.Paused {
+			fmt.Printf(", paused")
+		}
+		if f.Local > 0 {
+			fmt.Printf(", %d local changes", f.Local)
+		}
+		if f.Dropped > 0 {
+			fmt.Printf(", %d unsigned, forged or replayed snapshots dropped", f.Dropped)
+		}
+		if f.Error != "" {
+			fmt.Printf(" since %s: %s", f.Since.Format(time.RFC3339), f.Error)
+		}
+		fmt.Println()
+	}
+	fmt.Printf("Transfers: %d\n", len(st.Transfers))
+	for _, tr := range st.Transfers {
+		pct := 100.0
+		if tr.Size > 0 {
+			pct = float64(tr.Done) * 100 / float64(tr.Size)
+		}
+		fmt.Printf("  %-8s %5.1f%% %s (%s)", tr.State, pct, tr.Path, tr.Peer)
+		if tr.Error != "" {
+			fmt.Printf(" attempt %d: %s", tr.Attempt, tr.Error)
+		}
+		fmt.Println()
+	}
+	return nil
+}